@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// requireAdmin allows the request only for signed in users whose email is
+// listed in ADMIN_EMAILS (comma separated).
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := sessions.Default(c)
+		email, _ := session.Get("user_email").(string)
+		if session.Get("user_id") == nil || email == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+			return
+		}
+
+		for _, admin := range splitList(os.Getenv("ADMIN_EMAILS")) {
+			if strings.EqualFold(admin, email) {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+	}
+}
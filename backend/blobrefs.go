@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// blobGCGrace is how long an unreferenced blob is kept before it is
+// collected. Collages are stored before their generations exist and covers
+// just before their generation row is created.
+const blobGCGrace = 24 * time.Hour
+
+// errBlobInUse rolls back the removal of a blob that was used again.
+var errBlobInUse = errors.New("blob in use")
+
+// StoredBlob is a file of the store named by the SHA-256 of its content,
+// "<dir>/<sha256>.<ext>". The same bytes saved again, e.g. by a retried
+// request or the same collage sent twice, reuse the file. RefCount is the
+// number of Generation rows whose ImageURL or InputURL points to it, blobs
+// nothing refers to are removed by collectBlobGarbage.
+//
+// Blobs count against the storage quota of their owner from when they are
+// stored until their last reference is released, see setBlobCounted.
+type StoredBlob struct {
+	Key       string    `gorm:"primaryKey" json:"key"`
+	Owner     string    `gorm:"index" json:"owner"` // user charged for the blob
+	SHA256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	RefCount  int       `gorm:"index" json:"ref_count"`
+	Counted   bool      `json:"counted"` // included in the owner's storage usage
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// contentKey returns the key of data saved under dir.
+func contentKey(dir string, data []byte, format string) (string, string) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	return fmt.Sprintf("%s/%s.%s", dir, hash, format), hash
+}
+
+// contentHash returns the SHA-256 in the name of a content addressed key.
+// Files saved before content addressing have other names.
+func contentHash(key string) (string, bool) {
+	name := path.Base(key)
+	hash := strings.TrimSuffix(name, path.Ext(name))
+	if len(hash) != sha256.Size*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", false
+	}
+	return hash, true
+}
+
+// storeBlob saves data under dir unless the same content is already there
+// and returns its key. The blob starts without references, see acquireBlobs.
+func storeBlob(db *gorm.DB, store BlobStore, dir string, data []byte, format string) (string, error) {
+	key, hash := contentKey(dir, data, format)
+	ctx := context.Background()
+
+	var existing StoredBlob
+	if err := db.Where("key = ?", key).Limit(1).Find(&existing).Error; err != nil {
+		return "", err
+	}
+	if existing.Key != "" {
+		// Touch the blob so that the collector leaves it alone
+		db.Model(&StoredBlob{}).Where("key = ?", key).Update("updated_at", time.Now())
+		if err := setBlobCounted(db, key, true); err != nil {
+			return "", err
+		}
+		if _, err := store.Stat(ctx, key); err == nil {
+			fmt.Printf("Image already stored: %s\n", key)
+			return key, nil
+		} else if !errors.Is(err, ErrBlobNotFound) {
+			return "", err
+		}
+	}
+
+	if err := store.Put(ctx, key, data, blobContentType(key)); err != nil {
+		return "", err
+	}
+	if existing.Key != "" {
+		fmt.Printf("Image restored to: %s (size: %d bytes)\n", key, len(data))
+		return key, nil
+	}
+
+	blob := StoredBlob{
+		Key:     key,
+		Owner:   strings.SplitN(key, "/", 2)[0],
+		SHA256:  hash,
+		Size:    int64(len(data)),
+		Counted: true,
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&blob)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return addStorageUsage(tx, blob.Owner, 1, blob.Size)
+	})
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Image saved to: %s (size: %d bytes)\n", key, len(data))
+	return key, nil
+}
+
+// acquireBlobs adds a reference to the blobs behind the storage URLs. Other
+// URLs and files saved before content addressing are ignored.
+func acquireBlobs(tx *gorm.DB, urls ...string) error {
+	for _, fileURL := range urls {
+		key, ok := storagePath(fileURL)
+		if !ok {
+			continue
+		}
+		err := tx.Model(&StoredBlob{}).Where("key = ?", key).
+			Updates(map[string]interface{}{"ref_count": gorm.Expr("ref_count + 1"), "updated_at": time.Now()}).Error
+		if err != nil {
+			return err
+		}
+		if err := setBlobCounted(tx, key, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseBlob removes a reference to the blob behind a storage URL. It
+// returns false for URLs that are not tracked blobs, whose files the caller
+// removes itself. Releasing does not touch the blob, so a blob that was
+// last stored or referenced long ago is collected right away.
+func releaseBlob(tx *gorm.DB, fileURL string) (bool, error) {
+	key, ok := storagePath(fileURL)
+	if !ok {
+		return false, nil
+	}
+	var count int64
+	if err := tx.Model(&StoredBlob{}).Where("key = ?", key).Count(&count).Error; err != nil || count == 0 {
+		return false, err
+	}
+	err := tx.Model(&StoredBlob{}).Where("key = ? AND ref_count > 0", key).
+		UpdateColumn("ref_count", gorm.Expr("ref_count - 1")).Error
+	if err != nil {
+		return true, err
+	}
+
+	// The last reference frees the quota right away, the file is removed later
+	var unreferenced int64
+	if err := tx.Model(&StoredBlob{}).Where("key = ? AND ref_count = 0", key).Count(&unreferenced).Error; err != nil {
+		return true, err
+	}
+	if unreferenced > 0 {
+		return true, setBlobCounted(tx, key, false)
+	}
+	return true, nil
+}
+
+// setBlobCounted adds a blob to or removes it from the storage usage of its
+// owner, unless it already is or is not counted.
+func setBlobCounted(tx *gorm.DB, key string, counted bool) error {
+	var blob StoredBlob
+	if err := tx.Where("key = ?", key).Limit(1).Find(&blob).Error; err != nil || blob.Key == "" {
+		return err
+	}
+	result := tx.Model(&StoredBlob{}).Where("key = ? AND counted = ?", key, !counted).UpdateColumn("counted", counted)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	if counted {
+		return addStorageUsage(tx, blob.Owner, 1, blob.Size)
+	}
+	return addStorageUsage(tx, blob.Owner, -1, -blob.Size)
+}
+
+// collectBlobGarbage removes the blobs that no generation refers to and
+// that were not stored or referenced within grace. It returns the number
+// and the size of the removed blobs.
+func collectBlobGarbage(db *gorm.DB, store BlobStore, grace time.Duration) (int, int64) {
+	cutoff := time.Now().Add(-grace)
+	var blobs []StoredBlob
+	if err := db.Where("ref_count = 0 AND updated_at < ?", cutoff).Find(&blobs).Error; err != nil {
+		fmt.Printf("Warning: Failed to load unreferenced blobs: %v\n", err)
+		return 0, 0
+	}
+
+	var removed int
+	var removedBytes int64
+
+	for _, blob := range blobs {
+		// The blob may have been stored or referenced again in the meantime
+		var deleted bool
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := setBlobCounted(tx, blob.Key, false); err != nil {
+				return err
+			}
+			result := tx.Where("key = ? AND ref_count = 0 AND updated_at < ?", blob.Key, cutoff).Delete(&StoredBlob{})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				// Roll back the usage change
+				return errBlobInUse
+			}
+			deleted = true
+			return nil
+		})
+		if err != nil && !errors.Is(err, errBlobInUse) {
+			fmt.Printf("Warning: Failed to remove blob %s: %v\n", blob.Key, err)
+		}
+		if !deleted {
+			continue
+		}
+		if err := store.Delete(context.Background(), blob.Key); err != nil {
+			fmt.Printf("Warning: Failed to remove %s: %v\n", blob.Key, err)
+			continue
+		}
+		removed++
+		removedBytes += blob.Size
+	}
+	return removed, removedBytes
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrBlobNotFound is returned for keys that are not in the store.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore keeps the stored files, covers and collages, by key. Keys are
+// slash separated paths starting with the owner, e.g. "<userID>/<file>.png",
+// and are the part after /storage/ of the URLs in the database.
+type BlobStore interface {
+	Name() string
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (*BlobInfo, error)
+	// Delete removes a blob, deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every blob whose key starts with prefix
+	List(ctx context.Context, prefix string, fn func(BlobInfo) error) error
+	// PresignGet returns a URL that loads the blob without a session until
+	// ttl passes
+	PresignGet(key string, ttl time.Duration) (string, error)
+}
+
+// FileBlobStore is a BlobStore that keeps blobs in local files, which are
+// then served directly instead of through a presigned URL.
+type FileBlobStore interface {
+	BlobStore
+	FilePath(key string) string
+}
+
+// NewBlobStoreFromEnv returns the store selected with STORAGE_BACKEND:
+// "local" (default) keeps files in STORAGE_DIR, "s3" in an S3 compatible
+// bucket, see NewS3BlobStoreFromEnv.
+func NewBlobStoreFromEnv() (BlobStore, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		return NewLocalBlobStore(localStorageDir())
+	case "s3":
+		return NewS3BlobStoreFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", backend)
+	}
+}
+
+// localStorageDir is the directory of the local store, STORAGE_DIR or
+// ./storage.
+func localStorageDir() string {
+	if dir := os.Getenv("STORAGE_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(".", "storage")
+}
+
+// blobContentType returns the content type for the extension of a key.
+func blobContentType(key string) string {
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// immutableCacheControl is sent with content addressed blobs, their content
+// never changes under the same key.
+const immutableCacheControl = "max-age=31536000, immutable"
+
+// LocalBlobStore keeps blobs as files under a directory. Presigned URLs are
+// our own HMAC signed /storage URLs.
+type LocalBlobStore struct {
+	dir string
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+func (s *LocalBlobStore) Name() string {
+	return "local"
+}
+
+// FilePath returns the file of a key. Keys are cleaned first, so that they
+// cannot point outside of the storage directory.
+func (s *LocalBlobStore) FilePath(key string) string {
+	key = strings.TrimPrefix(path.Clean("/"+key), "/")
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	filePath := s.FilePath(key)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("failed to create user directory: %w", err)
+	}
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to save image: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(s.FilePath(key))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+func (s *LocalBlobStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	info, err := os.Stat(s.FilePath(key))
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.FilePath(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) List(ctx context.Context, prefix string, fn func(BlobInfo) error) error {
+	return filepath.WalkDir(s.dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
+
+func (s *LocalBlobStore) PresignGet(key string, ttl time.Duration) (string, error) {
+	signed, _ := signStorageURL(key, ttl)
+	return signed, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBlobStore runs the BlobStore contract against store.
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+
+	if _, err := store.Stat(ctx, "user-1/missing.png"); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Stat of a missing key: err = %v, want %v", err, ErrBlobNotFound)
+	}
+	if _, err := store.Get(ctx, "user-1/missing.png"); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Get of a missing key: err = %v, want %v", err, ErrBlobNotFound)
+	}
+	if err := store.Delete(ctx, "user-1/missing.png"); err != nil {
+		t.Fatalf("Delete of a missing key: %v", err)
+	}
+
+	blobs := map[string]string{
+		"user-1/cover.png":         "cover",
+		"user-1/collages/a b.jpeg": "collage with a space",
+		"user-2/cover.png":         "other user",
+	}
+	for key, data := range blobs {
+		if err := store.Put(ctx, key, []byte(data), blobContentType(key)); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	for key, data := range blobs {
+		reader, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get %s: %v", key, err)
+		}
+		got, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(got) != data {
+			t.Fatalf("Get %s = %q, %v, want %q", key, got, err, data)
+		}
+
+		info, err := store.Stat(ctx, key)
+		if err != nil {
+			t.Fatalf("Stat %s: %v", key, err)
+		}
+		if info.Key != key || info.Size != int64(len(data)) || info.ModTime.IsZero() {
+			t.Fatalf("Stat %s = %+v", key, info)
+		}
+	}
+
+	// Overwriting replaces the content
+	if err := store.Put(ctx, "user-2/cover.png", []byte("replaced"), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if info, err := store.Stat(ctx, "user-2/cover.png"); err != nil || info.Size != int64(len("replaced")) {
+		t.Fatalf("Stat after overwrite = %+v, %v", info, err)
+	}
+
+	listed := listKeys(t, store, "user-1/")
+	if want := []string{"user-1/collages/a b.jpeg", "user-1/cover.png"}; strings.Join(listed, ",") != strings.Join(want, ",") {
+		t.Fatalf("List user-1/ = %v, want %v", listed, want)
+	}
+	if listed := listKeys(t, store, ""); len(listed) != 3 {
+		t.Fatalf("List = %v, want 3 keys", listed)
+	}
+
+	// Errors of the callback stop the listing
+	stop := errors.New("stop")
+	calls := 0
+	err := store.List(ctx, "", func(BlobInfo) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Fatalf("List with failing callback: err = %v after %d calls", err, calls)
+	}
+
+	if err := store.Delete(ctx, "user-1/cover.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Stat(ctx, "user-1/cover.png"); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Stat after Delete: err = %v, want %v", err, ErrBlobNotFound)
+	}
+	if listed := listKeys(t, store, "user-1/"); len(listed) != 1 {
+		t.Fatalf("List after Delete = %v", listed)
+	}
+}
+
+// listKeys returns the sorted keys below prefix.
+func listKeys(t *testing.T, store BlobStore, prefix string) []string {
+	t.Helper()
+	var keys []string
+	err := store.List(context.Background(), prefix, func(info BlobInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List %q: %v", prefix, err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocalBlobStore(dir)
+	if err != nil {
+		t.Fatalf("NewLocalBlobStore: %v", err)
+	}
+	testBlobStore(t, store)
+
+	if _, err := os.Stat(filepath.Join(dir, "user-1", "collages", "a b.jpeg")); err != nil {
+		t.Fatalf("blob not stored as a file: %v", err)
+	}
+	// A directory is not a blob
+	if _, err := store.Stat(context.Background(), "user-1/collages"); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Stat of a directory: err = %v, want %v", err, ErrBlobNotFound)
+	}
+}
+
+func TestLocalBlobStoreFilePath(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocalBlobStore(dir)
+	if err != nil {
+		t.Fatalf("NewLocalBlobStore: %v", err)
+	}
+
+	for _, key := range []string{"../secret", "user-1/../../secret", "/etc/passwd", "user-1/./../../../x"} {
+		rel, err := filepath.Rel(dir, store.FilePath(key))
+		if err != nil || strings.HasPrefix(rel, "..") {
+			t.Errorf("FilePath(%q) = %s, outside of the storage directory", key, store.FilePath(key))
+		}
+	}
+}
+
+func TestLocalBlobStorePresignGet(t *testing.T) {
+	t.Setenv("BASE_URL", "https://covers.example")
+	t.Setenv("STORAGE_URL_SECRET", "test-secret")
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBlobStore: %v", err)
+	}
+
+	presigned, err := store.PresignGet("user-1/cover.png", time.Hour)
+	if err != nil {
+		t.Fatalf("PresignGet: %v", err)
+	}
+	parsed, err := url.Parse(presigned)
+	if err != nil {
+		t.Fatalf("parse %s: %v", presigned, err)
+	}
+	savedPath, ok := storagePath(parsed.Scheme + "://" + parsed.Host + parsed.Path)
+	if !ok || savedPath != "user-1/cover.png" {
+		t.Fatalf("PresignGet = %s, not a storage URL of the key", presigned)
+	}
+
+	query := parsed.Query()
+	now := time.Now()
+	if !verifyStorageSignature(savedPath, query.Get("expires"), query.Get("sig"), now) {
+		t.Fatal("presigned URL does not verify")
+	}
+	if verifyStorageSignature("user-2/cover.png", query.Get("expires"), query.Get("sig"), now) {
+		t.Fatal("signature verifies for another key")
+	}
+	if verifyStorageSignature(savedPath, query.Get("expires"), query.Get("sig"), now.Add(3*time.Hour)) {
+		t.Fatal("presigned URL verifies after it expired")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	ReservationStatusReserved  = "reserved"
+	ReservationStatusCommitted = "committed"
+	ReservationStatusReleased  = "released"
+)
+
+// ErrNoGenerationsLeft is returned when the user has no credit to reserve.
+var ErrNoGenerationsLeft = errors.New("no generations left")
+
+// CreditReservation holds one generation credit for a job while the
+// provider works. The credit is taken from the user balance when it is
+// reserved, committed when the job succeeds and returned when it fails.
+type CreditReservation struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	UserID    string    `gorm:"index" json:"user_id"`
+	JobID     string    `gorm:"index" json:"job_id"`
+	IsFree    bool      `json:"is_free"`
+	Kind      string    `json:"kind"`                // credit kind the reservation was taken from
+	Status    string    `gorm:"index" json:"status"` // "reserved", "committed", "released"
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ReserveGeneration takes one credit from the user for the job: a free
+// generation first, then a subscription one, then a paid one. Each balance
+// is checked and decremented by a single conditional UPDATE, so concurrent
+// requests can never spend the same credit twice.
+func ReserveGeneration(db *gorm.DB, userID string, jobID string) (*CreditReservation, error) {
+	reservation := &CreditReservation{
+		ID:     uuid.New().String(),
+		UserID: userID,
+		JobID:  jobID,
+		Status: ReservationStatusReserved,
+	}
+
+	now := time.Now()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Restore the free allowance if a new period started
+		if err := grantDailyFree(tx, userID, now); err != nil {
+			return err
+		}
+		// Take back the generations of a subscription that ended
+		if err := expireSubscriptionCredits(tx, userID, now); err != nil {
+			return err
+		}
+
+		for _, kind := range []string{CreditKindFree, CreditKindSubscription, CreditKindPaid} {
+			column := creditColumn(kind)
+			updates := map[string]interface{}{column: gorm.Expr(column + " - 1")}
+			if kind == CreditKindFree {
+				updates["last_free_generation"] = now
+			}
+			result := tx.Model(&User{}).Where("id = ? AND "+column+" > 0", userID).Updates(updates)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 1 {
+				reservation.Kind = kind
+				break
+			}
+		}
+		if reservation.Kind == "" {
+			return ErrNoGenerationsLeft
+		}
+		reservation.IsFree = reservation.Kind == CreditKindFree
+
+		if err := recordCreditChange(tx, userID, reservation.Kind, -1, CreditReasonSpend, jobID, ""); err != nil {
+			return err
+		}
+		return tx.Create(reservation).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reservation, nil
+}
+
+// CommitReservation marks the credit as spent. Committing a reservation
+// that was already committed or released does nothing.
+func CommitReservation(db *gorm.DB, reservationID string) error {
+	return db.Model(&CreditReservation{}).
+		Where("id = ? AND status = ?", reservationID, ReservationStatusReserved).
+		Update("status", ReservationStatusCommitted).Error
+}
+
+// ReleaseReservation returns the reserved credit to the user. The status
+// change and the refund happen in one transaction, and only for a
+// reservation that is still reserved, so a credit is never returned twice.
+// Paid credits of a guest that was merged meanwhile go on to the account.
+func ReleaseReservation(db *gorm.DB, reservationID string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var reservation CreditReservation
+		if err := tx.Where("id = ?", reservationID).First(&reservation).Error; err != nil {
+			return err
+		}
+
+		result := tx.Model(&CreditReservation{}).
+			Where("id = ? AND status = ?", reservationID, ReservationStatusReserved).
+			Update("status", ReservationStatusReleased)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		kind := reservation.Kind
+		if kind == "" {
+			// Reservations made before subscriptions existed
+			kind = CreditKindPaid
+			if reservation.IsFree {
+				kind = CreditKindFree
+			}
+		}
+		column := creditColumn(kind)
+		err := tx.Model(&User{}).
+			Where("id = ?", reservation.UserID).
+			Update(column, gorm.Expr(column+" + 1")).Error
+		if err != nil {
+			return err
+		}
+		if err := recordCreditChange(tx, reservation.UserID, kind, 1, CreditReasonRefund, reservation.JobID, ""); err != nil {
+			return err
+		}
+
+		// The guest signed in while the job ran, its paid credits were moved
+		// to the account and so is this one
+		if kind != CreditKindPaid {
+			return nil
+		}
+		var owner User
+		if err := tx.Where("id = ?", reservation.UserID).First(&owner).Error; err != nil {
+			return err
+		}
+		if owner.MergedInto == "" {
+			return nil
+		}
+		return transferCredits(tx, owner.ID, owner.MergedInto, kind, 1)
+	})
+}
+
+// releaseStaleReservations returns credits reserved more than ttl ago for
+// jobs that are not pending, e.g. when the request crashed before the job
+// was created.
+func releaseStaleReservations(db *gorm.DB, ttl time.Duration) {
+	var reservations []CreditReservation
+	err := db.Where("status = ? AND created_at < ?", ReservationStatusReserved, time.Now().Add(-ttl)).
+		Where("job_id NOT IN (?)", db.Model(&GenerationJob{}).Select("id").
+			Where("status IN ?", []string{JobStatusQueued, JobStatusRunning})).
+		Find(&reservations).Error
+	if err != nil {
+		fmt.Printf("Warning: Failed to load stale credit reservations: %v\n", err)
+		return
+	}
+
+	for _, reservation := range reservations {
+		fmt.Printf("Releasing stale credit reservation %s (job %s)\n", reservation.ID, reservation.JobID)
+		if err := ReleaseReservation(db, reservation.ID); err != nil {
+			fmt.Printf("Warning: Failed to release credit reservation %s: %v\n", reservation.ID, err)
+		}
+	}
+}
+
+// StartReservationSweeper runs releaseStaleReservations every interval.
+func StartReservationSweeper(db *gorm.DB, interval time.Duration, ttl time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			releaseStaleReservations(db, ttl)
+		}
+	}()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// newTestDB opens a migrated SQLite database in a temporary directory.
+// Transactions take the write lock right away and wait for each other
+// instead of failing with "database is locked".
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	t.Setenv("DB_PATH", filepath.Join(t.TempDir(), "test.db")+"?_busy_timeout=10000&_txlock=immediate")
+	db, err := InitDB()
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// newTestUser creates a user with the given free and paid balances,
+// recorded in the ledger. The free period starts now, so no daily grant
+// is due.
+func newTestUser(t *testing.T, db *gorm.DB, free int, paid int) *User {
+	t.Helper()
+	user := &User{
+		ID:              uuid.New().String(),
+		Email:           uuid.New().String() + "@example.com",
+		FreePeriodStart: time.Now().UTC(),
+	}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if free > 0 {
+		if err := AdjustCredits(db, user.ID, CreditKindFree, free, "", "test"); err != nil {
+			t.Fatalf("grant free: %v", err)
+		}
+	}
+	if paid > 0 {
+		if err := AdjustCredits(db, user.ID, CreditKindPaid, paid, "", "test"); err != nil {
+			t.Fatalf("grant paid: %v", err)
+		}
+	}
+	return user
+}
+
+// assertConsistent fails if the user balances differ from the ledger sums.
+func assertConsistent(t *testing.T, db *gorm.DB, userID string) *CreditReconciliation {
+	t.Helper()
+	reconciliation, err := ReconcileCredits(db, userID)
+	if err != nil {
+		t.Fatalf("ReconcileCredits: %v", err)
+	}
+	if !reconciliation.Consistent {
+		t.Fatalf("balances do not match the ledger: %+v", reconciliation)
+	}
+	return reconciliation
+}
+
+func TestReserveGenerationConcurrent(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, db, 1, 5)
+	const available = 6
+	const requests = 24
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var reserved []*CreditReservation
+	var failures []error
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reservation, err := ReserveGeneration(db, user.ID, fmt.Sprintf("job-%d", i))
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failures = append(failures, err)
+				return
+			}
+			reserved = append(reserved, reservation)
+		}(i)
+	}
+	wg.Wait()
+
+	if len(reserved) != available {
+		t.Fatalf("reserved %d generations, want %d", len(reserved), available)
+	}
+	for _, err := range failures {
+		if !errors.Is(err, ErrNoGenerationsLeft) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	kinds := map[string]int{}
+	for _, reservation := range reserved {
+		kinds[reservation.Kind]++
+	}
+	if kinds[CreditKindFree] != 1 || kinds[CreditKindPaid] != 5 {
+		t.Fatalf("reserved kinds = %v, want 1 free and 5 paid", kinds)
+	}
+
+	var count int64
+	db.Model(&CreditReservation{}).Where("user_id = ? AND status = ?", user.ID, ReservationStatusReserved).Count(&count)
+	if count != available {
+		t.Fatalf("%d reservations stored, want %d", count, available)
+	}
+
+	reconciliation := assertConsistent(t, db, user.ID)
+	if reconciliation.FreeBalance != 0 || reconciliation.PaidBalance != 0 {
+		t.Fatalf("balance left after spending everything: %+v", reconciliation)
+	}
+}
+
+func TestReleaseReservationConcurrent(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, db, 0, 1)
+
+	reservation, err := ReserveGeneration(db, user.ID, "job")
+	if err != nil {
+		t.Fatalf("ReserveGeneration: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ReleaseReservation(db, reservation.ID); err != nil {
+				t.Errorf("ReleaseReservation: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	reconciliation := assertConsistent(t, db, user.ID)
+	if reconciliation.PaidBalance != 1 {
+		t.Fatalf("paid balance = %d after releasing one credit, want 1", reconciliation.PaidBalance)
+	}
+
+	// A released reservation can not be committed anymore
+	if err := CommitReservation(db, reservation.ID); err != nil {
+		t.Fatalf("CommitReservation: %v", err)
+	}
+	var stored CreditReservation
+	db.Where("id = ?", reservation.ID).First(&stored)
+	if stored.Status != ReservationStatusReleased {
+		t.Fatalf("status = %s, want %s", stored.Status, ReservationStatusReleased)
+	}
+}
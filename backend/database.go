@@ -19,43 +19,127 @@ type User struct {
 	// Credits
 	FreeGenerationsLeft int       `gorm:"default:0" json:"free_generations_left"`
 	LastFreeGeneration  time.Time `json:"last_free_generation"`
+	FreePeriodStart     time.Time `json:"free_period_start"` // start of the current free allowance period
 	PaidGenerations     int       `gorm:"default:0" json:"paid_generations"`
+	Timezone            string    `json:"timezone"` // IANA zone for the daily free reset, e.g. "Europe/Moscow"
+
+	// Generations of the current subscription period, see Subscription
+	SubscriptionGenerations int `gorm:"default:0" json:"subscription_generations"`
+
+	// Referral program, see Referral
+	ReferralCode string `gorm:"index" json:"referral_code"`
+	ReferredBy   string `gorm:"index" json:"-"`
+	SignupIP     string `json:"-"`
+	LastIP       string `json:"-"`
+
+	// Guests are created for visitors without a session, see GuestManager
+	IsGuest    bool   `gorm:"index" json:"is_guest"`
+	MergedInto string `gorm:"index" json:"-"` // account the guest was merged into on login
+
+	// Stored files counted against the storage quota, see StoredBlob
+	StorageBytes int64 `gorm:"default:0" json:"storage_bytes"`
+	StorageFiles int   `gorm:"default:0" json:"storage_files"`
 }
 
 type Generation struct {
 	ID        string    `gorm:"primaryKey" json:"id"`
 	UserID    string    `gorm:"index" json:"user_id"`
+	BatchID   string    `gorm:"index" json:"batch_id,omitempty"`
 	ImageURL  string    `json:"image_url"`
 	Provider  string    `json:"provider"`
 	IsFree    bool      `json:"is_free"`
+	Cost      float64   `json:"cost"` // provider cost in USD
 	CreatedAt time.Time `json:"created_at"`
+
+	// The result could not be saved and is only at the provider URL
+	RemoteOnly bool `gorm:"index" json:"remote_only,omitempty"`
+	// Refund of the credit, see GenerationRefund
+	RefundID string `json:"refund_id,omitempty"`
+
+	// Prompt of the request, "" is the default prompt of the provider
+	Prompt string `json:"prompt"`
+	// Collage the cover was made from, shared by the variants of a batch
+	InputURL string `json:"input_url,omitempty"`
+
+	// Files were removed by the retention policy, see CleanupStorage
+	Expired bool `gorm:"index" json:"expired,omitempty"`
 }
 
-type Transaction struct {
-	ID          string    `gorm:"primaryKey" json:"id"`
-	UserID      string    `gorm:"index" json:"user_id"`
-	PackageType string    `json:"package_type"` // "pack1", "pack2", "pack3"
-	Amount      float64   `json:"amount"`
-	Currency    string    `json:"currency"` // "USD" or "RUB"
-	Status      string    `json:"status"`    // "pending", "completed", "failed"
-	LavaOrderID string    `gorm:"uniqueIndex" json:"lava_order_id"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+// GenerationBatch groups the variant jobs of one generation request.
+type GenerationBatch struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	UserID    string    `gorm:"index" json:"user_id"`
+	Provider  string    `json:"provider"`
+	Variants  int       `json:"variants"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
-type Package struct {
-	Type     string  `json:"type"`     // "pack1", "pack2", "pack3"
-	Name     string  `json:"name"`
-	Count    int     `json:"count"`    // количество генераций
-	PriceUSD float64 `json:"price_usd"`
-	PriceRUB float64 `json:"price_rub"`
-	Popular  bool    `json:"popular"` // флаг "Популярный"
+type GenerationJob struct {
+	ID                string            `gorm:"primaryKey" json:"id"`
+	UserID            string            `gorm:"index" json:"user_id"`
+	BatchID           string            `gorm:"index" json:"batch_id"`
+	Variant           int               `json:"variant"`  // 0-based index within the batch
+	Provider          string            `json:"provider"` // provider currently handling the job
+	RequestedProvider string            `json:"requested_provider"`
+	Attempts          []ProviderAttempt `gorm:"serializer:json" json:"attempts,omitempty"`
+	Prompt            string            `json:"prompt,omitempty"`
+	Status            string            `gorm:"index" json:"status"` // "queued", "running", "succeeded", "failed"
+	InputImageID      string            `json:"-"`                   // collage key in Redis ("image:<id>")
+	InputFormat       string            `json:"-"`
+	InputURL          string            `json:"-"` // collage saved in storage for the history
+	MaskImageID       string            `json:"-"` // optional edit mask key in Redis
+	ProviderTaskID    string            `gorm:"index" json:"-"`
+	TaskCreatedAt     time.Time         `json:"-"`
+	PollAttempts      int               `json:"poll_attempts,omitempty"`
+	IsFree            bool              `json:"is_free"`
+	ReservationID     string            `json:"-"` // credit held for the job, see ReserveGeneration
+	Cost              float64           `json:"cost,omitempty"`
+	ImageURL          string            `json:"image_url,omitempty"`
+	GenerationID      string            `json:"generation_id,omitempty"`
+	Error             string            `json:"error,omitempty"`
+	CreatedAt         time.Time         `json:"created_at"`
+	UpdatedAt         time.Time         `json:"updated_at"`
 }
 
-var Packages = []Package{
-	{Type: "pack1", Name: "Стартовый", Count: 10, PriceUSD: 2.99, PriceRUB: 249, Popular: false},
-	{Type: "pack2", Name: "Базовый", Count: 30, PriceUSD: 7.99, PriceRUB: 599, Popular: true},
-	{Type: "pack3", Name: "Профессиональный", Count: 100, PriceUSD: 19.99, PriceRUB: 1499, Popular: false},
+// ProviderAttempt is one provider try of a generation job.
+type ProviderAttempt struct {
+	Provider   string    `json:"provider"`
+	Status     string    `json:"status"` // "succeeded", "failed"
+	Error      string    `json:"error,omitempty"`
+	ErrorClass string    `json:"error_class,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+type Transaction struct {
+	ID           string    `gorm:"primaryKey" json:"id"`
+	UserID       string    `gorm:"index" json:"user_id"`
+	PackageType  string    `json:"package_type"` // "pack1", "pack2", "pack3"
+	PackageID    string    `json:"package_id"`   // package snapshot at purchase time
+	PackageName  string    `json:"package_name"`
+	PackageKind  string    `json:"package_kind"`  // "pack" or "subscription"
+	PackageCount int       `json:"package_count"` // generations granted on payment
+	PriceID      string    `json:"price_id"`      // PackagePrice version that was charged
+	Amount       float64   `json:"amount"`
+	Currency     string    `json:"currency"` // "USD" or "RUB"
+	Status       string    `json:"status"`   // "pending", "completed", "failed", "expired"
+	LavaOrderID  string    `gorm:"uniqueIndex" json:"lava_order_id"` // order ID of the payment provider
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+
+	// Payment provider that handled the payment, see PaymentProvider
+	Provider string `gorm:"default:lava;index" json:"provider"`
+
+	// Subscription started or renewed by the payment
+	SubscriptionID         string `gorm:"index" json:"subscription_id,omitempty"`
+	ProviderSubscriptionID string `json:"-"` // set by providers whose renewals refer to their own subscription ID
+
+	// Discount code applied to the payment, Amount is already discounted
+	PromoCode string  `json:"promo_code,omitempty"`
+	Discount  float64 `json:"discount,omitempty"`
+
+	// Set for payments that need a review, see ApplyPaymentEvent
+	FlagReason string  `gorm:"index" json:"flag_reason,omitempty"` // "amount_mismatch"
+	PaidAmount float64 `json:"paid_amount,omitempty"`              // amount the provider reported
 }
 
 func InitDB() (*gorm.DB, error) {
@@ -70,15 +154,38 @@ func InitDB() (*gorm.DB, error) {
 	}
 
 	// Auto migrate
-	err = db.AutoMigrate(&User{}, &Generation{}, &Transaction{})
+	err = db.AutoMigrate(&User{}, &Generation{}, &GenerationBatch{}, &GenerationJob{}, &CreditReservation{}, &CreditLedgerEntry{}, &Package{}, &PackagePrice{}, &Subscription{}, &PromoCode{}, &PromoRedemption{}, &Referral{}, &GenerationRefund{}, &StoredBlob{}, &Transaction{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the default packages on first start
+	if err := seedPackages(db); err != nil {
+		return nil, err
+	}
+
+	// Users created before free periods existed start a new period right away
+	err = db.Model(&User{}).Where("free_period_start IS NULL").Update("free_period_start", time.Time{}).Error
 	if err != nil {
 		return nil, err
 	}
 
+	// Start the ledger of users created before it existed
+	if err := backfillCreditLedger(db); err != nil {
+		return nil, err
+	}
+
+	// Give users created before referrals their code
+	if err := backfillReferralCodes(db); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
 
-func GetOrCreateUser(db *gorm.DB, userID string, email string, name string, picture string) (*User, error) {
+// GetOrCreateUser returns the user, creating it on first login. signup
+// is only used for new users.
+func GetOrCreateUser(db *gorm.DB, userID string, email string, name string, picture string, signup SignupInfo) (*User, error) {
 	var user User
 	err := db.Where("id = ?", userID).First(&user).Error
 	
@@ -89,92 +196,84 @@ func GetOrCreateUser(db *gorm.DB, userID string, email string, name string, pict
 			Email:               email,
 			Name:                name,
 			Picture:             picture,
-			FreeGenerationsLeft: 1, // Start with 1 free generation
+			FreeGenerationsLeft: freeDailyAllowance(),
 			LastFreeGeneration:  time.Time{},
+			FreePeriodStart:     time.Now().UTC(),
 			PaidGenerations:     0,
 		}
-		err = db.Create(&user).Error
+		if validTimezone(signup.Timezone) {
+			user.Timezone = signup.Timezone
+		}
+		user.SignupIP = signup.IP
+		user.LastIP = signup.IP
+		user.ReferralCode, err = newReferralCode(db)
+		if err != nil {
+			return nil, err
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			if user.FreeGenerationsLeft != 0 {
+				if err := recordCreditChange(tx, user.ID, CreditKindFree, user.FreeGenerationsLeft, CreditReasonDailyFreeGrant, "", "signup"); err != nil {
+					return err
+				}
+			}
+			return recordReferral(tx, &user, signup.ReferralCode, signup.IP)
+		})
 		if err != nil {
 			return nil, err
 		}
 	} else if err != nil {
 		return nil, err
 	} else {
-		// Update user info if changed
+		// Update user info if changed, balances are only changed through the ledger
 		user.Email = email
 		user.Name = name
 		user.Picture = picture
-		db.Save(&user)
+		updates := map[string]interface{}{"email": email, "name": name, "picture": picture}
+		if signup.IP != "" {
+			updates["last_ip"] = signup.IP
+		}
+		db.Model(&user).Updates(updates)
 	}
 
 	return &user, nil
 }
 
+// CheckGenerationLimit reports whether the user can generate and how many
+// generations are left. It only reads, a due free allowance is counted but
+// written when it is spent.
 func CheckGenerationLimit(db *gorm.DB, userID string) (bool, int, error) {
 	var user User
-	err := db.Where("id = ?", userID).First(&user).Error
-	if err != nil {
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
 		return false, 0, err
 	}
 
 	now := time.Now()
-	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-	
-	// Reset free generation if new day
-	if user.LastFreeGeneration.Before(today) {
-		user.FreeGenerationsLeft = 1
-		user.LastFreeGeneration = time.Time{}
-		db.Save(&user)
-	}
+	free := availableFreeGenerations(&user, now)
+	subscription := availableSubscriptionGenerations(db, &user, now)
 
 	// Check if user can generate
-	canGenerate := user.FreeGenerationsLeft > 0 || user.PaidGenerations > 0
-	remaining := user.FreeGenerationsLeft + user.PaidGenerations
+	remaining := free + subscription + user.PaidGenerations
+	canGenerate := remaining > 0
 
 	return canGenerate, remaining, nil
 }
 
-func UseGeneration(db *gorm.DB, userID string, isFree bool) error {
-	var user User
-	err := db.Where("id = ?", userID).First(&user).Error
-	if err != nil {
-		return err
-	}
-
-	if isFree {
-		now := time.Now()
-		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-		
-		// Reset if new day
-		if user.LastFreeGeneration.Before(today) {
-			user.FreeGenerationsLeft = 1
+// AddPaidGenerations credits a purchase, transactionID is recorded in the ledger.
+func AddPaidGenerations(db *gorm.DB, userID string, count int, transactionID string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).
+			Where("id = ?", userID).
+			Update("paid_generations", gorm.Expr("paid_generations + ?", count))
+		if result.Error != nil {
+			return result.Error
 		}
-		
-		if user.FreeGenerationsLeft > 0 {
-			user.FreeGenerationsLeft--
-			user.LastFreeGeneration = time.Now()
-		} else {
-			return gorm.ErrRecordNotFound // No free generations left
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
 		}
-	} else {
-		if user.PaidGenerations > 0 {
-			user.PaidGenerations--
-		} else {
-			return gorm.ErrRecordNotFound // No paid generations left
-		}
-	}
-
-	return db.Save(&user).Error
-}
-
-func AddPaidGenerations(db *gorm.DB, userID string, count int) error {
-	var user User
-	err := db.Where("id = ?", userID).First(&user).Error
-	if err != nil {
-		return err
-	}
-
-	user.PaidGenerations += count
-	return db.Save(&user).Error
+		return recordCreditChange(tx, userID, CreditKindPaid, count, CreditReasonPurchase, transactionID, "")
+	})
 }
 
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	JobEventQueued      = "queued"
+	JobEventUploaded    = "uploaded"
+	JobEventTaskCreated = "task_created"
+	JobEventPolling     = "polling"
+	JobEventDownloading = "downloading"
+	JobEventSaved       = "saved"
+	JobEventFailover    = "failover"
+	JobEventSucceeded   = "succeeded"
+	JobEventFailed      = "failed"
+)
+
+// Events are kept for replay so that a client connecting after the job
+// started still sees the earlier transitions.
+const jobEventsTTL = time.Hour
+
+// JobEvent is a single progress update of a generation job. Events are
+// published through Redis so that any backend instance can stream them.
+type JobEvent struct {
+	Seq      int64     `json:"seq"`
+	JobID    string    `json:"job_id"`
+	Type     string    `json:"type"`
+	Message  string    `json:"message,omitempty"`
+	Attempt  int       `json:"attempt,omitempty"`
+	ImageURL string    `json:"image_url,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// IsTerminal reports whether no more events will follow.
+func (e JobEvent) IsTerminal() bool {
+	return e.Type == JobEventSucceeded || e.Type == JobEventFailed
+}
+
+func jobEventsChannel(jobID string) string {
+	return fmt.Sprintf("job:%s:events", jobID)
+}
+
+func jobEventsHistoryKey(jobID string) string {
+	return fmt.Sprintf("job:%s:history", jobID)
+}
+
+func jobEventsSeqKey(jobID string) string {
+	return fmt.Sprintf("job:%s:seq", jobID)
+}
+
+// publishJobEvent appends the event to the job history and broadcasts it
+// to subscribers. Failures are only logged, progress events are best effort.
+func publishJobEvent(ctx context.Context, redisClient *redis.Client, event JobEvent) {
+	seq, err := redisClient.Incr(ctx, jobEventsSeqKey(event.JobID)).Result()
+	if err != nil {
+		fmt.Printf("Warning: Failed to publish job event: %v\n", err)
+		return
+	}
+	event.Seq = seq
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		fmt.Printf("Warning: Failed to marshal job event: %v\n", err)
+		return
+	}
+
+	pipe := redisClient.TxPipeline()
+	pipe.RPush(ctx, jobEventsHistoryKey(event.JobID), payload)
+	pipe.Expire(ctx, jobEventsHistoryKey(event.JobID), jobEventsTTL)
+	pipe.Expire(ctx, jobEventsSeqKey(event.JobID), jobEventsTTL)
+	pipe.Publish(ctx, jobEventsChannel(event.JobID), payload)
+	if _, err := pipe.Exec(ctx); err != nil {
+		fmt.Printf("Warning: Failed to publish job event: %v\n", err)
+	}
+}
+
+// jobEventHistory returns the events published so far for a job.
+func jobEventHistory(ctx context.Context, redisClient *redis.Client, jobID string) ([]JobEvent, error) {
+	items, err := redisClient.LRange(ctx, jobEventsHistoryKey(jobID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]JobEvent, 0, len(items))
+	for _, item := range items {
+		var event JobEvent
+		if err := json.Unmarshal([]byte(item), &event); err != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// jobStateEvent builds a terminal event from the stored job, used when the
+// event history has already expired.
+func jobStateEvent(job *GenerationJob) JobEvent {
+	return JobEvent{
+		JobID:    job.ID,
+		Type:     job.Status,
+		ImageURL: job.ImageURL,
+		Message:  job.Error,
+		Time:     job.UpdatedAt,
+	}
+}
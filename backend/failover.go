@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// Default failover order and the error classes that trigger a failover.
+// Both can be overridden with PROVIDER_FAILOVER and PROVIDER_FAILOVER_ON.
+const (
+	defaultFailoverChain   = "nanobanana,openai"
+	defaultFailoverClasses = "insufficient_balance,rate_limited,task_failed,timeout,unavailable"
+)
+
+// failoverChain returns the provider failover order, e.g.
+// PROVIDER_FAILOVER=nanobanana,openai. An empty value disables failover.
+func failoverChain() []string {
+	value, ok := os.LookupEnv("PROVIDER_FAILOVER")
+	if !ok {
+		value = defaultFailoverChain
+	}
+	return splitList(value)
+}
+
+// isFailoverError reports whether err belongs to an error class that should
+// be retried on the next provider.
+func isFailoverError(err error) bool {
+	class := ProviderErrorClass(err)
+	if class == "" {
+		return false
+	}
+
+	value := os.Getenv("PROVIDER_FAILOVER_ON")
+	if value == "" {
+		value = defaultFailoverClasses
+	}
+	for _, retryable := range splitList(value) {
+		if retryable == class {
+			return true
+		}
+	}
+	return false
+}
+
+// nextProvider returns the configured provider that follows the requested
+// one in the failover chain and has not been tried for this job yet, or ""
+// if there is none.
+func nextProvider(job *GenerationJob) string {
+	chain := failoverChain()
+
+	start := 0
+	for i, name := range chain {
+		if name == job.RequestedProvider {
+			start = i + 1
+			break
+		}
+	}
+
+	tried := map[string]bool{job.Provider: true}
+	for _, attempt := range job.Attempts {
+		tried[attempt.Provider] = true
+	}
+
+	for _, name := range chain[start:] {
+		if tried[name] {
+			continue
+		}
+		if p, ok := GetProvider(name); ok && p.Configured() {
+			return name
+		}
+	}
+	return ""
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+	_ "time/tzdata" // user time zones must resolve in minimal containers too
+
+	"gorm.io/gorm"
+)
+
+// Free tier reset policies, selected with FREE_RESET_POLICY.
+const (
+	// the allowance is restored at midnight in the user's time zone (default)
+	FreeResetCalendarDay = "calendar_day"
+	// the allowance is restored 24 hours after the period started
+	FreeResetRolling24h = "rolling_24h"
+)
+
+// freeDailyAllowance is the number of free generations per period, from
+// FREE_DAILY_GENERATIONS. 0 disables the free tier.
+func freeDailyAllowance() int {
+	value, err := strconv.Atoi(os.Getenv("FREE_DAILY_GENERATIONS"))
+	if err != nil || value < 0 {
+		return 1
+	}
+	return value
+}
+
+func freeResetPolicy() string {
+	if os.Getenv("FREE_RESET_POLICY") == FreeResetRolling24h {
+		return FreeResetRolling24h
+	}
+	return FreeResetCalendarDay
+}
+
+// validTimezone reports whether name is an IANA time zone, e.g. "Europe/Moscow".
+func validTimezone(name string) bool {
+	if name == "" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// userLocation returns the user's time zone, DEFAULT_TIMEZONE for users
+// without one and UTC if neither is set. The server zone is never used.
+func userLocation(user *User) *time.Location {
+	for _, name := range []string{user.Timezone, os.Getenv("DEFAULT_TIMEZONE")} {
+		if name == "" {
+			continue
+		}
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// freePeriodCutoff returns the start of the current free period. A user
+// whose period started before it gets a fresh allowance.
+func freePeriodCutoff(user *User, now time.Time) time.Time {
+	if freeResetPolicy() == FreeResetRolling24h {
+		return now.Add(-24 * time.Hour)
+	}
+	local := now.In(userLocation(user))
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+}
+
+// availableFreeGenerations returns the free generations the user can use
+// now, including an allowance that is due but not granted yet. It only
+// reads, the grant is written by grantDailyFree when a credit is spent.
+func availableFreeGenerations(user *User, now time.Time) int {
+	if user.FreePeriodStart.Before(freePeriodCutoff(user, now)) {
+		if allowance := freeDailyAllowance(); allowance > user.FreeGenerationsLeft {
+			return allowance
+		}
+	}
+	return user.FreeGenerationsLeft
+}
+
+// grantDailyFree restores the free allowance if a new period started and
+// starts the period. The update is conditional on the values read, so two
+// concurrent grants can not both apply.
+func grantDailyFree(tx *gorm.DB, userID string, now time.Time) error {
+	for attempt := 0; attempt < 3; attempt++ {
+		var user User
+		if err := tx.Where("id = ?", userID).First(&user).Error; err != nil {
+			return err
+		}
+
+		cutoff := freePeriodCutoff(&user, now)
+		if !user.FreePeriodStart.Before(cutoff) {
+			return nil
+		}
+
+		allowance := freeDailyAllowance()
+		if allowance < user.FreeGenerationsLeft {
+			// Never take away free generations that were refunded or granted by an admin
+			allowance = user.FreeGenerationsLeft
+		}
+
+		// SQLite compares times as text, keep them all in UTC
+		result := tx.Model(&User{}).
+			Where("id = ? AND free_generations_left = ? AND free_period_start < ?", userID, user.FreeGenerationsLeft, cutoff.UTC()).
+			Updates(map[string]interface{}{
+				"free_generations_left": allowance,
+				"free_period_start":     now.UTC(),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			// Changed in between, look again
+			continue
+		}
+
+		if delta := allowance - user.FreeGenerationsLeft; delta != 0 {
+			return recordCreditChange(tx, userID, CreditKindFree, delta, CreditReasonDailyFreeGrant, "", "")
+		}
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Generation history page sizes.
+const (
+	defaultGenerationsPageSize = 20
+	maxGenerationsPageSize     = 100
+)
+
+// ErrInvalidCursor is returned for a cursor that was not made by
+// encodeGenerationCursor.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// GenerationFilter selects generations of the history. Zero values do not
+// filter.
+type GenerationFilter struct {
+	Provider string
+	From     time.Time // inclusive
+	To       time.Time // exclusive
+	Free     *bool     // true for free generations, false for paid ones
+	Cursor   string    // next_cursor of the previous page
+	Limit    int
+}
+
+// ListGenerations returns a page of the user's generations, newest first,
+// and the cursor of the next page, "" on the last page. The cursor is the
+// position of the last generation, so new generations do not shift the
+// pages that follow.
+func ListGenerations(db *gorm.DB, userID string, filter GenerationFilter) ([]Generation, string, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultGenerationsPageSize
+	}
+	if limit > maxGenerationsPageSize {
+		limit = maxGenerationsPageSize
+	}
+
+	query := db.Where("user_id = ?", userID)
+	if filter.Provider != "" {
+		query = query.Where("provider = ?", filter.Provider)
+	}
+	// Generations are stored in local time, SQLite compares times as text
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From.Local())
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To.Local())
+	}
+	if filter.Free != nil {
+		query = query.Where("is_free = ?", *filter.Free)
+	}
+	if filter.Cursor != "" {
+		createdAt, id, err := decodeGenerationCursor(filter.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Where("created_at < ? OR (created_at = ? AND id < ?)", createdAt, createdAt, id)
+	}
+
+	// One more than the page tells whether there is a next page
+	var generations []Generation
+	if err := query.Order("created_at DESC, id DESC").Limit(limit + 1).Find(&generations).Error; err != nil {
+		return nil, "", err
+	}
+	if len(generations) <= limit {
+		return generations, "", nil
+	}
+	generations = generations[:limit]
+	last := generations[limit-1]
+	return generations, encodeGenerationCursor(last.CreatedAt, last.ID), nil
+}
+
+func encodeGenerationCursor(createdAt time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt.Format(time.RFC3339Nano) + "|" + id))
+}
+
+func decodeGenerationCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	timestamp, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	return createdAt, id, nil
+}
+
+// parseHistoryDate parses a date range bound, either RFC 3339 or a plain
+// date. endOfDay moves a plain date to the start of the next day, so that
+// to=2025-01-31 includes that day.
+func parseHistoryDate(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// DeleteGeneration removes a generation and drops its references to the
+// cover and the collage, which the blob collector removes once nothing else
+// refers to them. Ledger entries and refunds keep the generation ID.
+func DeleteGeneration(db *gorm.DB, store BlobStore, generation *Generation) error {
+	var untracked []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&Generation{}, "id = ?", generation.ID).Error; err != nil {
+			return err
+		}
+		var err error
+		untracked, err = releaseGenerationFiles(tx, generation)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// The batch result must not point to the deleted file
+	db.Model(&GenerationJob{}).Where("generation_id = ?", generation.ID).Update("image_url", "")
+
+	for _, fileURL := range untracked {
+		if _, removable := fileRemovable(db, store, fileURL, 0); removable {
+			removeStoredFile(store, fileURL)
+		}
+	}
+	return nil
+}
+
+// releaseGenerationFiles drops the references of a generation to its cover
+// and collage. It returns the URLs of files saved before content
+// addressing, which are not counted, see fileRemovable.
+func releaseGenerationFiles(tx *gorm.DB, generation *Generation) ([]string, error) {
+	var untracked []string
+	for _, fileURL := range []string{generation.ImageURL, generation.InputURL} {
+		if fileURL == "" {
+			continue
+		}
+		tracked, err := releaseBlob(tx, fileURL)
+		if err != nil {
+			return nil, err
+		}
+		if !tracked {
+			untracked = append(untracked, fileURL)
+		}
+	}
+	return untracked, nil
+}
+
+// fileRemovable tells whether the file behind a storage URL is not needed
+// anymore once the given number of generations that still refer to it are
+// gone, and returns its size. Content addressed blobs are counted by their
+// references, older files by the generations and pending jobs using them.
+func fileRemovable(db *gorm.DB, store BlobStore, fileURL string, releasing int) (int64, bool) {
+	key, ok := storagePath(fileURL)
+	if !ok {
+		return 0, false
+	}
+
+	var blob StoredBlob
+	db.Where("key = ?", key).Limit(1).Find(&blob)
+	var remaining int64
+	if blob.Key != "" {
+		remaining = int64(blob.RefCount - releasing)
+	} else {
+		var generations, jobs int64
+		db.Model(&Generation{}).
+			Where("(image_url = ? OR input_url = ?) AND expired = ?", fileURL, fileURL, false).
+			Count(&generations)
+		db.Model(&GenerationJob{}).
+			Where("input_url = ? AND status IN ?", fileURL, []string{JobStatusQueued, JobStatusRunning}).
+			Count(&jobs)
+		remaining = generations + jobs - int64(releasing)
+	}
+	if remaining > 0 {
+		return 0, false
+	}
+
+	info, err := store.Stat(context.Background(), key)
+	if err != nil {
+		return 0, false
+	}
+	return info.Size, true
+}
+
+// removeStoredFile deletes the file behind a storage URL. URLs outside of
+// our storage are ignored.
+func removeStoredFile(store BlobStore, fileURL string) {
+	savedPath, ok := storagePath(fileURL)
+	if !ok {
+		return
+	}
+	if err := store.Delete(context.Background(), savedPath); err != nil {
+		fmt.Printf("Warning: Failed to remove %s: %v\n", savedPath, err)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	guestCookieName   = "coverflow_guest"
+	guestCookieMaxAge = 365 * 24 * 60 * 60
+	guestIDPrefix     = "guest-"
+)
+
+// Guest abuse limits, overridable with GUEST_MAX_PER_IP and
+// GUEST_MAX_GENERATIONS_PER_IP.
+const (
+	defaultGuestsPerIP           = 3
+	defaultGuestGenerationsPerIP = 5
+)
+
+var (
+	ErrGuestLimitExceeded      = errors.New("too many guest accounts from this address")
+	ErrGuestGenerationsLimited = errors.New("too many guest generations from this address")
+)
+
+// GuestManager gives visitors without a session their own guest User,
+// identified by a signed device cookie, so that they get a personal daily
+// allowance and storage folder instead of a shared "anonymous" one.
+type GuestManager struct {
+	db          *gorm.DB
+	redisClient *redis.Client
+	secret      []byte
+}
+
+func NewGuestManager(db *gorm.DB, redisClient *redis.Client, secret string) *GuestManager {
+	return &GuestManager{
+		db:          db,
+		redisClient: redisClient,
+		secret:      []byte(secret),
+	}
+}
+
+func isGuestID(userID string) bool {
+	return strings.HasPrefix(userID, guestIDPrefix)
+}
+
+// CurrentUserID returns the signed in user, or the guest of the device
+// cookie, or "" if there is neither.
+func (g *GuestManager) CurrentUserID(c *gin.Context) string {
+	session := sessions.Default(c)
+	if id, ok := session.Get("user_id").(string); ok && id != "" {
+		return id
+	}
+	return g.guestFromCookie(c)
+}
+
+// EnsureUserID is CurrentUserID that creates a guest for new devices.
+// Returns ErrGuestLimitExceeded when the client address already created
+// too many guests today.
+func (g *GuestManager) EnsureUserID(c *gin.Context) (string, error) {
+	if userID := g.CurrentUserID(c); userID != "" {
+		return userID, nil
+	}
+
+	ctx := context.Background()
+	key := fmt.Sprintf("guest:ip:%s:created:%s", c.ClientIP(), time.Now().Format("2006-01-02"))
+	created, err := g.redisClient.Incr(ctx, key).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to check guest limit: %w", err)
+	}
+	g.redisClient.Expire(ctx, key, 24*time.Hour)
+	if created > int64(envInt("GUEST_MAX_PER_IP", defaultGuestsPerIP)) {
+		return "", ErrGuestLimitExceeded
+	}
+
+	guestID := guestIDPrefix + uuid.New().String()
+	if err := createGuestUser(g.db, guestID, c.GetHeader("X-Timezone")); err != nil {
+		return "", err
+	}
+	fmt.Printf("Guest user created: %s (ip: %s)\n", guestID, c.ClientIP())
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(guestCookieName, g.sign(guestID), guestCookieMaxAge, "/", "", false, true)
+	return guestID, nil
+}
+
+// CheckGuestGenerations counts guest generations per client address and
+// device fingerprint (X-Device-Fingerprint header) and refuses the request
+// when either went over the daily limit. Signed in users are not limited.
+func (g *GuestManager) CheckGuestGenerations(c *gin.Context, userID string, count int) error {
+	if !isGuestID(userID) {
+		return nil
+	}
+
+	limit := int64(envInt("GUEST_MAX_GENERATIONS_PER_IP", defaultGuestGenerationsPerIP))
+	day := time.Now().Format("2006-01-02")
+	keys := []string{fmt.Sprintf("guest:ip:%s:generations:%s", c.ClientIP(), day)}
+	if fingerprint := c.GetHeader("X-Device-Fingerprint"); fingerprint != "" {
+		keys = append(keys, fmt.Sprintf("guest:fp:%s:generations:%s", fingerprint, day))
+	}
+
+	ctx := context.Background()
+	for _, key := range keys {
+		used, err := g.redisClient.IncrBy(ctx, key, int64(count)).Result()
+		if err != nil {
+			return fmt.Errorf("failed to check guest limit: %w", err)
+		}
+		g.redisClient.Expire(ctx, key, 24*time.Hour)
+		if used > limit {
+			return ErrGuestGenerationsLimited
+		}
+	}
+	return nil
+}
+
+// MergeIntoAccount moves the guest of the device cookie into the account
+// that just signed in and clears the cookie.
+func (g *GuestManager) MergeIntoAccount(c *gin.Context, userID string) {
+	guestID := g.guestFromCookie(c)
+	if guestID == "" {
+		return
+	}
+
+	if err := MergeGuestUser(g.db, guestID, userID); err != nil {
+		fmt.Printf("Warning: Failed to merge guest %s into %s: %v\n", guestID, userID, err)
+		return
+	}
+	fmt.Printf("Guest %s merged into user %s\n", guestID, userID)
+	c.SetCookie(guestCookieName, "", -1, "/", "", false, true)
+}
+
+// guestFromCookie returns the guest ID of a validly signed cookie whose
+// guest still exists and was not merged into an account.
+func (g *GuestManager) guestFromCookie(c *gin.Context) string {
+	value, err := c.Cookie(guestCookieName)
+	if err != nil {
+		return ""
+	}
+	guestID, ok := g.verify(value)
+	if !ok {
+		return ""
+	}
+
+	var guest User
+	if err := g.db.Where("id = ? AND is_guest = ? AND merged_into = ''", guestID, true).First(&guest).Error; err != nil {
+		return ""
+	}
+	return guest.ID
+}
+
+// sign returns "<guestID>.<hex HMAC-SHA256 of guestID>".
+func (g *GuestManager) sign(guestID string) string {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write([]byte(guestID))
+	return guestID + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (g *GuestManager) verify(value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", false
+	}
+	guestID := value[:i]
+	if !isGuestID(guestID) || !hmac.Equal([]byte(g.sign(guestID)), []byte(value)) {
+		return "", false
+	}
+	return guestID, true
+}
+
+// createGuestUser creates a guest with the same daily allowance as a new
+// account. Guests get a placeholder email because emails are unique.
+func createGuestUser(db *gorm.DB, guestID string, timezone string) error {
+	guest := User{
+		ID:                  guestID,
+		Email:               guestID + "@guest.invalid",
+		Name:                "Guest",
+		IsGuest:             true,
+		FreeGenerationsLeft: freeDailyAllowance(),
+		FreePeriodStart:     time.Now().UTC(),
+	}
+	if validTimezone(timezone) {
+		guest.Timezone = timezone
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&guest).Error; err != nil {
+			return err
+		}
+		if guest.FreeGenerationsLeft == 0 {
+			return nil
+		}
+		return recordCreditChange(tx, guest.ID, CreditKindFree, guest.FreeGenerationsLeft, CreditReasonDailyFreeGrant, "", "guest")
+	})
+}
+
+// MergeGuestUser moves the generations, jobs and paid credits of a guest to
+// an account. If the guest already used today's free generation, the
+// account's is used up as well, so signing in does not grant a second one.
+// Credits reserved for running jobs stay with the guest, releasing them
+// must not give the account credits it never had, see ReleaseReservation.
+func MergeGuestUser(db *gorm.DB, guestID string, userID string) error {
+	now := time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&User{}).Where("id = ? AND is_guest = ? AND merged_into = ''", guestID, true).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		// Compare the free generations of the current period, not of the
+		// period either of them last spent one in
+		for _, id := range []string{guestID, userID} {
+			if err := grantDailyFree(tx, id, now); err != nil {
+				return err
+			}
+		}
+		var guest User
+		if err := tx.Where("id = ?", guestID).First(&guest).Error; err != nil {
+			return err
+		}
+		var user User
+		if err := tx.Where("id = ?", userID).First(&user).Error; err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&Generation{}, &GenerationBatch{}, &GenerationJob{}, &GenerationRefund{}} {
+			if err := tx.Model(model).Where("user_id = ?", guestID).Update("user_id", userID).Error; err != nil {
+				return err
+			}
+		}
+		err = tx.Model(&CreditReservation{}).
+			Where("user_id = ? AND status <> ?", guestID, ReservationStatusReserved).
+			Update("user_id", userID).Error
+		if err != nil {
+			return err
+		}
+
+		// The files stay in the guest directory but count for the account
+		if err := tx.Model(&StoredBlob{}).Where("owner = ?", guestID).Update("owner", userID).Error; err != nil {
+			return err
+		}
+		if err := addStorageUsage(tx, userID, guest.StorageFiles, guest.StorageBytes); err != nil {
+			return err
+		}
+		if err := addStorageUsage(tx, guestID, -guest.StorageFiles, -guest.StorageBytes); err != nil {
+			return err
+		}
+
+		if guest.PaidGenerations > 0 {
+			if err := transferCredits(tx, guestID, userID, CreditKindPaid, guest.PaidGenerations); err != nil {
+				return err
+			}
+		}
+
+		// Both are in the current period now, what the guest spent of its
+		// allowance is taken from the account
+		used := freeDailyAllowance() - guest.FreeGenerationsLeft
+		if used > user.FreeGenerationsLeft {
+			used = user.FreeGenerationsLeft
+		}
+		if used > 0 {
+			updates := map[string]interface{}{"free_generations_left": gorm.Expr("free_generations_left - ?", used)}
+			if guest.LastFreeGeneration.After(user.LastFreeGeneration) {
+				updates["last_free_generation"] = guest.LastFreeGeneration
+			}
+			if err := tx.Model(&User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
+				return err
+			}
+			if err := recordCreditChange(tx, userID, CreditKindFree, -used, CreditReasonGuestMerge, guestID, "free generation used as guest"); err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&User{}).Where("id = ?", guestID).Update("merged_into", userID).Error
+	})
+}
+
+// transferCredits moves count credits of a kind between two users, with a
+// ledger entry on both sides.
+func transferCredits(tx *gorm.DB, fromID string, toID string, kind string, count int) error {
+	column := creditColumn(kind)
+	if err := tx.Model(&User{}).Where("id = ?", fromID).Update(column, gorm.Expr(column+" - ?", count)).Error; err != nil {
+		return err
+	}
+	if err := recordCreditChange(tx, fromID, kind, -count, CreditReasonGuestMerge, toID, ""); err != nil {
+		return err
+	}
+	if err := tx.Model(&User{}).Where("id = ?", toID).Update(column, gorm.Expr(column+" + ?", count)).Error; err != nil {
+		return err
+	}
+	return recordCreditChange(tx, toID, kind, count, CreditReasonGuestMerge, fromID, "")
+}
+
+// envInt reads a positive integer from the environment.
+func envInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// newTestGuest creates a guest with the daily allowance and paid credits.
+func newTestGuest(t *testing.T, db *gorm.DB, paid int) string {
+	t.Helper()
+	guestID := "guest-" + uuid.New().String()
+	if err := createGuestUser(db, guestID, ""); err != nil {
+		t.Fatalf("createGuestUser: %v", err)
+	}
+	if paid > 0 {
+		if err := AdjustCredits(db, guestID, CreditKindPaid, paid, "", "test"); err != nil {
+			t.Fatalf("grant paid: %v", err)
+		}
+	}
+	return guestID
+}
+
+// newTestJobManager returns a job manager with local storage. Redis is
+// unreachable, progress events are dropped with a warning.
+func newTestJobManager(t *testing.T, db *gorm.DB) *JobManager {
+	t.Helper()
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBlobStore: %v", err)
+	}
+	redisClient := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	t.Cleanup(func() { redisClient.Close() })
+	return NewJobManager(db, redisClient, store, 1)
+}
+
+func TestMergeGuestUserOpenReservations(t *testing.T) {
+	t.Setenv("FREE_DAILY_GENERATIONS", "1")
+	db := newTestDB(t)
+	guestID := newTestGuest(t, db, 2)
+	user := newTestUser(t, db, 1, 0)
+
+	free, err := ReserveGeneration(db, guestID, "job-free")
+	if err != nil || free.Kind != CreditKindFree {
+		t.Fatalf("ReserveGeneration = %+v, %v", free, err)
+	}
+	paid, err := ReserveGeneration(db, guestID, "job-paid")
+	if err != nil || paid.Kind != CreditKindPaid {
+		t.Fatalf("ReserveGeneration = %+v, %v", paid, err)
+	}
+	done, err := ReserveGeneration(db, guestID, "job-done")
+	if err != nil {
+		t.Fatalf("ReserveGeneration: %v", err)
+	}
+	job := &GenerationJob{ID: "job-done", UserID: guestID, Provider: "test", Status: JobStatusRunning, ReservationID: done.ID}
+	if err := db.Create(job).Error; err != nil {
+		t.Fatalf("create job: %v", err)
+	}
+
+	if err := MergeGuestUser(db, guestID, user.ID); err != nil {
+		t.Fatalf("MergeGuestUser: %v", err)
+	}
+	// The guest used today's free generation, the account's is gone too
+	reconciliation := assertConsistent(t, db, user.ID)
+	if reconciliation.FreeBalance != 0 || reconciliation.PaidBalance != 0 {
+		t.Fatalf("account balance after merge: %+v", reconciliation)
+	}
+
+	// Both jobs fail. The free credit goes back to the guest, the paid one
+	// belongs to the account now
+	for _, reservation := range []*CreditReservation{free, paid} {
+		if err := ReleaseReservation(db, reservation.ID); err != nil {
+			t.Fatalf("ReleaseReservation: %v", err)
+		}
+	}
+	reconciliation = assertConsistent(t, db, user.ID)
+	if reconciliation.FreeBalance != 0 || reconciliation.PaidBalance != 1 {
+		t.Fatalf("account balance after release: %+v", reconciliation)
+	}
+	reconciliation = assertConsistent(t, db, guestID)
+	if reconciliation.PaidBalance != 0 {
+		t.Fatalf("guest balance after release: %+v", reconciliation)
+	}
+
+	// The job that was running as the guest succeeds, its result belongs
+	// to the account
+	manager := newTestJobManager(t, db)
+	manager.complete(job, &ImageResult{Images: []GeneratedImage{{Data: []byte("cover"), Format: "png"}}})
+
+	var generation Generation
+	if err := db.Where("id = ?", job.GenerationID).First(&generation).Error; err != nil {
+		t.Fatalf("load generation: %v", err)
+	}
+	if generation.UserID != user.ID {
+		t.Fatalf("generation of %s, want the account %s", generation.UserID, user.ID)
+	}
+	var saved GenerationJob
+	db.Where("id = ?", job.ID).First(&saved)
+	if saved.UserID != user.ID || saved.Status != JobStatusSucceeded {
+		t.Fatalf("job = %+v, want succeeded for the account", saved)
+	}
+	var account User
+	db.Where("id = ?", user.ID).First(&account)
+	if account.StorageFiles != 1 {
+		t.Fatalf("account storage files = %d, want 1", account.StorageFiles)
+	}
+	var blob StoredBlob
+	if err := db.Where("owner = ?", user.ID).First(&blob).Error; err != nil {
+		t.Fatalf("stored blob not owned by the account: %v", err)
+	}
+}
+
+func TestMergeGuestUserNewPeriod(t *testing.T) {
+	t.Setenv("FREE_DAILY_GENERATIONS", "1")
+	db := newTestDB(t)
+	guestID := newTestGuest(t, db, 0)
+
+	reservation, err := ReserveGeneration(db, guestID, "job-1")
+	if err != nil {
+		t.Fatalf("ReserveGeneration: %v", err)
+	}
+	if err := CommitReservation(db, reservation.ID); err != nil {
+		t.Fatalf("CommitReservation: %v", err)
+	}
+	// The guest spent the free generation of an earlier day
+	earlier := time.Now().Add(-48 * time.Hour).UTC()
+	err = db.Model(&User{}).Where("id = ?", guestID).Updates(map[string]interface{}{
+		"free_period_start":    earlier,
+		"last_free_generation": earlier,
+	}).Error
+	if err != nil {
+		t.Fatalf("move guest period: %v", err)
+	}
+
+	user := newTestUser(t, db, 1, 0)
+	if err := MergeGuestUser(db, guestID, user.ID); err != nil {
+		t.Fatalf("MergeGuestUser: %v", err)
+	}
+	reconciliation := assertConsistent(t, db, user.ID)
+	if reconciliation.FreeBalance != 1 {
+		t.Fatalf("free balance = %d after merging a guest of an earlier day, want 1", reconciliation.FreeBalance)
+	}
+}
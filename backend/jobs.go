@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+)
+
+// An instance touches the jobs it works on every jobHeartbeatInterval.
+// Jobs that were not touched for jobStaleAfter belong to an instance that
+// went away and are taken over, see ResumePending.
+const (
+	jobHeartbeatInterval = time.Minute
+	jobStaleAfter        = 5 * time.Minute
+)
+
+// JobManager runs generation jobs in the background so that
+// /api/generate-cover can return a job ID right away instead of holding
+// the connection open while the provider works. At most `workers` jobs
+// talk to providers at the same time.
+type JobManager struct {
+	db          *gorm.DB
+	redisClient *redis.Client
+	store       BlobStore
+	workers     chan struct{}
+}
+
+func NewJobManager(db *gorm.DB, redisClient *redis.Client, store BlobStore, workers int) *JobManager {
+	if workers < 1 {
+		workers = 1
+	}
+	return &JobManager{
+		db:          db,
+		redisClient: redisClient,
+		store:       store,
+		workers:     make(chan struct{}, workers),
+	}
+}
+
+// SubmitBatch persists the batch and its variant jobs as queued and starts
+// processing them.
+func (m *JobManager) SubmitBatch(batch *GenerationBatch, jobs []*GenerationJob) error {
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(batch).Error; err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			job.BatchID = batch.ID
+			job.Status = JobStatusQueued
+			if err := tx.Create(job).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		m.emit(job, JobEvent{Type: JobEventQueued, Message: "Job queued"})
+		go m.run(job)
+	}
+	return nil
+}
+
+// ResumePending restarts jobs that were interrupted by a server restart.
+// Jobs other instances are still working on are recognized by their
+// heartbeat and left alone, a stale job is claimed with a conditional
+// update so only one instance resumes it. Jobs that already have a
+// provider task ID are left to the callback and the sweeper instead of
+// creating a new task. Returns the number of jobs resumed.
+func (m *JobManager) ResumePending() int {
+	pending := []string{JobStatusQueued, JobStatusRunning}
+	cutoff := time.Now().Add(-jobStaleAfter)
+
+	var jobs []GenerationJob
+	err := m.db.Where("status IN ? AND provider_task_id = '' AND updated_at < ?", pending, cutoff).Find(&jobs).Error
+	if err != nil {
+		fmt.Printf("Warning: Failed to load pending generation jobs: %v\n", err)
+		return 0
+	}
+
+	resumed := 0
+	for i := range jobs {
+		job := &jobs[i]
+		result := m.db.Model(&GenerationJob{}).
+			Where("id = ? AND status IN ? AND provider_task_id = '' AND updated_at < ?", job.ID, pending, cutoff).
+			Update("updated_at", time.Now())
+		if result.Error != nil || result.RowsAffected == 0 {
+			// Finished or claimed by another instance meanwhile
+			continue
+		}
+		fmt.Printf("Resuming generation job %s (status: %s)\n", job.ID, job.Status)
+		resumed++
+		go m.run(job)
+	}
+	return resumed
+}
+
+// StartJobResumer runs ResumePending every interval, so the jobs of an
+// instance that went away are taken over by the others.
+func (m *JobManager) StartJobResumer(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			m.ResumePending()
+		}
+	}()
+}
+
+// heartbeat touches the job every jobHeartbeatInterval until stop is
+// called, so other instances do not resume it.
+func (m *JobManager) heartbeat(jobID string) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(jobHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				m.db.Model(&GenerationJob{}).
+					Where("id = ? AND status IN ?", jobID, []string{JobStatusQueued, JobStatusRunning}).
+					Update("updated_at", time.Now())
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (m *JobManager) run(job *GenerationJob) {
+	stop := m.heartbeat(job.ID)
+	defer stop()
+
+	// Wait for a free worker
+	m.workers <- struct{}{}
+	defer func() { <-m.workers }()
+
+	job.Status = JobStatusRunning
+	m.db.Model(job).Update("status", JobStatusRunning)
+
+	provider, ok := GetProvider(job.Provider)
+	if !ok {
+		m.fail(job, fmt.Errorf("unknown provider: %s", job.Provider))
+		return
+	}
+
+	imageData, err := m.loadInputImage(job.InputImageID)
+	if err != nil {
+		m.fail(job, err)
+		return
+	}
+
+	baseURL := os.Getenv("BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+
+	// Create public URL for the image
+	imageURL := fmt.Sprintf("%s/api/image/%s", baseURL, job.InputImageID)
+	fmt.Printf("Image accessible at: %s\n", imageURL)
+
+	req := ImageRequest{
+		Prompt: job.Prompt,
+		InputImages: []InputImage{{
+			URL:    imageURL,
+			Data:   imageData,
+			Format: job.InputFormat,
+		}},
+		AspectRatio:  "16:9", // YouTube thumbnail standard
+		OutputFormat: "png",
+		CallbackURL:  fmt.Sprintf("%s/api/providers/%s/callback", baseURL, provider.Name()),
+	}
+
+	if job.MaskImageID != "" && provider.Capabilities().Mask {
+		maskData, err := m.loadInputImage(job.MaskImageID)
+		if err != nil {
+			m.fail(job, err)
+			return
+		}
+		req.Mask = &InputImage{Data: maskData, Format: "png"}
+	}
+
+	result, err := provider.Generate(context.Background(), req)
+	if err != nil {
+		m.fail(job, err)
+		return
+	}
+
+	if result.TaskID != "" && len(result.Images) == 0 {
+		fmt.Printf("%s task created: %s\n", provider.DisplayName(), result.TaskID)
+
+		// Persist task ID so the callback and the sweeper can find the job
+		job.ProviderTaskID = result.TaskID
+		job.TaskCreatedAt = time.Now()
+		m.db.Model(job).Updates(map[string]interface{}{
+			"provider_task_id": job.ProviderTaskID,
+			"task_created_at":  job.TaskCreatedAt,
+		})
+		m.emit(job, JobEvent{Type: JobEventTaskCreated, Message: fmt.Sprintf("%s task created", provider.DisplayName())})
+		return
+	}
+
+	m.complete(job, result)
+}
+
+// complete saves the result of a successful generation and finishes the job.
+func (m *JobManager) complete(job *GenerationJob, result *ImageResult) {
+	if len(result.Images) == 0 {
+		m.fail(job, fmt.Errorf("no image in response"))
+		return
+	}
+
+	coverURL, err := m.saveResult(job, result.Images[0])
+	if err != nil {
+		m.fail(job, err)
+		return
+	}
+
+	job.Attempts = append(job.Attempts, ProviderAttempt{Provider: job.Provider, Status: "succeeded", At: time.Now()})
+	job.Cost = result.Cost
+	m.finish(job, coverURL, nil)
+}
+
+// completeTask finishes a job from the task state fetched from the provider
+// after a callback or by the sweeper. Tasks still in progress are ignored.
+func (m *JobManager) completeTask(job *GenerationJob, status *TaskStatus) {
+	if !status.Done {
+		return
+	}
+
+	m.withFinishLock(job.ID, func(job *GenerationJob) {
+		if status.Err != nil {
+			m.fail(job, status.Err)
+			return
+		}
+
+		fmt.Printf("Task %s completed successfully\n", status.TaskID)
+		m.complete(job, status.Result)
+	})
+}
+
+// sweepProviderTasks polls running tasks that have not been updated for
+// pollAfter, as a fallback for callbacks that never arrive. Tasks older
+// than timeout are failed.
+func (m *JobManager) sweepProviderTasks(pollAfter time.Duration, timeout time.Duration) {
+	var jobs []GenerationJob
+	err := m.db.Where("status = ? AND provider_task_id <> '' AND updated_at < ?", JobStatusRunning, time.Now().Add(-pollAfter)).
+		Find(&jobs).Error
+	if err != nil {
+		fmt.Printf("Warning: Failed to load pending provider tasks: %v\n", err)
+		return
+	}
+
+	for i := range jobs {
+		job := &jobs[i]
+
+		if time.Since(job.TaskCreatedAt) > timeout {
+			m.withFinishLock(job.ID, func(job *GenerationJob) {
+				m.fail(job, &ProviderError{
+					Class: ErrorClassTimeout,
+					Err:   fmt.Errorf("task timeout after %.1f minutes", timeout.Minutes()),
+				})
+			})
+			continue
+		}
+
+		provider, ok := GetProvider(job.Provider)
+		asyncProvider, isAsync := provider.(AsyncImageProvider)
+		if !ok || !isAsync {
+			continue
+		}
+
+		job.PollAttempts++
+		m.db.Model(job).Update("poll_attempts", job.PollAttempts)
+
+		status, err := asyncProvider.FetchTask(context.Background(), job.ProviderTaskID)
+		if err != nil {
+			fmt.Printf("Poll attempt %d for task %s failed: %v\n", job.PollAttempts, job.ProviderTaskID, err)
+			continue
+		}
+
+		if !status.Done {
+			fmt.Printf("Task status: %s (waiting for completion, attempt %d)...\n", status.State, job.PollAttempts)
+			m.emit(job, JobEvent{
+				Type:    JobEventPolling,
+				Attempt: job.PollAttempts,
+				Message: fmt.Sprintf("Task status: %s (attempt %d)", status.State, job.PollAttempts),
+			})
+			continue
+		}
+
+		m.completeTask(job, status)
+	}
+}
+
+// StartTaskSweeper runs sweepProviderTasks every interval.
+func (m *JobManager) StartTaskSweeper(interval time.Duration, pollAfter time.Duration, timeout time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			m.sweepProviderTasks(pollAfter, timeout)
+		}
+	}()
+}
+
+// loadInputImage fetches an uploaded image (the collage or its mask) from Redis.
+func (m *JobManager) loadInputImage(imageID string) ([]byte, error) {
+	imageData, err := m.redisClient.Get(context.Background(), fmt.Sprintf("image:%s", imageID)).Bytes()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("input image expired, please upload the collage again")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get input image from Redis: %w", err)
+	}
+	return imageData, nil
+}
+
+// fail records a failed provider attempt. Retryable errors fail over to
+// the next provider in the chain, anything else finishes the job.
+func (m *JobManager) fail(job *GenerationJob, err error) {
+	job.Attempts = append(job.Attempts, ProviderAttempt{
+		Provider:   job.Provider,
+		Status:     "failed",
+		Error:      err.Error(),
+		ErrorClass: ProviderErrorClass(err),
+		At:         time.Now(),
+	})
+
+	if isFailoverError(err) {
+		if next := nextProvider(job); next != "" {
+			fmt.Printf("Provider %s failed for job %s: %v, failing over to %s\n", job.Provider, job.ID, err, next)
+			m.emit(job, JobEvent{Type: JobEventFailover, Message: fmt.Sprintf("%s failed (%s), trying %s", job.Provider, err, next)})
+
+			job.Provider = next
+			job.ProviderTaskID = ""
+			job.PollAttempts = 0
+			m.refreshOwner(job)
+			m.db.Save(job)
+			go m.run(job)
+			return
+		}
+	}
+
+	m.finish(job, "", err)
+}
+
+// finish records the outcome of a job. On success the reserved credit is
+// committed and a Generation row is created, on failure it is released.
+func (m *JobManager) finish(job *GenerationJob, coverURL string, err error) {
+	m.refreshOwner(job)
+	if err != nil {
+		fmt.Printf("Generation job %s failed: %v\n", job.ID, err)
+		job.Status = JobStatusFailed
+		job.Error = err.Error()
+		m.db.Save(job)
+		m.releaseInputImages(job)
+
+		// Nothing was generated, give the credit back
+		if err := ReleaseReservation(m.db, job.ReservationID); err != nil {
+			fmt.Printf("Warning: Failed to release credit reservation: %v\n", err)
+		}
+		m.emit(job, JobEvent{Type: JobEventFailed, Message: job.Error})
+		return
+	}
+
+	if err := CommitReservation(m.db, job.ReservationID); err != nil {
+		fmt.Printf("Warning: Failed to commit credit reservation: %v\n", err)
+	}
+
+	// Record generation
+	generation := Generation{
+		ID:       uuid.New().String(),
+		UserID:   job.UserID,
+		BatchID:  job.BatchID,
+		ImageURL: coverURL,
+		Provider: job.Provider,
+		IsFree:   job.IsFree,
+		Cost:     job.Cost,
+		Prompt:   job.Prompt,
+		InputURL: job.InputURL,
+	}
+	if _, stored := storagePath(coverURL); !stored {
+		// Saving failed, the provider URL expires, see recoverRemoteGenerations
+		generation.RemoteOnly = true
+	}
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&generation).Error; err != nil {
+			return err
+		}
+		return acquireBlobs(tx, generation.ImageURL, generation.InputURL)
+	})
+	if err != nil {
+		fmt.Printf("Warning: Failed to record generation: %v\n", err)
+	}
+
+	job.Status = JobStatusSucceeded
+	job.ImageURL = coverURL
+	job.GenerationID = generation.ID
+	m.db.Save(job)
+	m.releaseInputImages(job)
+	m.emit(job, JobEvent{Type: JobEventSucceeded, ImageURL: coverURL})
+	fmt.Printf("Generation job %s succeeded: %s\n", job.ID, coverURL)
+}
+
+// refreshOwner reloads the user of a job before its result is written. A
+// guest that signs in while the job runs is merged into the account, see
+// MergeGuestUser, and the result belongs to the account.
+func (m *JobManager) refreshOwner(job *GenerationJob) {
+	var userIDs []string
+	err := m.db.Model(&GenerationJob{}).Where("id = ?", job.ID).Pluck("user_id", &userIDs).Error
+	if err != nil || len(userIDs) == 0 {
+		return
+	}
+	job.UserID = userIDs[0]
+}
+
+// releaseInputImages removes the collage and the mask from Redis once no
+// other variant of the batch needs them anymore. The job must already be
+// saved as finished.
+func (m *JobManager) releaseInputImages(job *GenerationJob) {
+	if job.BatchID != "" {
+		var pending int64
+		m.db.Model(&GenerationJob{}).
+			Where("batch_id = ? AND id <> ? AND status IN ?", job.BatchID, job.ID, []string{JobStatusQueued, JobStatusRunning}).
+			Count(&pending)
+		if pending > 0 {
+			return
+		}
+	}
+
+	// Clean up Redis cache, the collage is not needed anymore
+	m.redisClient.Del(context.Background(), fmt.Sprintf("image:%s", job.InputImageID))
+	if job.MaskImageID != "" {
+		m.redisClient.Del(context.Background(), fmt.Sprintf("image:%s", job.MaskImageID))
+	}
+}
+
+// withFinishLock runs fn with the current state of the job unless the job
+// is already finished. The callback and the sweeper may race to finish the
+// same job, the Redis lock makes sure only one of them does.
+func (m *JobManager) withFinishLock(jobID string, fn func(job *GenerationJob)) {
+	ctx := context.Background()
+	lockKey := fmt.Sprintf("job:%s:finishing", jobID)
+
+	acquired, err := m.redisClient.SetNX(ctx, lockKey, 1, 5*time.Minute).Result()
+	if err != nil || !acquired {
+		return
+	}
+	defer m.redisClient.Del(ctx, lockKey)
+
+	var job GenerationJob
+	if err := m.db.Where("id = ?", jobID).First(&job).Error; err != nil {
+		return
+	}
+	if job.Status == JobStatusSucceeded || job.Status == JobStatusFailed {
+		return
+	}
+
+	fn(&job)
+}
+
+// saveResult stores the provider result in storage and returns the public
+// URL. Results given by URL fall back to the provider URL if saving fails,
+// inline results have nowhere else to live so that is an error.
+func (m *JobManager) saveResult(job *GenerationJob, image GeneratedImage) (string, error) {
+	m.refreshOwner(job)
+	var savedPath string
+	var err error
+	if image.URL != "" {
+		m.emit(job, JobEvent{Type: JobEventDownloading, Message: "Downloading result"})
+
+		// Download and save generated image
+		savedPath, err = downloadAndSaveImage(m.db, m.store, job.Provider, image.URL, job.UserID)
+		if err != nil {
+			fmt.Printf("Warning: Failed to save image locally: %v\n", err)
+			// Return original URL if save fails
+			return image.URL, nil
+		}
+	} else {
+		savedPath, err = saveImageToStorage(m.db, m.store, image.Data, image.Format, job.UserID)
+		if err != nil {
+			return "", err
+		}
+	}
+	m.emit(job, JobEvent{Type: JobEventSaved, Message: "Result saved to storage"})
+
+	// Return local URL
+	return storageURL(savedPath), nil
+}
+
+// storageURL returns the public URL of a file saved in storage.
+func storageURL(savedPath string) string {
+	baseURL := os.Getenv("BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+	return fmt.Sprintf("%s/storage/%s", baseURL, savedPath)
+}
+
+// storagePath returns the storage path of a URL made by storageURL, or
+// false for URLs outside of our storage, e.g. provider URLs.
+func storagePath(imageURL string) (string, bool) {
+	savedPath, ok := strings.CutPrefix(imageURL, storageURL(""))
+	return savedPath, ok && savedPath != ""
+}
+
+// batchStatus is "running" while any variant is pending, then "succeeded"
+// if at least one variant succeeded and "failed" otherwise.
+func batchStatus(jobs []GenerationJob) string {
+	status := JobStatusFailed
+	for _, job := range jobs {
+		switch job.Status {
+		case JobStatusQueued, JobStatusRunning:
+			return JobStatusRunning
+		case JobStatusSucceeded:
+			status = JobStatusSucceeded
+		}
+	}
+	return status
+}
+
+// batchImageURLs returns the covers of the succeeded variants.
+func batchImageURLs(jobs []GenerationJob) []string {
+	urls := []string{}
+	for _, job := range jobs {
+		if job.Status == JobStatusSucceeded && job.ImageURL != "" {
+			urls = append(urls, job.ImageURL)
+		}
+	}
+	return urls
+}
+
+// emit publishes a progress event for the job.
+func (m *JobManager) emit(job *GenerationJob, event JobEvent) {
+	event.JobID = job.ID
+	publishJobEvent(context.Background(), m.redisClient, event)
+}
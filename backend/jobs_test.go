@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// newTestJob creates a queued job of the user last touched at updatedAt.
+// Its provider is unknown, so running it fails it right away.
+func newTestJob(t *testing.T, db *gorm.DB, id string, userID string, updatedAt time.Time) *GenerationJob {
+	t.Helper()
+	reservation, err := ReserveGeneration(db, userID, id)
+	if err != nil {
+		t.Fatalf("ReserveGeneration: %v", err)
+	}
+	job := &GenerationJob{ID: id, UserID: userID, Provider: "missing", Status: JobStatusQueued, ReservationID: reservation.ID}
+	if err := db.Create(job).Error; err != nil {
+		t.Fatalf("create job: %v", err)
+	}
+	if err := db.Model(job).UpdateColumn("updated_at", updatedAt).Error; err != nil {
+		t.Fatalf("set updated_at: %v", err)
+	}
+	return job
+}
+
+// waitForJob waits until the job is finished and returns it.
+func waitForJob(t *testing.T, db *gorm.DB, id string) *GenerationJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var job GenerationJob
+		if err := db.Where("id = ?", id).First(&job).Error; err != nil {
+			t.Fatalf("load job: %v", err)
+		}
+		if job.Status == JobStatusSucceeded || job.Status == JobStatusFailed {
+			return &job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s still %s", id, job.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResumePending(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, db, 0, 3)
+	stale := newTestJob(t, db, "job-stale", user.ID, time.Now().Add(-time.Hour))
+	live := newTestJob(t, db, "job-live", user.ID, time.Now())
+	withTask := newTestJob(t, db, "job-task", user.ID, time.Now().Add(-time.Hour))
+	db.Model(withTask).UpdateColumn("provider_task_id", "task-1")
+
+	// Two instances start at the same time, only one of them resumes the
+	// stale job
+	first, second := newTestJobManager(t, db), newTestJobManager(t, db)
+	resumed := make(chan int, 2)
+	for _, manager := range []*JobManager{first, second} {
+		go func(manager *JobManager) { resumed <- manager.ResumePending() }(manager)
+	}
+	if total := <-resumed + <-resumed; total != 1 {
+		t.Fatalf("stale job resumed %d times, want once", total)
+	}
+
+	finished := waitForJob(t, db, stale.ID)
+	if finished.Status != JobStatusFailed || len(finished.Attempts) != 1 {
+		t.Fatalf("stale job = %+v, want failed after one attempt", finished)
+	}
+	for _, id := range []string{live.ID, withTask.ID} {
+		var job GenerationJob
+		db.Where("id = ?", id).First(&job)
+		if job.Status != JobStatusQueued {
+			t.Fatalf("job %s = %s, want it left to its instance", id, job.Status)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type LavaTopCreateOrderRequest struct {
+	Sum      float64 `json:"sum"`
+	OrderID  string  `json:"orderId"`
+	ShopID   string  `json:"shopId"`
+	Currency string  `json:"currency"` // "RUB" or "USD"
+	// "MONTHLY" for subscriptions, the provider then charges every month
+	// and reports each renewal to the webhook
+	Periodicity string `json:"periodicity,omitempty"`
+}
+
+type LavaTopCreateOrderResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		URL       string `json:"url"`
+		InvoiceID string `json:"invoiceId"`
+		OrderID   string `json:"orderId"`
+	} `json:"data"`
+	Message string `json:"message"`
+}
+
+type LavaTopStatusRequest struct {
+	OrderID string `json:"orderId"`
+	ShopID  string `json:"shopId"`
+}
+
+type LavaTopStatusResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		Status         string  `json:"status"` // "success", "completed", "cancelled", "expired", ...
+		OrderID        string  `json:"orderId"`
+		SubscriptionID string  `json:"subscriptionId,omitempty"`
+		Amount         float64 `json:"amount"`
+	} `json:"data"`
+	Message string `json:"message"`
+}
+
+// LavaTopWebhook is the webhook body. Renewals and cancellations of a
+// subscription come with a new order_id and refer to the first order as
+// subscription_id.
+type LavaTopWebhook struct {
+	OrderID        string  `json:"order_id"`
+	Status         string  `json:"status"`
+	SubscriptionID string  `json:"subscription_id,omitempty"`
+	Amount         float64 `json:"amount,omitempty"`
+}
+
+// Webhook signature schemes, selected with LAVA_WEBHOOK_SIGNATURE_SCHEME.
+const (
+	// hex encoded HMAC-SHA256 of the raw body (default)
+	WebhookSchemeHMACSHA256 = "hmac-sha256"
+	// base64 encoded HMAC-SHA256 of the raw body
+	WebhookSchemeHMACSHA256Base64 = "hmac-sha256-base64"
+	// the header carries the secret itself, e.g. Lava Top "X-Api-Key"
+	WebhookSchemeAPIKey = "api-key"
+)
+
+// LavaTopProvider takes payments in RUB and USD through Lava Top.
+type LavaTopProvider struct{}
+
+func init() {
+	RegisterPaymentProvider(&LavaTopProvider{})
+}
+
+func (p *LavaTopProvider) Name() string {
+	return "lava"
+}
+
+func (p *LavaTopProvider) DisplayName() string {
+	return "Lava Top"
+}
+
+func (p *LavaTopProvider) Currencies() []string {
+	return []string{"RUB", "USD"}
+}
+
+func (p *LavaTopProvider) Configured() bool {
+	return os.Getenv("LAVA_SHOP_ID") != "" && os.Getenv("LAVA_SECRET_KEY") != ""
+}
+
+func (p *LavaTopProvider) apiURL() string {
+	if apiURL := os.Getenv("LAVA_API_URL"); apiURL != "" {
+		return apiURL
+	}
+	return "https://api.lava.top"
+}
+
+func (p *LavaTopProvider) CreateInvoice(ctx context.Context, invoice PaymentInvoice) (*PaymentOrder, error) {
+	if !p.Configured() {
+		return nil, fmt.Errorf("LAVA_SHOP_ID and LAVA_SECRET_KEY must be set")
+	}
+
+	reqBody := LavaTopCreateOrderRequest{
+		Sum:      invoice.Amount,
+		OrderID:  invoice.TransactionID,
+		ShopID:   os.Getenv("LAVA_SHOP_ID"),
+		Currency: invoice.Currency,
+	}
+	if invoice.Recurring {
+		reqBody.Periodicity = "MONTHLY"
+	}
+
+	var lavaResp LavaTopCreateOrderResponse
+	if err := p.post(ctx, "/v1/invoice/create", reqBody, &lavaResp); err != nil {
+		return nil, err
+	}
+	if lavaResp.Status != "success" {
+		return nil, fmt.Errorf("lava top error: %s", lavaResp.Message)
+	}
+
+	return &PaymentOrder{OrderID: lavaResp.Data.InvoiceID, PaymentURL: lavaResp.Data.URL}, nil
+}
+
+func (p *LavaTopProvider) FetchStatus(ctx context.Context, orderID string) (*PaymentEvent, error) {
+	if !p.Configured() {
+		return nil, fmt.Errorf("LAVA_SHOP_ID and LAVA_SECRET_KEY must be set")
+	}
+
+	var lavaResp LavaTopStatusResponse
+	reqBody := LavaTopStatusRequest{OrderID: orderID, ShopID: os.Getenv("LAVA_SHOP_ID")}
+	if err := p.post(ctx, "/v1/invoice/status", reqBody, &lavaResp); err != nil {
+		return nil, err
+	}
+	if lavaResp.Status != "success" {
+		return nil, fmt.Errorf("lava top error: %s", lavaResp.Message)
+	}
+
+	return &PaymentEvent{
+		OrderID:        orderID,
+		SubscriptionID: lavaResp.Data.SubscriptionID,
+		Status:         lavaTopPaymentStatus(lavaResp.Data.Status),
+		Amount:         lavaResp.Data.Amount,
+	}, nil
+}
+
+// ParseWebhook verifies the signature against the raw body before the body
+// is parsed.
+func (p *LavaTopProvider) ParseWebhook(header http.Header, body []byte) (*PaymentEvent, error) {
+	if err := verifyLavaWebhookSignature(header, body); err != nil {
+		return nil, err
+	}
+
+	var webhook LavaTopWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, fmt.Errorf("invalid webhook data: %w", err)
+	}
+	if webhook.OrderID == "" && webhook.SubscriptionID == "" {
+		return nil, fmt.Errorf("invalid webhook data: no order_id")
+	}
+
+	return &PaymentEvent{
+		OrderID:        webhook.OrderID,
+		SubscriptionID: webhook.SubscriptionID,
+		Status:         lavaTopPaymentStatus(webhook.Status),
+		Amount:         webhook.Amount,
+	}, nil
+}
+
+// lavaTopPaymentStatus maps a Lava Top status. Unknown states are failures,
+// as they always were for this webhook.
+func lavaTopPaymentStatus(status string) string {
+	switch status {
+	case "success", "completed":
+		return PaymentStatusSucceeded
+	case "cancelled", "canceled":
+		return PaymentStatusCancelled
+	case "pending", "created":
+		return PaymentStatusPending
+	}
+	return PaymentStatusFailed
+}
+
+// post sends a JSON request to the Lava Top API and decodes the response.
+func (p *LavaTopProvider) post(ctx context.Context, path string, reqBody interface{}, out interface{}) error {
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.apiURL()+path, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", os.Getenv("LAVA_SECRET_KEY"))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("lava top API error: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}
+
+// verifyLavaWebhookSignature checks the webhook signature header against
+// the raw body. The secret is LAVA_WEBHOOK_SECRET (LAVA_SECRET_KEY if not
+// set), the header LAVA_WEBHOOK_SIGNATURE_HEADER (default "X-Signature").
+func verifyLavaWebhookSignature(header http.Header, body []byte) error {
+	secret := os.Getenv("LAVA_WEBHOOK_SECRET")
+	if secret == "" {
+		secret = os.Getenv("LAVA_SECRET_KEY")
+	}
+	if secret == "" {
+		return fmt.Errorf("LAVA_WEBHOOK_SECRET or LAVA_SECRET_KEY must be set")
+	}
+
+	headerName := os.Getenv("LAVA_WEBHOOK_SIGNATURE_HEADER")
+	if headerName == "" {
+		headerName = "X-Signature"
+	}
+	signature := strings.TrimSpace(header.Get(headerName))
+	if signature == "" {
+		return ErrInvalidWebhookSignature
+	}
+
+	scheme := os.Getenv("LAVA_WEBHOOK_SIGNATURE_SCHEME")
+	if scheme == "" {
+		scheme = WebhookSchemeHMACSHA256
+	}
+
+	var expected string
+	switch scheme {
+	case WebhookSchemeHMACSHA256:
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expected = hex.EncodeToString(mac.Sum(nil))
+		// Some senders prefix the digest with the algorithm name
+		signature = strings.ToLower(strings.TrimPrefix(signature, "sha256="))
+	case WebhookSchemeHMACSHA256Base64:
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expected = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		signature = strings.TrimPrefix(signature, "sha256=")
+	case WebhookSchemeAPIKey:
+		expected = secret
+	default:
+		return fmt.Errorf("unknown webhook signature scheme: %s", scheme)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(expected)) != 1 {
+		return ErrInvalidWebhookSignature
+	}
+	return nil
+}
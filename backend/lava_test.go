@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testLavaSecret = "lava-secret"
+
+// newLavaStub starts a Lava Top API stub that checks the credentials and
+// answers invoice requests. Status requests answer with status.
+func newLavaStub(t *testing.T, status string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != testLavaSecret {
+			http.Error(w, `{"status":"error","message":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["shopId"] != "shop-1" {
+			http.Error(w, `{"status":"error","message":"bad request"}`, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/invoice/create":
+			if body["sum"] != 4.99 || body["currency"] != "RUB" || body["orderId"] != "tx-1" {
+				t.Errorf("unexpected invoice request: %v", body)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": "success",
+				"data":   map[string]string{"url": "https://pay.example/tx-1", "invoiceId": "inv-1", "orderId": "tx-1"},
+			})
+		case "/v1/invoice/status":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": "success",
+				"data":   map[string]interface{}{"status": status, "orderId": body["orderId"], "amount": 4.99},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("LAVA_API_URL", server.URL)
+	t.Setenv("LAVA_SHOP_ID", "shop-1")
+	t.Setenv("LAVA_SECRET_KEY", testLavaSecret)
+	t.Setenv("LAVA_WEBHOOK_SECRET", "")
+	t.Setenv("LAVA_WEBHOOK_SIGNATURE_HEADER", "")
+	t.Setenv("LAVA_WEBHOOK_SIGNATURE_SCHEME", "")
+	return server
+}
+
+// signLavaWebhook returns the default X-Signature header of body.
+func signLavaWebhook(body []byte, secret string) http.Header {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	header := http.Header{}
+	header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return header
+}
+
+func TestLavaCreateInvoice(t *testing.T) {
+	newLavaStub(t, "success")
+	provider := &LavaTopProvider{}
+
+	order, err := provider.CreateInvoice(context.Background(), PaymentInvoice{TransactionID: "tx-1", Amount: 4.99, Currency: "RUB"})
+	if err != nil {
+		t.Fatalf("CreateInvoice: %v", err)
+	}
+	if order.OrderID != "inv-1" || order.PaymentURL != "https://pay.example/tx-1" {
+		t.Fatalf("order = %+v", order)
+	}
+
+	t.Setenv("LAVA_SECRET_KEY", "wrong")
+	if _, err := provider.CreateInvoice(context.Background(), PaymentInvoice{TransactionID: "tx-1", Amount: 4.99, Currency: "RUB"}); err == nil {
+		t.Fatal("CreateInvoice succeeded with a wrong API key")
+	}
+}
+
+func TestLavaFetchStatus(t *testing.T) {
+	for status, want := range map[string]string{
+		"success":   PaymentStatusSucceeded,
+		"created":   PaymentStatusPending,
+		"cancelled": PaymentStatusCancelled,
+		"expired":   PaymentStatusFailed,
+	} {
+		t.Run(status, func(t *testing.T) {
+			newLavaStub(t, status)
+			event, err := (&LavaTopProvider{}).FetchStatus(context.Background(), "inv-1")
+			if err != nil {
+				t.Fatalf("FetchStatus: %v", err)
+			}
+			if event.OrderID != "inv-1" || event.Status != want || event.Amount != 4.99 {
+				t.Fatalf("event = %+v, want status %s", event, want)
+			}
+		})
+	}
+}
+
+func TestLavaParseWebhook(t *testing.T) {
+	newLavaStub(t, "success")
+	provider := &LavaTopProvider{}
+	body := []byte(`{"order_id":"inv-1","status":"success","amount":4.99}`)
+
+	event, err := provider.ParseWebhook(signLavaWebhook(body, testLavaSecret), body)
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if event.OrderID != "inv-1" || event.Status != PaymentStatusSucceeded || event.Amount != 4.99 {
+		t.Fatalf("event = %+v", event)
+	}
+
+	// Prefixed digests are accepted as well
+	header := signLavaWebhook(body, testLavaSecret)
+	header.Set("X-Signature", "sha256="+header.Get("X-Signature"))
+	if _, err := provider.ParseWebhook(header, body); err != nil {
+		t.Fatalf("ParseWebhook with prefixed signature: %v", err)
+	}
+
+	for name, header := range map[string]http.Header{
+		"wrong secret": signLavaWebhook(body, "other-secret"),
+		"other body":   signLavaWebhook([]byte(`{"order_id":"inv-2","status":"success"}`), testLavaSecret),
+		"no signature": {},
+	} {
+		if _, err := provider.ParseWebhook(header, body); err != ErrInvalidWebhookSignature {
+			t.Errorf("%s: err = %v, want %v", name, err, ErrInvalidWebhookSignature)
+		}
+	}
+}
+
+func TestLavaWebhookReplayed(t *testing.T) {
+	newLavaStub(t, "success")
+	db := newTestDB(t)
+	user := newTestUser(t, db, 0, 0)
+	transaction := newTestTransaction(t, db, user.ID, "lava", "inv-1", 4.99)
+	provider := &LavaTopProvider{}
+
+	body := []byte(`{"order_id":"inv-1","status":"success","amount":4.99}`)
+	header := signLavaWebhook(body, testLavaSecret)
+	for i := 0; i < 3; i++ {
+		event, err := provider.ParseWebhook(header, body)
+		if err != nil {
+			t.Fatalf("ParseWebhook: %v", err)
+		}
+		if err := ApplyPaymentEvent(db, provider.Name(), event); err != nil {
+			t.Fatalf("ApplyPaymentEvent: %v", err)
+		}
+	}
+	assertTransactionStatus(t, db, transaction.ID, "completed")
+	assertPaidBalance(t, db, user.ID, 10)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Credit kinds, matching the User balance columns.
+const (
+	CreditKindFree         = "free"
+	CreditKindSubscription = "subscription"
+	CreditKindPaid         = "paid"
+)
+
+// Ledger entry reasons.
+const (
+	CreditReasonOpeningBalance  = "opening_balance" // balance that existed before the ledger
+	CreditReasonDailyFreeGrant  = "daily_free_grant"
+	CreditReasonPurchase        = "purchase"
+	CreditReasonSpend           = "spend"
+	CreditReasonRefund          = "refund"
+	CreditReasonAdminAdjustment = "admin_adjustment"
+	CreditReasonGuestMerge      = "guest_merge"
+	CreditReasonPromo           = "promo" // credits promo code, reference is the code
+	CreditReasonReferralBonus   = "referral_bonus"
+
+	CreditReasonSubscriptionGrant  = "subscription_grant"  // quota of a new subscription period
+	CreditReasonSubscriptionExpiry = "subscription_expiry" // unused generations over the rollover cap or after the end
+)
+
+// CreditLedgerEntry is one change of a user balance. Entries are only ever
+// appended, the sum of the deltas of a kind equals the matching balance.
+type CreditLedgerEntry struct {
+	ID               string    `gorm:"primaryKey" json:"id"`
+	UserID           string    `gorm:"index" json:"user_id"`
+	Kind             string    `json:"kind"` // "free", "subscription", "paid"
+	Delta            int       `json:"delta"`
+	Reason           string    `gorm:"index" json:"reason"`
+	Reference        string    `gorm:"index" json:"reference,omitempty"` // transaction, job or generation ID
+	Note             string    `json:"note,omitempty"`
+	FreeBalanceAfter int       `json:"free_balance_after"`
+	SubBalanceAfter  int       `json:"subscription_balance_after"`
+	PaidBalanceAfter int       `json:"paid_balance_after"`
+	CreatedAt        time.Time `gorm:"index" json:"created_at"`
+}
+
+// CreditReconciliation compares the user balances with the ledger sums.
+type CreditReconciliation struct {
+	UserID                string `json:"user_id"`
+	FreeBalance           int    `json:"free_balance"`
+	FreeLedgerSum         int    `json:"free_ledger_sum"`
+	SubscriptionBalance   int    `json:"subscription_balance"`
+	SubscriptionLedgerSum int    `json:"subscription_ledger_sum"`
+	PaidBalance           int    `json:"paid_balance"`
+	PaidLedgerSum         int    `json:"paid_ledger_sum"`
+	Consistent            bool   `json:"consistent"`
+}
+
+func creditColumn(kind string) string {
+	switch kind {
+	case CreditKindFree:
+		return "free_generations_left"
+	case CreditKindSubscription:
+		return "subscription_generations"
+	}
+	return "paid_generations"
+}
+
+// recordCreditChange appends a ledger entry for a balance change that was
+// just applied in tx, with the balances after the change.
+func recordCreditChange(tx *gorm.DB, userID string, kind string, delta int, reason string, reference string, note string) error {
+	var user User
+	if err := tx.Where("id = ?", userID).First(&user).Error; err != nil {
+		return err
+	}
+
+	entry := CreditLedgerEntry{
+		ID:               uuid.New().String(),
+		UserID:           userID,
+		Kind:             kind,
+		Delta:            delta,
+		Reason:           reason,
+		Reference:        reference,
+		Note:             note,
+		FreeBalanceAfter: user.FreeGenerationsLeft,
+		SubBalanceAfter:  user.SubscriptionGenerations,
+		PaidBalanceAfter: user.PaidGenerations,
+	}
+	return tx.Create(&entry).Error
+}
+
+// AdjustCredits changes a user balance by delta on behalf of an admin. The
+// balance can not go below zero.
+func AdjustCredits(db *gorm.DB, userID string, kind string, delta int, reference string, note string) error {
+	if kind != CreditKindFree && kind != CreditKindSubscription && kind != CreditKindPaid {
+		return fmt.Errorf("invalid credit kind: %s", kind)
+	}
+	column := creditColumn(kind)
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).
+			Where("id = ? AND "+column+" + ? >= 0", userID, delta).
+			Update(column, gorm.Expr(column+" + ?", delta))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("user not found or balance would become negative")
+		}
+		return recordCreditChange(tx, userID, kind, delta, CreditReasonAdminAdjustment, reference, note)
+	})
+}
+
+// ReconcileCredits checks the user balances against the ledger.
+func ReconcileCredits(db *gorm.DB, userID string) (*CreditReconciliation, error) {
+	var user User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	var sums []struct {
+		Kind  string
+		Total int
+	}
+	err := db.Model(&CreditLedgerEntry{}).
+		Select("kind, SUM(delta) AS total").
+		Where("user_id = ?", userID).
+		Group("kind").
+		Scan(&sums).Error
+	if err != nil {
+		return nil, err
+	}
+
+	reconciliation := &CreditReconciliation{
+		UserID:              userID,
+		FreeBalance:         user.FreeGenerationsLeft,
+		SubscriptionBalance: user.SubscriptionGenerations,
+		PaidBalance:         user.PaidGenerations,
+	}
+	for _, sum := range sums {
+		switch sum.Kind {
+		case CreditKindFree:
+			reconciliation.FreeLedgerSum = sum.Total
+		case CreditKindSubscription:
+			reconciliation.SubscriptionLedgerSum = sum.Total
+		case CreditKindPaid:
+			reconciliation.PaidLedgerSum = sum.Total
+		}
+	}
+	reconciliation.Consistent = reconciliation.FreeBalance == reconciliation.FreeLedgerSum &&
+		reconciliation.SubscriptionBalance == reconciliation.SubscriptionLedgerSum &&
+		reconciliation.PaidBalance == reconciliation.PaidLedgerSum
+
+	return reconciliation, nil
+}
+
+// backfillCreditLedger records the current balances of users that have no
+// ledger entries yet, so that existing balances reconcile.
+func backfillCreditLedger(db *gorm.DB) error {
+	var users []User
+	err := db.Where("id NOT IN (?)", db.Model(&CreditLedgerEntry{}).Select("user_id")).Find(&users).Error
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if user.FreeGenerationsLeft != 0 {
+				if err := recordCreditChange(tx, user.ID, CreditKindFree, user.FreeGenerationsLeft, CreditReasonOpeningBalance, "", ""); err != nil {
+					return err
+				}
+			}
+			if user.PaidGenerations != 0 {
+				if err := recordCreditChange(tx, user.ID, CreditKindPaid, user.PaidGenerations, CreditReasonOpeningBalance, "", ""); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
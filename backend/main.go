@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -9,7 +8,7 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,81 +23,27 @@ import (
 	"golang.org/x/oauth2/google"
 	googleOAuth2 "google.golang.org/api/oauth2/v2"
 	"google.golang.org/api/option"
+	"gorm.io/gorm"
 )
 
 type GenerateCoverRequest struct {
 	Image    string `json:"image" binding:"required"`
 	Provider string `json:"provider,omitempty"` // "openai" or "nanobanana", defaults to "nanobanana"
 	Prompt   string `json:"prompt,omitempty"`   // optional custom prompt for generation
+	Mask     string `json:"mask,omitempty"`     // optional base64 PNG edit mask, same size as the image
+	Variants int    `json:"variants,omitempty"` // number of covers to generate, 1 to maxVariants
 }
 
 type GenerateCoverResponse struct {
-	ID       string `json:"id"`
-	ImageURL string `json:"image_url"`
+	ID       string   `json:"id"`       // first generation job ID, poll GET /api/jobs/:id
+	BatchID  string   `json:"batch_id"` // poll GET /api/batches/:id for all variants
+	JobIDs   []string `json:"job_ids"`
+	Status   string   `json:"status"` // "queued", "running", "succeeded", "failed"
+	ImageURL string   `json:"image_url,omitempty"`
 }
 
-// Nano Banana API structures
-type NanoBananaCreateTaskRequest struct {
-	Model       string          `json:"model"`
-	Input       NanoBananaInput `json:"input"`
-	CallBackUrl string          `json:"callBackUrl,omitempty"`
-}
-
-type NanoBananaInput struct {
-	Prompt       string   `json:"prompt"`
-	ImageUrls    []string `json:"image_urls"`
-	OutputFormat string   `json:"output_format,omitempty"`
-	ImageSize    string   `json:"image_size,omitempty"`
-}
-
-type NanoBananaCreateTaskResponse struct {
-	Code int    `json:"code"`
-	Msg  string `json:"msg"`
-	Data struct {
-		TaskID string `json:"taskId"`
-	} `json:"data"`
-}
-
-type NanoBananaTaskResponse struct {
-	Code int    `json:"code"`
-	Msg  string `json:"msg"`
-	Data struct {
-		TaskID       string `json:"taskId"`
-		Model        string `json:"model"`
-		State        string `json:"state"` // "waiting", "success", "fail"
-		Param        string `json:"param"`
-		ResultJSON   string `json:"resultJson"`
-		FailCode     string `json:"failCode,omitempty"`
-		FailMsg      string `json:"failMsg,omitempty"`
-		CostTime     int    `json:"costTime,omitempty"`
-		CompleteTime int64  `json:"completeTime,omitempty"`
-		CreateTime   int64  `json:"createTime"`
-	} `json:"data"`
-}
-
-type NanoBananaResult struct {
-	ResultUrls []string `json:"resultUrls"`
-}
-
-type OpenAIRequest struct {
-	Model          string `json:"model"`
-	Prompt         string `json:"prompt"`
-	Image          string `json:"image"`
-	N              int    `json:"n"`
-	Size           string `json:"size"`
-	ResponseFormat struct {
-		Type string `json:"type"`
-	} `json:"response_format"`
-}
-
-type OpenAIResponse struct {
-	Data []struct {
-		URL string `json:"url"`
-	} `json:"data"`
-	Error *struct {
-		Message string `json:"message"`
-	} `json:"error,omitempty"`
-}
+// maxVariants limits the number of covers per generation request.
+const maxVariants = 4
 
 func main() {
 	// Load .env file
@@ -106,28 +51,30 @@ func main() {
 		fmt.Println("Warning: .env file not found")
 	}
 
-	// Get API keys
-	openAIKey := os.Getenv("OPENAI_API_KEY")
-	nanoBananaKey := os.Getenv("NANO_BANANA_API_KEY")
-
-	if openAIKey == "" {
-		fmt.Println("Warning: OPENAI_API_KEY not set in environment variables")
+	// Copy the files of the local storage directory to the configured store
+	if len(os.Args) > 1 && os.Args[1] == "migrate-storage" {
+		os.Exit(runStorageMigration(os.Args[2:]))
 	}
-	if nanoBananaKey == "" {
-		fmt.Println("Warning: NANO_BANANA_API_KEY not set in environment variables")
+
+	// Apply the retention policy once, -dry-run only reports
+	if len(os.Args) > 1 && os.Args[1] == "cleanup-storage" {
+		os.Exit(runStorageCleanup(os.Args[2:]))
 	}
 
-	// Create temp directory for images
-	tempDir := filepath.Join(".", "temp")
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
-		fmt.Printf("Warning: Failed to create temp directory: %v\n", err)
+	// Check provider API keys
+	for _, p := range Providers() {
+		if !p.Configured() {
+			fmt.Printf("Warning: %s API key not set in environment variables\n", p.DisplayName())
+		}
 	}
 
-	// Create storage directory for user images
-	storageDir := filepath.Join(".", "storage")
-	if err := os.MkdirAll(storageDir, 0755); err != nil {
-		fmt.Printf("Warning: Failed to create storage directory: %v\n", err)
+	// Stored covers and collages, on the local disk or in S3 (STORAGE_BACKEND)
+	store, err := NewBlobStoreFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to initialize storage: %v\n", err)
+		os.Exit(1)
 	}
+	fmt.Printf("Using %s storage\n", store.Name())
 
 	// Initialize Redis client
 	redisAddr := os.Getenv("REDIS_ADDR")
@@ -142,7 +89,7 @@ func main() {
 
 	// Test Redis connection
 	ctx := context.Background()
-	_, err := redisClient.Ping(ctx).Result()
+	_, err = redisClient.Ping(ctx).Result()
 	if err != nil {
 		fmt.Printf("Warning: Failed to connect to Redis: %v\n", err)
 		fmt.Println("Redis is required for image caching. Please ensure Redis is running.")
@@ -158,23 +105,49 @@ func main() {
 	}
 	fmt.Println("Database initialized successfully")
 
+	// Start background generation jobs and pick up the ones interrupted by a restart
+	workers, _ := strconv.Atoi(os.Getenv("GENERATION_WORKERS"))
+	if workers <= 0 {
+		workers = 4
+	}
+	jobManager := NewJobManager(db, redisClient, store, workers)
+	jobManager.ResumePending()
+	jobManager.StartJobResumer(time.Minute)
+	jobManager.StartTaskSweeper(15*time.Second, time.Minute, 10*time.Minute)
+
+	// Return credits reserved by requests that crashed before creating their job
+	StartReservationSweeper(db, 5*time.Minute, 15*time.Minute)
+
+	// Take back the generations of subscriptions that were not renewed
+	StartSubscriptionSweeper(db, 10*time.Minute)
+
+	// Settle payments whose webhook never arrived and expire abandoned invoices
+	StartPaymentReconciler(db, 5*time.Minute)
+
+	// Retry saving results kept at provider URLs, refund the ones that expired
+	StartGenerationRecovery(db, store, 15*time.Minute)
+
+	// Expire old covers, purge deleted accounts and remove unreferenced files
+	StartStorageJanitor(db, store, time.Hour)
+
 	r := gin.Default()
 
 	// Initialize session store
 	sessionSecret := os.Getenv("SESSION_SECRET")
 	if sessionSecret == "" {
-		sessionSecret = "coverflow-ai-secret-key-change-in-production"
+		sessionSecret = defaultSessionSecret
 		fmt.Println("Warning: SESSION_SECRET not set, using default. Change in production!")
 	}
-	store := cookie.NewStore([]byte(sessionSecret))
-	store.Options(sessions.Options{
+	guests := NewGuestManager(db, redisClient, sessionSecret)
+	sessionStore := cookie.NewStore([]byte(sessionSecret))
+	sessionStore.Options(sessions.Options{
 		Path:     "/",
 		MaxAge:   86400 * 7, // 7 days
 		HttpOnly: true,
 		Secure:   false, // Set to true in production with HTTPS
 		SameSite: http.SameSiteLaxMode,
 	})
-	r.Use(sessions.Sessions("coverflow_session", store))
+	r.Use(sessions.Sessions("coverflow_session", sessionStore))
 
 	// Initialize Google OAuth2 config
 	googleClientID := os.Getenv("GOOGLE_CLIENT_ID")
@@ -207,11 +180,8 @@ func main() {
 		AllowCredentials: true,
 	}))
 
-	// Serve static files from temp directory
-	r.Static("/temp", tempDir)
-
-	// Serve user storage files
-	r.Static("/storage", storageDir)
+	// Serve user storage files to their owner or by signed URL
+	r.GET("/storage/*path", serveStorage(db, guests, store))
 
 	// Endpoint to serve images from Redis
 	r.GET("/api/image/:imageId", func(c *gin.Context) {
@@ -248,6 +218,15 @@ func main() {
 			// Generate state token for CSRF protection
 			state := uuid.New().String()
 			session.Set("oauth_state", state)
+
+			// Time zone of the browser (e.g. ?tz=Europe/Moscow), used for new accounts
+			if tz := c.Query("tz"); validTimezone(tz) {
+				session.Set("signup_timezone", tz)
+			}
+			// Referral code of the link the user came from (?ref=CODE)
+			if ref := c.Query("ref"); ref != "" {
+				session.Set("signup_referral", ref)
+			}
 			if err := session.Save(); err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
 				return
@@ -294,18 +273,26 @@ func main() {
 			}
 
 			// Get or create user in database
-			user, err := GetOrCreateUser(db, userInfo.Id, userInfo.Email, userInfo.Name, userInfo.Picture)
+			signup := SignupInfo{IP: c.ClientIP()}
+			signup.Timezone, _ = session.Get("signup_timezone").(string)
+			signup.ReferralCode, _ = session.Get("signup_referral").(string)
+			user, err := GetOrCreateUser(db, userInfo.Id, userInfo.Email, userInfo.Name, userInfo.Picture, signup)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 				return
 			}
 
+			// Move the generations and credits of this device's guest into the account
+			guests.MergeIntoAccount(c, user.ID)
+
 			// Save user info in session
 			session.Set("user_id", user.ID)
 			session.Set("user_email", user.Email)
 			session.Set("user_name", user.Name)
 			session.Set("user_picture", user.Picture)
 			session.Delete("oauth_state")
+			session.Delete("signup_timezone")
+			session.Delete("signup_referral")
 			if err := session.Save(); err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
 				return
@@ -346,17 +333,66 @@ func main() {
 
 		// Check limits
 		canGenerate, remaining, _ := CheckGenerationLimit(db, userID)
+		subscription, _ := ActiveSubscription(db, userID, time.Now())
 
 		c.JSON(http.StatusOK, gin.H{
-			"id":                    user.ID,
-			"email":                 user.Email,
-			"name":                  user.Name,
-			"picture":               user.Picture,
-			"can_generate":          canGenerate,
-			"generations_remaining": remaining,
-			"free_generations_left": user.FreeGenerationsLeft,
-			"paid_generations":      user.PaidGenerations,
+			"id":                       user.ID,
+			"email":                    user.Email,
+			"name":                     user.Name,
+			"picture":                  user.Picture,
+			"can_generate":             canGenerate,
+			"generations_remaining":    remaining,
+			"free_generations_left":    availableFreeGenerations(&user, time.Now()),
+			"subscription_generations": availableSubscriptionGenerations(db, &user, time.Now()),
+			"paid_generations":         user.PaidGenerations,
+			"subscription":             subscription,
+			"timezone":                 userLocation(&user).String(),
+			"free_reset_policy":        freeResetPolicy(),
+		})
+	})
+
+	// Update profile settings
+	r.PUT("/api/user/profile", func(c *gin.Context) {
+		session := sessions.Default(c)
+		userIDValue := session.Get("user_id")
+
+		if userIDValue == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+			return
+		}
+
+		userID, _ := userIDValue.(string)
+
+		var req struct {
+			Timezone string `json:"timezone" binding:"required"` // IANA zone, e.g. "Europe/Moscow"
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		if !validTimezone(req.Timezone) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone"})
+			return
+		}
+
+		// Grant what is due in the old zone, then start a new period so that
+		// switching zones can not skip ahead to the next day's allowance
+		err := db.Transaction(func(tx *gorm.DB) error {
+			now := time.Now()
+			if err := grantDailyFree(tx, userID, now); err != nil {
+				return err
+			}
+			return tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+				"timezone":          req.Timezone,
+				"free_period_start": now.UTC(),
+			}).Error
 		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"timezone": req.Timezone})
 	})
 
 	// Logout
@@ -393,13 +429,29 @@ func main() {
 		})
 	})
 
-	// Get available packages
-	r.GET("/api/packages", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"packages": Packages})
+	// Storage used by the user's covers and collages, and the quota of their tier
+	r.GET("/api/user/storage", func(c *gin.Context) {
+		userIDStr := guests.CurrentUserID(c)
+		if userIDStr == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+			return
+		}
+
+		usage, err := GetStorageUsage(db, userIDStr)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load storage usage"})
+			return
+		}
+
+		response := gin.H{"storage": usage}
+		if usage.UsedFiles >= usage.QuotaFiles || usage.UsedBytes >= usage.QuotaBytes {
+			response["message"] = storageCleanupHint
+		}
+		c.JSON(http.StatusOK, response)
 	})
 
-	// Create payment order (Lava Top)
-	r.POST("/api/payment/create", func(c *gin.Context) {
+	// Current subscription
+	r.GET("/api/user/subscription", func(c *gin.Context) {
 		session := sessions.Default(c)
 		userIDValue := session.Get("user_id")
 
@@ -410,584 +462,1245 @@ func main() {
 
 		userID, _ := userIDValue.(string)
 
-		var req struct {
-			PackageType string `json:"package_type" binding:"required"` // "pack1", "pack2", "pack3"
-			Currency    string `json:"currency" binding:"required"`     // "USD" or "RUB"
-		}
-
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		subscription, err := ActiveSubscription(db, userID, time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load subscription"})
 			return
 		}
 
-		// Find package
-		var selectedPackage *Package
-		for _, pkg := range Packages {
-			if pkg.Type == req.PackageType {
-				selectedPackage = &pkg
-				break
-			}
+		scheduled, err := ScheduledSubscription(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load subscription"})
+			return
 		}
 
-		if selectedPackage == nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid package type"})
+		var user User
+		if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 			return
 		}
 
-		// Get price based on currency
-		var amount float64
-		if req.Currency == "RUB" {
-			amount = selectedPackage.PriceRUB
-		} else {
-			amount = selectedPackage.PriceUSD
-		}
+		c.JSON(http.StatusOK, gin.H{
+			"subscription":          subscription,
+			"scheduled":             scheduled,
+			"generations_remaining": availableSubscriptionGenerations(db, &user, time.Now()),
+		})
+	})
 
-		// Create transaction
-		transactionID := uuid.New().String()
-		transaction := Transaction{
-			ID:          transactionID,
-			UserID:      userID,
-			PackageType: req.PackageType,
-			Amount:      amount,
-			Currency:    req.Currency,
-			Status:      "pending",
+	// Referral link, referred users and earned rewards
+	r.GET("/api/user/referrals", func(c *gin.Context) {
+		session := sessions.Default(c)
+		userIDValue := session.Get("user_id")
+
+		if userIDValue == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+			return
 		}
 
-		if err := db.Create(&transaction).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction"})
+		userID, _ := userIDValue.(string)
+
+		var user User
+		if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 			return
 		}
 
-		// Create Lava Top order
-		orderID, paymentURL, err := createLavaTopOrder(transactionID, amount, req.Currency, selectedPackage)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment order", "details": err.Error()})
+		var referrals []Referral
+		if err := db.Where("referrer_id = ?", userID).Order("created_at DESC").Find(&referrals).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load referrals"})
 			return
 		}
 
-		// Update transaction with Lava order ID
-		transaction.LavaOrderID = orderID
-		db.Save(&transaction)
+		// Referred users are only shown by first name
+		list := make([]gin.H, 0, len(referrals))
+		earned := 0
+		for _, referral := range referrals {
+			var referred User
+			db.Select("name").Where("id = ?", referral.ReferredID).First(&referred)
+			name := strings.Fields(referred.Name)
+			entry := gin.H{
+				"status":     referral.Status,
+				"reward":     referral.ReferrerReward,
+				"created_at": referral.CreatedAt,
+			}
+			if len(name) > 0 {
+				entry["name"] = name[0]
+			}
+			if referral.RewardedAt != nil {
+				entry["rewarded_at"] = referral.RewardedAt
+			}
+			list = append(list, entry)
+			earned += referral.ReferrerReward
+		}
 
 		c.JSON(http.StatusOK, gin.H{
-			"transaction_id": transactionID,
-			"payment_url":    paymentURL,
-			"order_id":       orderID,
+			"code":           user.ReferralCode,
+			"link":           referralLink(user.ReferralCode),
+			"referrals":      list,
+			"earned_rewards": earned,
+			"referrer_bonus": envInt("REFERRAL_REFERRER_BONUS", defaultReferrerBonus),
+			"referred_bonus": envInt("REFERRAL_REFERRED_BONUS", defaultReferredBonus),
 		})
 	})
 
-	// Lava Top webhook
-	r.POST("/api/payment/webhook", func(c *gin.Context) {
-		// Verify webhook signature from Lava Top
-		// Process payment confirmation
-		var webhookData map[string]interface{}
-		if err := c.ShouldBindJSON(&webhookData); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook data"})
+	// Credit history from the ledger
+	r.GET("/api/user/credits/history", func(c *gin.Context) {
+		session := sessions.Default(c)
+		userIDValue := session.Get("user_id")
+
+		if userIDValue == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
 			return
 		}
 
-		// Extract order ID and status from webhook
-		orderID, _ := webhookData["order_id"].(string)
-		status, _ := webhookData["status"].(string)
+		userID, _ := userIDValue.(string)
 
-		// Find transaction
-		var transaction Transaction
-		if err := db.Where("lava_order_id = ?", orderID).First(&transaction).Error; err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
-			return
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if limit <= 0 || limit > 200 {
+			limit = 50
+		}
+		offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if offset < 0 {
+			offset = 0
 		}
 
-		if status == "success" || status == "completed" {
-			// Update transaction status
-			transaction.Status = "completed"
-			db.Save(&transaction)
-
-			// Find package and add generations
-			for _, pkg := range Packages {
-				if pkg.Type == transaction.PackageType {
-					if err := AddPaidGenerations(db, transaction.UserID, pkg.Count); err != nil {
-						fmt.Printf("Failed to add generations: %v\n", err)
-					}
-					break
-				}
-			}
-		} else {
-			transaction.Status = "failed"
-			db.Save(&transaction)
+		var entries []CreditLedgerEntry
+		err := db.Where("user_id = ?", userID).
+			Order("created_at DESC").
+			Limit(limit).
+			Offset(offset).
+			Find(&entries).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load credit history"})
+			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		c.JSON(http.StatusOK, gin.H{
+			"entries": entries,
+			"limit":   limit,
+			"offset":  offset,
+		})
 	})
 
-	// Health check endpoint
-	r.GET("/api/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
-	})
+	// Admin endpoints
+	admin := r.Group("/api/admin", requireAdmin())
 
-	// Generate cover endpoint
-	r.POST("/api/generate-cover", func(c *gin.Context) {
-		var req GenerateCoverRequest
+	// Adjust a user balance
+	admin.POST("/users/:id/credits", func(c *gin.Context) {
+		var req struct {
+			Kind      string `json:"kind" binding:"required"` // "free" or "paid"
+			Delta     int    `json:"delta" binding:"required"`
+			Reference string `json:"reference"`
+			Note      string `json:"note" binding:"required"` // why the balance was changed
+		}
 		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 			return
 		}
 
-		// Get user ID from session
-		session := sessions.Default(c)
-		userIDValue := session.Get("user_id")
-		userIDStr := "anonymous"
-		if userIDValue != nil {
-			if id, ok := userIDValue.(string); ok {
-				userIDStr = id
-			}
+		if err := AdjustCredits(db, c.Param("id"), req.Kind, req.Delta, req.Reference, req.Note); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to adjust credits", "details": err.Error()})
+			return
 		}
 
-		// Default to nanobanana if not specified
-		provider := req.Provider
-		if provider == "" {
-			provider = "nanobanana"
+		reconciliation, err := ReconcileCredits(db, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load balances"})
+			return
 		}
+		c.JSON(http.StatusOK, reconciliation)
+	})
 
-		// Remove data:image prefix if present
-		imageData := req.Image
-		var imageFormat string
-		if strings.HasPrefix(imageData, "data:image") {
-			parts := strings.Split(imageData, ";base64,")
-			if len(parts) == 2 {
-				// Extract format
-				formatPart := strings.Split(parts[0], "/")
-				if len(formatPart) == 2 {
-					imageFormat = formatPart[1]
-				}
-				imageData = parts[1]
-			} else {
-				// Try old format
-				parts := strings.Split(imageData, ",")
-				if len(parts) == 2 {
-					imageData = parts[1]
-				}
-			}
+	// Check a user balance against the ledger
+	admin.GET("/users/:id/credits/reconcile", func(c *gin.Context) {
+		reconciliation, err := ReconcileCredits(db, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
 		}
+		c.JSON(http.StatusOK, reconciliation)
+	})
 
-		if imageFormat == "" {
-			imageFormat = "png"
+	// All packages including retired ones, with current prices
+	admin.GET("/packages", func(c *gin.Context) {
+		packages, err := ListPackages(db, true)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load packages"})
+			return
 		}
+		c.JSON(http.StatusOK, gin.H{"packages": packages})
+	})
 
-		var coverURL string
-		var err error
+	// Create a package
+	admin.POST("/packages", func(c *gin.Context) {
+		var input PackageInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
 
-		// Check generation limit
-		canGenerate, remaining, err := CheckGenerationLimit(db, userIDStr)
+		pkg, err := CreatePackage(db, input)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check generation limit"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to create package", "details": err.Error()})
 			return
 		}
+		c.JSON(http.StatusCreated, pkg)
+	})
 
-		if !canGenerate {
-			c.JSON(http.StatusPaymentRequired, gin.H{
-				"error":     "No generations left",
-				"remaining": remaining,
-				"message":   "You have reached your generation limit. Please purchase a package to continue.",
-			})
+	// Update a package, changed prices get a new version
+	admin.PUT("/packages/:type", func(c *gin.Context) {
+		var input PackageInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 			return
 		}
 
-		// Determine if using free or paid generation
-		var user User
-		db.Where("id = ?", userIDStr).First(&user)
-		now := time.Now()
-		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-		useFree := user.FreeGenerationsLeft > 0 && (user.LastFreeGeneration.Before(today) || user.LastFreeGeneration.IsZero())
-
-		if provider == "nanobanana" {
-			if nanoBananaKey == "" {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Nano Banana API key not configured"})
-				return
-			}
-			ctx := context.Background()
-			coverURL, err = generateCoverWithNanoBanana(imageData, imageFormat, nanoBananaKey, redisClient, ctx, userIDStr, storageDir, req.Prompt)
-		} else if provider == "openai" {
-			if openAIKey == "" {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "OpenAI API key not configured"})
-				return
-			}
-			coverURL, err = generateCoverWithOpenAI(imageData, openAIKey, userIDStr, storageDir, req.Prompt)
-		} else {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid provider. Use 'openai' or 'nanobanana'"})
+		pkg, err := UpdatePackage(db, c.Param("type"), input)
+		if err == ErrPackageNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Package not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to update package", "details": err.Error()})
 			return
 		}
+		c.JSON(http.StatusOK, pkg)
+	})
 
-		// If generation successful, use up generation credit
-		if err == nil {
-			if err := UseGeneration(db, userIDStr, useFree); err != nil {
-				fmt.Printf("Warning: Failed to update generation count: %v\n", err)
-			}
+	// Retire a package, it is no longer sold but old transactions keep it
+	admin.DELETE("/packages/:type", func(c *gin.Context) {
+		if err := RetirePackage(db, c.Param("type")); err == ErrPackageNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Package not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retire package"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "retired"})
+	})
 
-			// Record generation
-			generationID := uuid.New().String()
-			generation := Generation{
-				ID:       generationID,
-				UserID:   userIDStr,
-				ImageURL: coverURL,
-				Provider: provider,
-				IsFree:   useFree,
-			}
-			db.Create(&generation)
+	// Promo codes
+	admin.GET("/promo-codes", func(c *gin.Context) {
+		var codes []PromoCode
+		if err := db.Order("created_at DESC").Find(&codes).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load promo codes"})
+			return
 		}
+		c.JSON(http.StatusOK, gin.H{"promo_codes": codes})
+	})
 
-		if err != nil {
-			fmt.Printf("Error generating cover: %v\n", err)
-			// Determine appropriate status code
-			statusCode := http.StatusInternalServerError
-			errMsg := err.Error()
-
-			// Check for specific error types
-			if strings.Contains(errMsg, "API key not configured") || strings.Contains(errMsg, "IMGBB_API_KEY not set") {
-				statusCode = http.StatusBadRequest
-			} else if strings.Contains(errMsg, "authentication failed") || strings.Contains(errMsg, "insufficient account balance") {
-				statusCode = http.StatusUnauthorized
-			}
+	admin.POST("/promo-codes", func(c *gin.Context) {
+		var input PromoCodeInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
 
-			c.JSON(statusCode, gin.H{
-				"error":   "Failed to generate cover",
-				"details": errMsg,
-			})
+		promo, err := CreatePromoCode(db, input)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to create promo code", "details": err.Error()})
 			return
 		}
+		c.JSON(http.StatusCreated, promo)
+	})
 
-		response := GenerateCoverResponse{
-			ID:       uuid.New().String(),
-			ImageURL: coverURL,
+	admin.DELETE("/promo-codes/:code", func(c *gin.Context) {
+		if err := DeactivatePromoCode(db, c.Param("code")); err == ErrPromoNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Promo code not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate promo code"})
+			return
 		}
+		c.JSON(http.StatusOK, gin.H{"status": "deactivated"})
+	})
 
-		c.JSON(http.StatusOK, response)
+	// Redemptions of a code with client addresses, for abuse review
+	admin.GET("/promo-codes/:code/redemptions", func(c *gin.Context) {
+		var redemptions []PromoRedemption
+		err := db.Where("code = ?", normalizePromoCode(c.Param("code"))).
+			Order("created_at DESC").
+			Find(&redemptions).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load redemptions"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"redemptions": redemptions})
 	})
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
+	// Report what the storage cleanup would remove, without removing anything
+	admin.GET("/storage/cleanup", func(c *gin.Context) {
+		report, err := CleanupStorage(db, store, true)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
 
-	fmt.Printf("Server starting on port %s\n", port)
-	if err := r.Run(":" + port); err != nil {
-		fmt.Printf("Failed to start server: %v\n", err)
-	}
-}
+	// Run the storage cleanup now
+	admin.POST("/storage/cleanup", func(c *gin.Context) {
+		report, err := CleanupStorage(db, store, false)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clean up storage", "details": err.Error()})
+			return
+		}
+		printCleanupReport(report)
+		c.JSON(http.StatusOK, report)
+	})
 
-func generateCoverWithOpenAI(imageData string, apiKey string, userID string, storageDir string, customPrompt string) (string, error) {
-	prompt := customPrompt
-	if prompt == "" {
-		prompt = "Create a professional YouTube thumbnail cover based on this collage. Make it visually appealing, modern, and optimized for video thumbnails. Ensure high quality and attention-grabbing design."
-	}
+	// Transactions flagged for review, e.g. paid with another amount
+	admin.GET("/transactions/flagged", func(c *gin.Context) {
+		var transactions []Transaction
+		err := db.Where("flag_reason <> ''").Order("created_at DESC").Limit(100).Find(&transactions).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load transactions"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"transactions": transactions})
+	})
 
-	openAIReq := map[string]interface{}{
-		"model":  "dall-e-3",
-		"prompt": prompt,
-		"n":      1,
-		"size":   "1024x1024",
-	}
+	// Redeem a promo code. Credits codes add generations right away,
+	// discount codes are checked and then passed to /api/payment/create.
+	r.POST("/api/promo/redeem", func(c *gin.Context) {
+		session := sessions.Default(c)
+		userIDValue := session.Get("user_id")
 
-	reqBody, err := json.Marshal(openAIReq)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
-	}
+		if userIDValue == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+			return
+		}
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/images/generations", bytes.NewBuffer(reqBody))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
+		userID, _ := userIDValue.(string)
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+		var req struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
 
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
+		promo, err := ValidatePromoCode(db, req.Code, userID)
+		if isPromoCodeError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check promo code"})
+			return
+		}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
-	}
+		if promo.Kind == PromoKindDiscount {
+			c.JSON(http.StatusOK, gin.H{
+				"code":             promo.Code,
+				"kind":             promo.Kind,
+				"discount_percent": promo.DiscountPercent,
+				"package_type":     promo.PackageType,
+				"message":          "Pass the code as promo_code when creating the payment.",
+			})
+			return
+		}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("OpenAI API error: %s (status: %d)", string(body), resp.StatusCode)
-	}
+		redemption, err := RedeemCreditsCode(db, req.Code, userID, c.ClientIP(), c.Request.UserAgent())
+		if isPromoCodeError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			fmt.Printf("Warning: Failed to redeem promo code %s: %v\n", req.Code, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem promo code"})
+			return
+		}
 
-	var openAIResp OpenAIResponse
-	if err := json.Unmarshal(body, &openAIResp); err != nil {
-		return "", fmt.Errorf("failed to unmarshal response: %w", err)
-	}
+		_, remaining, _ := CheckGenerationLimit(db, userID)
+		c.JSON(http.StatusOK, gin.H{
+			"code":      redemption.Code,
+			"kind":      promo.Kind,
+			"credits":   redemption.Credits,
+			"remaining": remaining,
+		})
+	})
 
-	if openAIResp.Error != nil {
-		return "", fmt.Errorf("OpenAI API error: %s", openAIResp.Error.Message)
-	}
+	// Get available packages
+	r.GET("/api/packages", func(c *gin.Context) {
+		packages, err := ListPackages(db, false)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load packages"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"packages": packages})
+	})
 
-	if len(openAIResp.Data) == 0 {
-		return "", fmt.Errorf("no image URL in response")
-	}
+	// Create payment order with the gateway of the currency or region
+	r.POST("/api/payment/create", func(c *gin.Context) {
+		session := sessions.Default(c)
+		userIDValue := session.Get("user_id")
 
-	// Download and save generated image
-	resultURL := openAIResp.Data[0].URL
-	savedPath, err := downloadAndSaveImage(resultURL, userID, storageDir)
-	if err != nil {
-		fmt.Printf("Warning: Failed to save image locally: %v\n", err)
-		// Return original URL if save fails
-		return resultURL, nil
-	}
+		if userIDValue == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+			return
+		}
 
-	// Return local URL
-	baseURL := os.Getenv("BASE_URL")
-	if baseURL == "" {
-		baseURL = "http://localhost:8080"
-	}
-	return fmt.Sprintf("%s/storage/%s", baseURL, savedPath), nil
-}
+		userID, _ := userIDValue.(string)
 
-func generateCoverWithNanoBanana(imageData string, imageFormat string, apiKey string, redisClient *redis.Client, ctx context.Context, userID string, storageDir string, customPrompt string) (string, error) {
+		var req struct {
+			PackageType string `json:"package_type" binding:"required"` // "pack1", "pack2", "pack3"
+			Currency    string `json:"currency" binding:"required"`     // "USD" or "RUB"
+			PromoCode   string `json:"promo_code"`                      // optional discount code
+			Country     string `json:"country"`                         // optional ISO country of the buyer, e.g. "RU"
+		}
 
-	// Decode base64 image
-	decodedData, err := base64.StdEncoding.DecodeString(imageData)
-	if err != nil {
-		return "", fmt.Errorf("failed to decode base64 image: %w", err)
-	}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
 
-	// Validate image size (max 10MB for Nano Banana API)
-	if len(decodedData) > 10*1024*1024 {
-		return "", fmt.Errorf("image size exceeds 10MB limit")
-	}
+		// Find package
+		selectedPackage, err := GetActivePackage(db, req.PackageType)
+		if err == ErrPackageNotFound {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid package type"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load package"})
+			return
+		}
 
-	// Save image to Redis with expiration
-	imageID := fmt.Sprintf("%s.%s", uuid.New().String(), imageFormat)
-	redisKey := fmt.Sprintf("image:%s", imageID)
+		// A subscription is renewed by the provider, a second one is not sold
+		if selectedPackage.Kind == PackageKindSubscription {
+			subscription, err := ActiveSubscription(db, userID, time.Now())
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load subscription"})
+				return
+			}
+			if subscription != nil && subscription.Status != SubscriptionStatusCancelled {
+				c.JSON(http.StatusConflict, gin.H{"error": "You already have an active subscription"})
+				return
+			}
+			// A new subscription bought during a cancelled one starts when it ends
+			scheduled, err := ScheduledSubscription(db, userID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load subscription"})
+				return
+			}
+			if scheduled != nil {
+				c.JSON(http.StatusConflict, gin.H{"error": "You already have a subscription starting on " + scheduled.CurrentPeriodStart.Format("2006-01-02")})
+				return
+			}
+		}
 
-	err = redisClient.Set(ctx, redisKey, decodedData, 30*time.Minute).Err()
-	if err != nil {
-		return "", fmt.Errorf("failed to save image to Redis: %w", err)
-	}
-	fmt.Printf("Image saved to Redis: %s (size: %d bytes)\n", imageID, len(decodedData))
+		// Get price based on currency
+		price, err := CurrentPackagePrice(db, selectedPackage.ID, req.Currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Package is not available in this currency"})
+			return
+		}
+		amount := price.Amount
+
+		var promo *PromoCode
+		var discount float64
+		if req.PromoCode != "" {
+			promo, err = ValidatePromoCode(db, req.PromoCode, userID)
+			if err == nil {
+				discount, err = PromoDiscount(promo, req.PackageType, amount)
+			}
+			if isPromoCodeError(err) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check promo code"})
+				return
+			}
+			amount -= discount
+		}
 
-	// Create public URL for the image
-	baseURL := os.Getenv("BASE_URL")
-	if baseURL == "" {
-		baseURL = "http://localhost:8080"
-	}
-	imageURL := fmt.Sprintf("%s/api/image/%s", baseURL, imageID)
-	fmt.Printf("Image accessible at: %s\n", imageURL)
+		// Create transaction with a snapshot of what is being bought
+		transactionID := uuid.New().String()
+		transaction := Transaction{
+			ID:           transactionID,
+			UserID:       userID,
+			PackageType:  req.PackageType,
+			PackageID:    selectedPackage.ID,
+			PackageName:  selectedPackage.Name,
+			PackageKind:  selectedPackage.Kind,
+			PackageCount: selectedPackage.Count,
+			PriceID:      price.ID,
+			Amount:       amount,
+			Currency:     price.Currency,
+			Status:       "pending",
+			Discount:     discount,
+		}
+		if promo != nil {
+			transaction.PromoCode = promo.Code
+		}
 
-	// Create task
-	taskID, err := createNanoBananaTask(imageURL, apiKey, customPrompt)
-	if err != nil {
-		// Clean up Redis on error
-		redisClient.Del(ctx, redisKey)
-		return "", fmt.Errorf("failed to create Nano Banana task: %w", err)
-	}
+		country := req.Country
+		if country == "" {
+			// Set by Cloudflare when the server runs behind it
+			country = c.GetHeader("CF-IPCountry")
+		}
+		paymentProvider, err := SelectPaymentProvider(price.Currency, country)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Payments in this currency are not available", "details": err.Error()})
+			return
+		}
+		transaction.Provider = paymentProvider.Name()
+		// Replaced by the provider order ID once the order is created
+		transaction.LavaOrderID = transactionID
+
+		// The discount is held together with the transaction
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&transaction).Error; err != nil {
+				return err
+			}
+			if promo == nil {
+				return nil
+			}
+			return holdPromoDiscount(tx, promo, &transaction, c.ClientIP(), c.Request.UserAgent())
+		})
+		if isPromoCodeError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction"})
+			return
+		}
 
-	fmt.Printf("Nano Banana task created: %s\n", taskID)
+		order, err := paymentProvider.CreateInvoice(c.Request.Context(), PaymentInvoice{
+			TransactionID: transactionID,
+			Amount:        amount,
+			Currency:      price.Currency,
+			Description:   selectedPackage.Name,
+			Recurring:     selectedPackage.Kind == PackageKindSubscription,
+		})
+		if err != nil {
+			// Give the promo code back
+			if err := FailTransaction(db, &transaction); err != nil {
+				fmt.Printf("Warning: Failed to fail transaction %s: %v\n", transactionID, err)
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment order", "details": err.Error()})
+			return
+		}
 
-	// Poll for result
-	maxAttempts := 120 // 10 minutes max (5 second intervals)
-	interval := 5 * time.Second
+		// Update transaction with the provider order ID
+		transaction.LavaOrderID = order.OrderID
+		db.Save(&transaction)
 
-	resultURL, err := pollNanoBananaTask(taskID, apiKey, maxAttempts, interval)
-	if err != nil {
-		// Clean up Redis on error
-		redisClient.Del(ctx, redisKey)
-		return "", fmt.Errorf("failed to get Nano Banana result: %w", err)
-	}
+		c.JSON(http.StatusOK, gin.H{
+			"transaction_id": transactionID,
+			"provider":       paymentProvider.Name(),
+			"payment_url":    order.PaymentURL,
+			"order_id":       order.OrderID,
+			"amount":         amount,
+			"discount":       discount,
+		})
+	})
 
-	fmt.Printf("Nano Banana task completed successfully. Result URL: %s\n", resultURL)
+	// Payment provider webhooks
+	handlePaymentWebhook := func(c *gin.Context, paymentProvider PaymentProvider) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook data"})
+			return
+		}
+
+		// The provider verifies the signature before the body is parsed
+		event, err := paymentProvider.ParseWebhook(c.Request.Header, body)
+		if err == ErrInvalidWebhookSignature {
+			fmt.Printf("Rejected %s payment webhook: %v\n", paymentProvider.DisplayName(), err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid webhook signature"})
+			return
+		} else if err != nil {
+			fmt.Printf("Rejected %s payment webhook: %v\n", paymentProvider.DisplayName(), err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook data"})
+			return
+		}
+		if event == nil {
+			c.JSON(http.StatusOK, gin.H{"status": "ignored"})
+			return
+		}
 
-	// Clean up Redis cache after successful generation
-	redisClient.Del(ctx, redisKey)
-	fmt.Printf("Cleaned up Redis cache for image: %s\n", imageID)
+		if err := ApplyPaymentEvent(db, paymentProvider.Name(), event); err == ErrTransactionNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+			return
+		} else if err != nil {
+			fmt.Printf("Failed to apply %s payment event for order %s: %v\n", paymentProvider.DisplayName(), event.OrderID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update transaction"})
+			return
+		}
 
-	// Download and save generated image
-	savedPath, err := downloadAndSaveImage(resultURL, userID, storageDir)
-	if err != nil {
-		fmt.Printf("Warning: Failed to save image locally: %v\n", err)
-		// Return original URL if save fails
-		return resultURL, nil
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	}
 
-	// Return local URL
-	return fmt.Sprintf("%s/storage/%s", baseURL, savedPath), nil
-}
+	// Lava Top webhook, kept at its original URL
+	r.POST("/api/payment/webhook", func(c *gin.Context) {
+		lava, _ := GetPaymentProvider("lava")
+		handlePaymentWebhook(c, lava)
+	})
 
-func createNanoBananaTask(imageURL string, apiKey string, customPrompt string) (string, error) {
-	// Use custom prompt if provided, otherwise use default
-	prompt := customPrompt
-	if prompt == "" {
-		prompt = "Transform this collage into a professional YouTube thumbnail cover. " +
-			"Make it visually striking, modern, and optimized for video thumbnails. " +
-			"Ensure high quality, attention-grabbing design with good contrast and readable text. " +
-			"Maintain the key elements from the collage but enhance them professionally. " +
-			"Use 16:9 aspect ratio suitable for YouTube thumbnails."
-	}
+	r.POST("/api/payment/:provider/webhook", func(c *gin.Context) {
+		paymentProvider, ok := GetPaymentProvider(c.Param("provider"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unknown payment provider"})
+			return
+		}
+		handlePaymentWebhook(c, paymentProvider)
+	})
 
-	reqBody := NanoBananaCreateTaskRequest{
-		Model: "google/nano-banana-edit",
-		Input: NanoBananaInput{
-			Prompt:       prompt,
-			ImageUrls:    []string{imageURL},
-			OutputFormat: "png",
-			ImageSize:    "16:9", // YouTube thumbnail standard
-		},
-	}
+	// Payment gateways and the currencies they accept
+	r.GET("/api/payment/providers", func(c *gin.Context) {
+		list := []gin.H{}
+		for _, p := range PaymentProviders() {
+			if !p.Configured() {
+				continue
+			}
+			list = append(list, gin.H{
+				"name":         p.Name(),
+				"display_name": p.DisplayName(),
+				"currencies":   p.Currencies(),
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"providers": list})
+	})
 
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
-	}
+	// Available image providers
+	r.GET("/api/providers", func(c *gin.Context) {
+		list := []gin.H{}
+		for _, p := range Providers() {
+			list = append(list, gin.H{
+				"name":         p.Name(),
+				"display_name": p.DisplayName(),
+				"configured":   p.Configured(),
+				"capabilities": p.Capabilities(),
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"providers": list})
+	})
 
-	req, err := http.NewRequest("POST", "https://api.kie.ai/api/v1/jobs/createTask", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
+	// Health check endpoint
+	r.GET("/api/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	// Generate cover endpoint
+	r.POST("/api/generate-cover", func(c *gin.Context) {
+		var req GenerateCoverRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
+		// Get user ID from session
+		// Signed in user, or the guest of this device
+		userIDStr, err := guests.EnsureUserID(c)
+		if err == ErrGuestLimitExceeded {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many guest sessions, please sign in to continue"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create guest user"})
+			return
+		}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
-	}
+		// Default to nanobanana if not specified
+		provider := req.Provider
+		if provider == "" {
+			provider = "nanobanana"
+		}
 
-	// Check HTTP status code
-	if resp.StatusCode == 401 {
-		return "", fmt.Errorf("authentication failed: check your NANO_BANANA_API_KEY")
-	}
-	if resp.StatusCode == 402 {
-		return "", fmt.Errorf("insufficient account balance")
-	}
-	if resp.StatusCode == 429 {
-		return "", fmt.Errorf("rate limit exceeded, please try again later")
-	}
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("nano banana API error: %s (status: %d)", string(body), resp.StatusCode)
-	}
+		variants := req.Variants
+		if variants == 0 {
+			variants = 1
+		}
+		if variants < 1 || variants > maxVariants {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("variants must be between 1 and %d", maxVariants)})
+			return
+		}
 
-	var taskResp NanoBananaCreateTaskResponse
-	if err := json.Unmarshal(body, &taskResp); err != nil {
-		return "", fmt.Errorf("failed to unmarshal response: %w", err)
-	}
+		imageProvider, ok := GetProvider(provider)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid provider. See GET /api/providers for available providers"})
+			return
+		}
+		if !imageProvider.Configured() {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("%s API key not configured", imageProvider.DisplayName())})
+			return
+		}
 
-	if taskResp.Code != 200 {
-		errorMsg := taskResp.Msg
-		switch taskResp.Code {
-		case 400:
-			errorMsg = "invalid request parameters: " + errorMsg
-		case 401:
-			errorMsg = "authentication failed: " + errorMsg
-		case 402:
-			errorMsg = "insufficient account balance: " + errorMsg
-		case 422:
-			errorMsg = "parameter validation failed: " + errorMsg
-		case 429:
-			errorMsg = "rate limit exceeded: " + errorMsg
-		case 500:
-			errorMsg = "internal server error: " + errorMsg
-		}
-		return "", fmt.Errorf("nano banana API error: %s (code: %d)", errorMsg, taskResp.Code)
-	}
+		// Decode base64 image
+		decodedData, imageFormat, err := decodeBase64Image(req.Image)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to decode base64 image"})
+			return
+		}
 
-	if taskResp.Data.TaskID == "" {
-		return "", fmt.Errorf("no task ID in response")
-	}
+		var maskData []byte
+		if req.Mask != "" {
+			if !imageProvider.Capabilities().Mask {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s does not support masks", imageProvider.DisplayName())})
+				return
+			}
+			maskData, _, err = decodeBase64Image(req.Mask)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to decode base64 mask"})
+				return
+			}
+		}
 
-	return taskResp.Data.TaskID, nil
-}
+		// Validate image size against the provider limit
+		if maxBytes := imageProvider.Capabilities().MaxInputBytes; maxBytes > 0 && len(decodedData) > maxBytes {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Image size exceeds %dMB limit", maxBytes/(1024*1024))})
+			return
+		}
 
-func pollNanoBananaTask(taskID string, apiKey string, maxAttempts int, interval time.Duration) (string, error) {
-	url := fmt.Sprintf("https://api.kie.ai/api/v1/jobs/recordInfo?taskId=%s", taskID)
+		if err := guests.CheckGuestGenerations(c, userIDStr, variants); err != nil {
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error":   "Guest limit reached",
+				"message": "Please sign in with Google to continue generating covers.",
+			})
+			return
+		}
 
-	for i := 0; i < maxAttempts; i++ {
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			return "", fmt.Errorf("failed to create request: %w", err)
+		// Every variant and the collage become stored files
+		if usage, err := CheckStorageQuota(db, userIDStr, variants+1, int64(len(decodedData))); err == ErrStorageQuotaExceeded {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":   "Storage quota exceeded",
+				"message": storageCleanupHint,
+				"storage": usage,
+			})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage quota"})
+			return
 		}
 
-		req.Header.Set("Authorization", "Bearer "+apiKey)
+		// Reserve a credit for every variant before anything is sent to the
+		// provider. The daily free generation covers the first variant.
+		jobIDs := make([]string, 0, variants)
+		reservations := make([]*CreditReservation, 0, variants)
+		releaseReservations := func() {
+			for _, reservation := range reservations {
+				if err := ReleaseReservation(db, reservation.ID); err != nil {
+					fmt.Printf("Warning: Failed to release credit reservation: %v\n", err)
+				}
+			}
+		}
+		for i := 0; i < variants; i++ {
+			jobID := uuid.New().String()
+			reservation, err := ReserveGeneration(db, userIDStr, jobID)
+			if err != nil {
+				releaseReservations()
+				if err == ErrNoGenerationsLeft {
+					_, remaining, _ := CheckGenerationLimit(db, userIDStr)
+					c.JSON(http.StatusPaymentRequired, gin.H{
+						"error":     "No generations left",
+						"remaining": remaining,
+						"message":   "You have reached your generation limit. Please purchase a package to continue.",
+					})
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve generation"})
+				return
+			}
+			jobIDs = append(jobIDs, jobID)
+			reservations = append(reservations, reservation)
+		}
 
-		client := &http.Client{Timeout: 10 * time.Second}
-		resp, err := client.Do(req)
+		// Keep the collage in Redis so the job can be resumed after a restart
+		imageID, err := saveImageToRedis(context.Background(), redisClient, decodedData, imageFormat)
 		if err != nil {
-			fmt.Printf("Poll attempt %d/%d failed, retrying...\n", i+1, maxAttempts)
-			time.Sleep(interval)
-			continue
+			releaseReservations()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cache image", "details": err.Error()})
+			return
 		}
 
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			fmt.Printf("Poll attempt %d/%d failed to read response, retrying...\n", i+1, maxAttempts)
-			time.Sleep(interval)
-			continue
+		var maskID string
+		if maskData != nil {
+			maskID, err = saveImageToRedis(context.Background(), redisClient, maskData, "png")
+			if err != nil {
+				releaseReservations()
+				redisClient.Del(context.Background(), fmt.Sprintf("image:%s", imageID))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cache mask", "details": err.Error()})
+				return
+			}
 		}
 
-		var taskResp NanoBananaTaskResponse
-		if err := json.Unmarshal(body, &taskResp); err != nil {
-			fmt.Printf("Poll attempt %d/%d failed to parse response, retrying...\n", i+1, maxAttempts)
-			time.Sleep(interval)
-			continue
+		// Keep the collage with the generations, the history refers to it
+		var inputURL string
+		if inputPath, err := saveImageToStorage(db, store, decodedData, imageFormat, userIDStr+"/inputs"); err != nil {
+			fmt.Printf("Warning: Failed to save collage: %v\n", err)
+		} else {
+			inputURL = storageURL(inputPath)
 		}
 
-		if taskResp.Code != 200 {
-			return "", fmt.Errorf("nano banana API error: %s (code: %d)", taskResp.Msg, taskResp.Code)
+		batch := &GenerationBatch{
+			ID:       uuid.New().String(),
+			UserID:   userIDStr,
+			Provider: provider,
+			Variants: variants,
 		}
 
-		state := taskResp.Data.State
-		if state == "success" {
-			// Parse result JSON
-			if taskResp.Data.ResultJSON == "" {
-				return "", fmt.Errorf("empty result JSON in response")
+		// Variants share the collage, each one is a job of its own and is
+		// charged only when it succeeds
+		jobs := make([]*GenerationJob, 0, variants)
+		for i, reservation := range reservations {
+			job := &GenerationJob{
+				ID:                jobIDs[i],
+				UserID:            userIDStr,
+				Variant:           i,
+				Provider:          provider,
+				RequestedProvider: provider,
+				Prompt:            req.Prompt,
+				InputImageID:      imageID,
+				InputFormat:       imageFormat,
+				InputURL:          inputURL,
+				MaskImageID:       maskID,
+				IsFree:            reservation.IsFree,
+				ReservationID:     reservation.ID,
 			}
+			jobManager.emit(job, JobEvent{Type: JobEventUploaded, Message: "Collage uploaded to Redis"})
+			jobs = append(jobs, job)
+		}
+
+		if err := jobManager.SubmitBatch(batch, jobs); err != nil {
+			releaseReservations()
+			redisClient.Del(context.Background(), fmt.Sprintf("image:%s", imageID), fmt.Sprintf("image:%s", maskID))
+			// The unreferenced collage is removed by the blob collector
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create generation job"})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, GenerateCoverResponse{
+			ID:      jobs[0].ID,
+			BatchID: batch.ID,
+			JobIDs:  jobIDs,
+			Status:  JobStatusQueued,
+		})
+	})
+
+	// Generation job status
+	r.GET("/api/jobs/:id", func(c *gin.Context) {
+		userIDStr := guests.CurrentUserID(c)
+
+		var job GenerationJob
+		if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userIDStr).First(&job).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+
+		job.ImageURL = signedURL(store, job.ImageURL)
+		c.JSON(http.StatusOK, job)
+	})
+
+	// Generation batch status with the results of all variants
+	r.GET("/api/batches/:id", func(c *gin.Context) {
+		userIDStr := guests.CurrentUserID(c)
+
+		var batch GenerationBatch
+		if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userIDStr).First(&batch).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+			return
+		}
+
+		var jobs []GenerationJob
+		if err := db.Where("batch_id = ?", batch.ID).Order("variant").Find(&jobs).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load batch jobs"})
+			return
+		}
+		signJobURLs(store, jobs)
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":         batch.ID,
+			"provider":   batch.Provider,
+			"variants":   batch.Variants,
+			"status":     batchStatus(jobs),
+			"image_urls": batchImageURLs(jobs),
+			"jobs":       jobs,
+			"created_at": batch.CreatedAt,
+		})
+	})
 
-			var result NanoBananaResult
-			if err := json.Unmarshal([]byte(taskResp.Data.ResultJSON), &result); err != nil {
-				return "", fmt.Errorf("failed to parse result JSON: %w", err)
+	// Generation history, newest first, paginated by cursor
+	r.GET("/api/generations", func(c *gin.Context) {
+		userIDStr := guests.CurrentUserID(c)
+		if userIDStr == "" {
+			c.JSON(http.StatusOK, gin.H{"generations": []Generation{}, "next_cursor": ""})
+			return
+		}
+
+		filter := GenerationFilter{
+			Provider: c.Query("provider"),
+			Cursor:   c.Query("cursor"),
+		}
+		if limit := c.Query("limit"); limit != "" {
+			value, err := strconv.Atoi(limit)
+			if err != nil || value <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+				return
+			}
+			filter.Limit = value
+		}
+		if from := c.Query("from"); from != "" {
+			t, err := parseHistoryDate(from, false)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date, use YYYY-MM-DD or RFC 3339"})
+				return
+			}
+			filter.From = t
+		}
+		if to := c.Query("to"); to != "" {
+			t, err := parseHistoryDate(to, true)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date, use YYYY-MM-DD or RFC 3339"})
+				return
 			}
+			filter.To = t
+		}
+		switch c.Query("type") {
+		case "":
+		case "free":
+			free := true
+			filter.Free = &free
+		case "paid":
+			free := false
+			filter.Free = &free
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Type must be free or paid"})
+			return
+		}
+
+		generations, nextCursor, err := ListGenerations(db, userIDStr, filter)
+		if err == ErrInvalidCursor {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load generations"})
+			return
+		}
+		signGenerationURLs(store, generations)
+
+		c.JSON(http.StatusOK, gin.H{
+			"generations": generations,
+			"next_cursor": nextCursor,
+		})
+	})
 
-			if len(result.ResultUrls) == 0 {
-				return "", fmt.Errorf("no result URLs in response")
+	r.GET("/api/generations/:id", func(c *gin.Context) {
+		userIDStr := guests.CurrentUserID(c)
+
+		var generation Generation
+		if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userIDStr).First(&generation).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Generation not found"})
+			return
+		}
+
+		generation.ImageURL = signedURL(store, generation.ImageURL)
+		generation.InputURL = signedURL(store, generation.InputURL)
+		c.JSON(http.StatusOK, generation)
+	})
+
+	// Signed link to a cover for sharing and embedding, valid without a session
+	r.POST("/api/generations/:id/share", func(c *gin.Context) {
+		userIDStr := guests.CurrentUserID(c)
+
+		var req struct {
+			ExpiresIn int64 `json:"expires_in"` // seconds, default 7 days, at most 30 days
+		}
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+				return
 			}
+		}
+		ttl := defaultShareURLTTL
+		if req.ExpiresIn > 0 {
+			ttl = time.Duration(req.ExpiresIn) * time.Second
+		}
+		if req.ExpiresIn < 0 || ttl > maxShareURLTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expires_in must be between 1 and %d seconds", int64(maxShareURLTTL/time.Second))})
+			return
+		}
+
+		var generation Generation
+		if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userIDStr).First(&generation).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Generation not found"})
+			return
+		}
+
+		if generation.Expired {
+			c.JSON(http.StatusGone, gin.H{"error": "The cover has expired and was removed from storage"})
+			return
+		}
+		savedPath, ok := storagePath(generation.ImageURL)
+		if !ok {
+			c.JSON(http.StatusConflict, gin.H{"error": "The cover is not in storage and cannot be shared"})
+			return
+		}
+		shareURL, expiresAt := signStorageURL(savedPath, ttl)
+
+		c.JSON(http.StatusOK, gin.H{
+			"url":        shareURL,
+			"expires_at": expiresAt,
+		})
+	})
 
-			if taskResp.Data.CostTime > 0 {
-				fmt.Printf("Task completed in %d ms\n", taskResp.Data.CostTime)
+	// Delete a generation together with its stored cover
+	r.DELETE("/api/generations/:id", func(c *gin.Context) {
+		userIDStr := guests.CurrentUserID(c)
+
+		var generation Generation
+		if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userIDStr).First(&generation).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Generation not found"})
+			return
+		}
+
+		if err := DeleteGeneration(db, store, &generation); err != nil {
+			fmt.Printf("Warning: Failed to delete generation %s: %v\n", generation.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete generation"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	})
+
+	// Report a generation whose image does not load or is broken, the credit
+	// is refunded according to the refund policy
+	r.POST("/api/generations/:id/report", func(c *gin.Context) {
+		userIDStr := guests.CurrentUserID(c)
+
+		var req struct {
+			Reason  string `json:"reason" binding:"required"` // "unavailable" or "broken"
+			Comment string `json:"comment"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		if req.Reason != ReportReasonUnavailable && req.Reason != ReportReasonBroken {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Reason must be unavailable or broken"})
+			return
+		}
+		if len(req.Comment) > 1000 {
+			req.Comment = req.Comment[:1000]
+		}
+
+		var generation Generation
+		if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userIDStr).First(&generation).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Generation not found"})
+			return
+		}
+
+		refund, err := ReportGeneration(db, store, &generation, req.Reason, req.Comment)
+		if err == ErrGenerationRefunded || err == ErrGenerationReported {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			fmt.Printf("Warning: Failed to handle report of generation %s: %v\n", generation.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to handle report"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":        refund.Status,
+			"reject_reason": refund.RejectReason,
+			"credits":       refund.Credits,
+			"credit_kind":   refund.CreditKind,
+			"refund_id":     refund.ID,
+		})
+	})
+
+	// Task completion callback from async providers (e.g. Nano Banana via kie.ai)
+	r.POST("/api/providers/:name/callback", func(c *gin.Context) {
+		imageProvider, ok := GetProvider(c.Param("name"))
+		asyncProvider, isAsync := imageProvider.(AsyncImageProvider)
+		if !ok || !isAsync {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unknown provider"})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid callback data"})
+			return
+		}
+
+		taskID, err := asyncProvider.CallbackTaskID(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid callback data", "details": err.Error()})
+			return
+		}
+
+		// Only accept callbacks for tasks issued for our pending jobs
+		var job GenerationJob
+		err = db.Where("provider = ? AND provider_task_id = ? AND status = ?", imageProvider.Name(), taskID, JobStatusRunning).
+			First(&job).Error
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unknown task"})
+			return
+		}
+
+		fmt.Printf("%s callback received for task %s\n", imageProvider.DisplayName(), taskID)
+
+		// The callback is not authenticated, so it only tells us to look at the
+		// task. Fetching and downloading the result may take a while, answer the
+		// provider right away.
+		go func() {
+			status, err := asyncProvider.FetchTask(context.Background(), taskID)
+			if err != nil {
+				fmt.Printf("Warning: Failed to fetch task %s after callback: %v\n", taskID, err)
+				return
 			}
+			jobManager.completeTask(&job, status)
+		}()
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
 
-			return result.ResultUrls[0], nil
-		} else if state == "fail" {
-			failMsg := taskResp.Data.FailMsg
-			if failMsg == "" {
-				failMsg = "unknown error"
+	// Live generation progress (Server-Sent Events)
+	r.GET("/api/jobs/:id/events", func(c *gin.Context) {
+		userIDStr := guests.CurrentUserID(c)
+
+		var job GenerationJob
+		if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userIDStr).First(&job).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+
+		ctx := c.Request.Context()
+
+		// Subscribe before reading the history so no event is lost in between
+		pubsub := redisClient.Subscribe(ctx, jobEventsChannel(job.ID))
+		defer pubsub.Close()
+		if _, err := pubsub.Receive(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to subscribe to job events"})
+			return
+		}
+
+		history, err := jobEventHistory(ctx, redisClient, job.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load job events"})
+			return
+		}
+
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+
+		var lastSeq int64
+		for _, event := range history {
+			event.ImageURL = signedURL(store, event.ImageURL)
+			c.SSEvent(event.Type, event)
+			lastSeq = event.Seq
+			if event.IsTerminal() {
+				return
 			}
-			return "", fmt.Errorf("task failed: %s (failCode: %s)", failMsg, taskResp.Data.FailCode)
 		}
 
-		// Task is still processing (waiting)
-		if (i+1)%6 == 0 { // Log every 30 seconds
-			fmt.Printf("Task status: %s (waiting for completion, attempt %d/%d)...\n", state, i+1, maxAttempts)
+		// History expired but the job is already done
+		if job.Status == JobStatusSucceeded || job.Status == JobStatusFailed {
+			job.ImageURL = signedURL(store, job.ImageURL)
+			c.SSEvent(job.Status, jobStateEvent(&job))
+			return
 		}
-		time.Sleep(interval)
+		c.Writer.Flush()
+
+		messages := pubsub.Channel()
+		keepAlive := time.NewTicker(15 * time.Second)
+		defer keepAlive.Stop()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-keepAlive.C:
+				c.SSEvent("ping", gin.H{"time": time.Now()})
+				return true
+			case msg, ok := <-messages:
+				if !ok {
+					return false
+				}
+				var event JobEvent
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil || event.Seq <= lastSeq {
+					return true
+				}
+				lastSeq = event.Seq
+				event.ImageURL = signedURL(store, event.ImageURL)
+				c.SSEvent(event.Type, event)
+				return !event.IsTerminal()
+			}
+		})
+	})
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
 	}
 
-	return "", fmt.Errorf("task timeout after %d attempts (approximately %.1f minutes)", maxAttempts, float64(maxAttempts)*interval.Seconds()/60)
+	fmt.Printf("Server starting on port %s\n", port)
+	if err := r.Run(":" + port); err != nil {
+		fmt.Printf("Failed to start server: %v\n", err)
+	}
 }
 
-// downloadAndSaveImage downloads an image from URL and saves it to storage/userid/
-func downloadAndSaveImage(imageURL string, userID string, storageDir string) (string, error) {
+// saveImageToRedis stores an uploaded image in Redis so that it can be
+// served to the provider via /api/image/:imageId. Returns the image ID.
+func saveImageToRedis(ctx context.Context, redisClient *redis.Client, imageData []byte, imageFormat string) (string, error) {
+	// Save image to Redis with expiration
+	imageID := fmt.Sprintf("%s.%s", uuid.New().String(), imageFormat)
+	redisKey := fmt.Sprintf("image:%s", imageID)
+
+	err := redisClient.Set(ctx, redisKey, imageData, 30*time.Minute).Err()
+	if err != nil {
+		return "", fmt.Errorf("failed to save image to Redis: %w", err)
+	}
+	fmt.Printf("Image saved to Redis: %s (size: %d bytes)\n", imageID, len(imageData))
+
+	return imageID, nil
+}
+
+// decodeBase64Image decodes an uploaded image, with or without the
+// data:image/...;base64, prefix. Returns the image and its format.
+func decodeBase64Image(value string) ([]byte, string, error) {
+	// Remove data:image prefix if present
+	imageData := value
+	var imageFormat string
+	if strings.HasPrefix(imageData, "data:image") {
+		parts := strings.Split(imageData, ";base64,")
+		if len(parts) == 2 {
+			// Extract format
+			formatPart := strings.Split(parts[0], "/")
+			if len(formatPart) == 2 {
+				imageFormat = formatPart[1]
+			}
+			imageData = parts[1]
+		} else {
+			// Try old format
+			parts := strings.Split(imageData, ",")
+			if len(parts) == 2 {
+				imageData = parts[1]
+			}
+		}
+	}
+
+	if imageFormat == "" {
+		imageFormat = "png"
+	}
+
+	decodedData, err := base64.StdEncoding.DecodeString(imageData)
+	if err != nil {
+		return nil, "", err
+	}
+	return decodedData, imageFormat, nil
+}
+
+// downloadAndSaveImage downloads a result image of a provider and saves it
+// to storage/userid/. Only the provider's result hosts are contacted, see
+// resultURLAllowed.
+func downloadAndSaveImage(db *gorm.DB, store BlobStore, providerName string, imageURL string, userID string) (string, error) {
+	if !resultURLAllowed(providerName, imageURL) {
+		return "", fmt.Errorf("refusing to download image from %s: not a %s result host", imageURL, providerName)
+	}
+
 	// Download image
-	resp, err := http.Get(imageURL)
+	client := resultClient(providerName, 60*time.Second)
+	resp, err := client.Get(imageURL)
 	if err != nil {
 		return "", fmt.Errorf("failed to download image: %w", err)
 	}
@@ -1003,23 +1716,15 @@ func downloadAndSaveImage(imageURL string, userID string, storageDir string) (st
 		return "", fmt.Errorf("failed to read image data: %w", err)
 	}
 
-	// Create user directory
-	userDir := filepath.Join(storageDir, userID)
-	if err := os.MkdirAll(userDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create user directory: %w", err)
-	}
-
-	// Generate filename with timestamp
-	filename := fmt.Sprintf("%s_%d.png", uuid.New().String(), time.Now().Unix())
-	filePath := filepath.Join(userDir, filename)
+	return saveImageToStorage(db, store, imageData, "png", userID)
+}
 
-	// Save image
-	if err := os.WriteFile(filePath, imageData, 0644); err != nil {
-		return "", fmt.Errorf("failed to save image: %w", err)
+// saveImageToStorage saves image data to storage/userid/ and returns its
+// key in the store. Files are named by the SHA-256 of their content, so
+// saving the same image again reuses the file, see storeBlob.
+func saveImageToStorage(db *gorm.DB, store BlobStore, imageData []byte, imageFormat string, userID string) (string, error) {
+	if imageFormat == "" {
+		imageFormat = "png"
 	}
-
-	fmt.Printf("Image saved to: %s (size: %d bytes)\n", filePath, len(imageData))
-
-	// Return relative path from storage directory
-	return filepath.Join(userID, filename), nil
+	return storeBlob(db, store, userID, imageData, imageFormat)
 }
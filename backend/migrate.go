@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// runStorageMigration copies the files of the local storage directory to the
+// store selected with STORAGE_BACKEND, e.g. when moving to S3:
+//
+//	go run . migrate-storage [-dry-run] [-delete]
+//
+// Files already in the destination with the same size are skipped, so the
+// migration can be run again after a failure. The keys stay the same, so
+// the URLs in the database do not change. Returns the exit code.
+func runStorageMigration(args []string) int {
+	flags := flag.NewFlagSet("migrate-storage", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report the files that would be copied")
+	deleteSource := flags.Bool("delete", false, "remove local files once they are copied")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	source, err := NewLocalBlobStore(localStorageDir())
+	if err != nil {
+		fmt.Printf("Failed to open local storage: %v\n", err)
+		return 1
+	}
+	destination, err := NewBlobStoreFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to initialize storage: %v\n", err)
+		return 1
+	}
+	if _, isFile := destination.(FileBlobStore); isFile {
+		fmt.Println("STORAGE_BACKEND is local, set it to the store to migrate to")
+		return 1
+	}
+
+	ctx := context.Background()
+	var copied, skipped, failed int
+	var bytes int64
+	err = source.List(ctx, "", func(info BlobInfo) error {
+		if existing, err := destination.Stat(ctx, info.Key); err == nil && existing.Size == info.Size {
+			skipped++
+			return nil
+		}
+		if *dryRun {
+			fmt.Printf("Would copy %s (%d bytes)\n", info.Key, info.Size)
+			copied++
+			bytes += info.Size
+			return nil
+		}
+		if err := copyBlob(ctx, source, destination, info.Key); err != nil {
+			fmt.Printf("Warning: Failed to copy %s: %v\n", info.Key, err)
+			failed++
+			return nil
+		}
+		copied++
+		bytes += info.Size
+		if *deleteSource {
+			if err := source.Delete(ctx, info.Key); err != nil {
+				fmt.Printf("Warning: Failed to remove %s: %v\n", info.Key, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Failed to list local storage: %v\n", err)
+		return 1
+	}
+
+	verb := "Copied"
+	if *dryRun {
+		verb = "Would copy"
+	}
+	fmt.Printf("%s %d files (%d bytes) to %s storage, %d already there, %d failed\n",
+		verb, copied, bytes, destination.Name(), skipped, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// copyBlob copies one blob between stores.
+func copyBlob(ctx context.Context, source BlobStore, destination BlobStore, key string) error {
+	reader, err := source.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return destination.Put(ctx, key, data, blobContentType(key))
+}
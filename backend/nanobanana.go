@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Nano Banana API structures
+type NanoBananaCreateTaskRequest struct {
+	Model       string          `json:"model"`
+	Input       NanoBananaInput `json:"input"`
+	CallBackUrl string          `json:"callBackUrl,omitempty"`
+}
+
+type NanoBananaInput struct {
+	Prompt       string   `json:"prompt"`
+	ImageUrls    []string `json:"image_urls"`
+	OutputFormat string   `json:"output_format,omitempty"`
+	ImageSize    string   `json:"image_size,omitempty"`
+}
+
+type NanoBananaCreateTaskResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		TaskID string `json:"taskId"`
+	} `json:"data"`
+}
+
+type NanoBananaTaskResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	Data struct {
+		TaskID       string `json:"taskId"`
+		Model        string `json:"model"`
+		State        string `json:"state"` // "waiting", "success", "fail"
+		Param        string `json:"param"`
+		ResultJSON   string `json:"resultJson"`
+		FailCode     string `json:"failCode,omitempty"`
+		FailMsg      string `json:"failMsg,omitempty"`
+		CostTime     int    `json:"costTime,omitempty"`
+		CompleteTime int64  `json:"completeTime,omitempty"`
+		CreateTime   int64  `json:"createTime"`
+	} `json:"data"`
+}
+
+type NanoBananaResult struct {
+	ResultUrls []string `json:"resultUrls"`
+}
+
+// nanoBananaCostPerImage is the kie.ai price of one google/nano-banana-edit image.
+const nanoBananaCostPerImage = 0.02
+
+// NanoBananaProvider generates covers with google/nano-banana-edit through
+// kie.ai. Tasks finish asynchronously.
+type NanoBananaProvider struct{}
+
+func init() {
+	RegisterProvider(&NanoBananaProvider{})
+}
+
+func (p *NanoBananaProvider) Name() string {
+	return "nanobanana"
+}
+
+func (p *NanoBananaProvider) DisplayName() string {
+	return "Nano Banana Edit"
+}
+
+func (p *NanoBananaProvider) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{
+		ImageToImage:  true,
+		Async:         true,
+		AspectRatios:  []string{"16:9", "1:1", "9:16", "4:3", "3:4"},
+		OutputFormats: []string{"png", "jpeg"},
+		MaxInputBytes: 10 * 1024 * 1024,
+		CostPerImage:  nanoBananaCostPerImage,
+		ResultHosts:   envList("NANO_BANANA_RESULT_HOSTS", []string{"aiquickdraw.com", "kie.ai"}),
+	}
+}
+
+func (p *NanoBananaProvider) Configured() bool {
+	return os.Getenv("NANO_BANANA_API_KEY") != ""
+}
+
+func (p *NanoBananaProvider) Generate(ctx context.Context, req ImageRequest) (*ImageResult, error) {
+	imageURLs := make([]string, 0, len(req.InputImages))
+	for _, img := range req.InputImages {
+		imageURLs = append(imageURLs, img.URL)
+	}
+
+	taskID, err := createNanoBananaTask(imageURLs, os.Getenv("NANO_BANANA_API_KEY"), req.Prompt, req.OutputFormat, req.AspectRatio, req.CallbackURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Nano Banana task: %w", err)
+	}
+
+	return &ImageResult{TaskID: taskID}, nil
+}
+
+func (p *NanoBananaProvider) FetchTask(ctx context.Context, taskID string) (*TaskStatus, error) {
+	taskResp, err := fetchNanoBananaTask(taskID, os.Getenv("NANO_BANANA_API_KEY"))
+	if err != nil {
+		return nil, err
+	}
+	return nanoBananaTaskStatus(taskResp), nil
+}
+
+// CallbackTaskID returns the task ID of a kie.ai callback body, which has
+// the same shape as the recordInfo response.
+func (p *NanoBananaProvider) CallbackTaskID(body []byte) (string, error) {
+	var taskResp NanoBananaTaskResponse
+	if err := json.Unmarshal(body, &taskResp); err != nil {
+		return "", fmt.Errorf("failed to parse callback: %w", err)
+	}
+	if taskResp.Data.TaskID == "" {
+		return "", fmt.Errorf("no task ID in callback")
+	}
+	return taskResp.Data.TaskID, nil
+}
+
+func nanoBananaTaskStatus(taskResp *NanoBananaTaskResponse) *TaskStatus {
+	status := &TaskStatus{
+		TaskID: taskResp.Data.TaskID,
+		State:  taskResp.Data.State,
+	}
+
+	// Task is still processing (waiting)
+	if taskResp.Code == 200 && status.State != "success" && status.State != "fail" {
+		return status
+	}
+
+	status.Done = true
+	resultURL, err := parseNanoBananaResult(taskResp)
+	if err != nil {
+		status.Err = fmt.Errorf("failed to get Nano Banana result: %w", err)
+		return status
+	}
+
+	if taskResp.Data.CostTime > 0 {
+		fmt.Printf("Task completed in %d ms\n", taskResp.Data.CostTime)
+	}
+	status.Result = &ImageResult{
+		TaskID: taskResp.Data.TaskID,
+		Images: []GeneratedImage{{URL: resultURL, Format: "png"}},
+		Cost:   nanoBananaCostPerImage,
+	}
+	return status
+}
+
+func createNanoBananaTask(imageURLs []string, apiKey string, customPrompt string, outputFormat string, imageSize string, callbackURL string) (string, error) {
+	// Use custom prompt if provided, otherwise use default
+	prompt := customPrompt
+	if prompt == "" {
+		prompt = "Transform this collage into a professional YouTube thumbnail cover. " +
+			"Make it visually striking, modern, and optimized for video thumbnails. " +
+			"Ensure high quality, attention-grabbing design with good contrast and readable text. " +
+			"Maintain the key elements from the collage but enhance them professionally. " +
+			"Use 16:9 aspect ratio suitable for YouTube thumbnails."
+	}
+
+	reqBody := NanoBananaCreateTaskRequest{
+		Model: "google/nano-banana-edit",
+		Input: NanoBananaInput{
+			Prompt:       prompt,
+			ImageUrls:    imageURLs,
+			OutputFormat: outputFormat,
+			ImageSize:    imageSize,
+		},
+		CallBackUrl: callbackURL,
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", "https://api.kie.ai/api/v1/jobs/createTask", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", &ProviderError{Class: ErrorClassUnavailable, Err: fmt.Errorf("failed to send request: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", &ProviderError{Class: ErrorClassUnavailable, Err: fmt.Errorf("failed to read response: %w", err)}
+	}
+
+	// Check HTTP status code
+	if resp.StatusCode == 401 {
+		return "", &ProviderError{Class: ErrorClassAuth, Err: fmt.Errorf("authentication failed: check your NANO_BANANA_API_KEY")}
+	}
+	if resp.StatusCode == 402 {
+		return "", &ProviderError{Class: ErrorClassInsufficientBalance, Err: fmt.Errorf("insufficient account balance")}
+	}
+	if resp.StatusCode == 429 {
+		return "", &ProviderError{Class: ErrorClassRateLimited, Err: fmt.Errorf("rate limit exceeded, please try again later")}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &ProviderError{
+			Class: classifyHTTPStatus(resp.StatusCode),
+			Err:   fmt.Errorf("nano banana API error: %s (status: %d)", string(body), resp.StatusCode),
+		}
+	}
+
+	var taskResp NanoBananaCreateTaskResponse
+	if err := json.Unmarshal(body, &taskResp); err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	if taskResp.Code != 200 {
+		errorMsg := taskResp.Msg
+		switch taskResp.Code {
+		case 400:
+			errorMsg = "invalid request parameters: " + errorMsg
+		case 401:
+			errorMsg = "authentication failed: " + errorMsg
+		case 402:
+			errorMsg = "insufficient account balance: " + errorMsg
+		case 422:
+			errorMsg = "parameter validation failed: " + errorMsg
+		case 429:
+			errorMsg = "rate limit exceeded: " + errorMsg
+		case 500:
+			errorMsg = "internal server error: " + errorMsg
+		}
+		return "", &ProviderError{
+			Class: classifyHTTPStatus(taskResp.Code),
+			Err:   fmt.Errorf("nano banana API error: %s (code: %d)", errorMsg, taskResp.Code),
+		}
+	}
+
+	if taskResp.Data.TaskID == "" {
+		return "", fmt.Errorf("no task ID in response")
+	}
+
+	return taskResp.Data.TaskID, nil
+}
+
+// fetchNanoBananaTask queries the current state of a task once.
+func fetchNanoBananaTask(taskID string, apiKey string) (*NanoBananaTaskResponse, error) {
+	url := fmt.Sprintf("https://api.kie.ai/api/v1/jobs/recordInfo?taskId=%s", taskID)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var taskResp NanoBananaTaskResponse
+	if err := json.Unmarshal(body, &taskResp); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return &taskResp, nil
+}
+
+// parseNanoBananaResult returns the result image URL of a finished task,
+// or the reason the task failed.
+func parseNanoBananaResult(taskResp *NanoBananaTaskResponse) (string, error) {
+	if taskResp.Code != 200 {
+		return "", &ProviderError{
+			Class: classifyHTTPStatus(taskResp.Code),
+			Err:   fmt.Errorf("nano banana API error: %s (code: %d)", taskResp.Msg, taskResp.Code),
+		}
+	}
+
+	switch taskResp.Data.State {
+	case "success":
+		// Parse result JSON
+		if taskResp.Data.ResultJSON == "" {
+			return "", fmt.Errorf("empty result JSON in response")
+		}
+
+		var result NanoBananaResult
+		if err := json.Unmarshal([]byte(taskResp.Data.ResultJSON), &result); err != nil {
+			return "", fmt.Errorf("failed to parse result JSON: %w", err)
+		}
+
+		if len(result.ResultUrls) == 0 {
+			return "", fmt.Errorf("no result URLs in response")
+		}
+
+		return result.ResultUrls[0], nil
+	case "fail":
+		failMsg := taskResp.Data.FailMsg
+		if failMsg == "" {
+			failMsg = "unknown error"
+		}
+		return "", &ProviderError{
+			Class: ErrorClassTaskFailed,
+			Err:   fmt.Errorf("task failed: %s (failCode: %s)", failMsg, taskResp.Data.FailCode),
+		}
+	default:
+		return "", fmt.Errorf("task is not finished yet (state: %s)", taskResp.Data.State)
+	}
+}
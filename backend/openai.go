@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+type OpenAIResponse struct {
+	Data []struct {
+		URL     string `json:"url,omitempty"`
+		B64JSON string `json:"b64_json,omitempty"`
+	} `json:"data"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// defaultOpenAIModel is used when OPENAI_IMAGE_MODEL is not set.
+const defaultOpenAIModel = "gpt-image-1"
+
+// openAICostPerImage is the price of one gpt-image-1 medium quality
+// 1536x1024 image.
+const openAICostPerImage = 0.063
+
+// OpenAIProvider generates covers with the OpenAI image edits API, using
+// the uploaded collage as the source image.
+type OpenAIProvider struct{}
+
+func init() {
+	RegisterProvider(&OpenAIProvider{})
+}
+
+func (p *OpenAIProvider) Name() string {
+	return "openai"
+}
+
+func (p *OpenAIProvider) DisplayName() string {
+	return "OpenAI Image Edit"
+}
+
+func (p *OpenAIProvider) Capabilities() ProviderCapabilities {
+	maxInputBytes := 50 * 1024 * 1024
+	if !isGPTImageModel(openAIModel()) {
+		// dall-e-2 only accepts square PNGs up to 4MB
+		maxInputBytes = 4 * 1024 * 1024
+	}
+
+	return ProviderCapabilities{
+		ImageToImage:  true,
+		Async:         false,
+		Mask:          true,
+		AspectRatios:  []string{"16:9", "1:1", "9:16"},
+		OutputFormats: []string{"png", "jpeg", "webp"},
+		MaxInputBytes: maxInputBytes,
+		CostPerImage:  openAICostPerImage,
+		ResultHosts:   envList("OPENAI_RESULT_HOSTS", []string{"oaidalleapiprodscus.blob.core.windows.net"}),
+	}
+}
+
+func (p *OpenAIProvider) Configured() bool {
+	return os.Getenv("OPENAI_API_KEY") != ""
+}
+
+func (p *OpenAIProvider) Generate(ctx context.Context, req ImageRequest) (*ImageResult, error) {
+	if len(req.InputImages) == 0 {
+		return nil, &ProviderError{Class: ErrorClassInvalidRequest, Err: fmt.Errorf("no input image")}
+	}
+
+	images, err := editImageWithOpenAI(ctx, req, os.Getenv("OPENAI_API_KEY"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageResult{
+		Images: images,
+		Cost:   openAICostPerImage,
+	}, nil
+}
+
+// openAIModel returns the image model from OPENAI_IMAGE_MODEL, e.g.
+// "gpt-image-1" or "dall-e-2".
+func openAIModel() string {
+	if model := os.Getenv("OPENAI_IMAGE_MODEL"); model != "" {
+		return model
+	}
+	return defaultOpenAIModel
+}
+
+func isGPTImageModel(model string) bool {
+	return strings.HasPrefix(model, "gpt-image")
+}
+
+// openAIImageSize picks the output size closest to the requested aspect
+// ratio. OPENAI_IMAGE_SIZE overrides it. gpt-image models have no 16:9
+// size, 1536x1024 is the closest landscape one.
+func openAIImageSize(model string, aspectRatio string) string {
+	if size := os.Getenv("OPENAI_IMAGE_SIZE"); size != "" {
+		return size
+	}
+	if !isGPTImageModel(model) {
+		return "1024x1024"
+	}
+
+	switch aspectRatio {
+	case "16:9", "3:2", "4:3":
+		return "1536x1024"
+	case "9:16", "2:3", "3:4":
+		return "1024x1536"
+	default:
+		return "1024x1024"
+	}
+}
+
+// editImageWithOpenAI calls /v1/images/edits with the collage (and the
+// optional mask) as a multipart upload and returns the generated images.
+func editImageWithOpenAI(ctx context.Context, imageReq ImageRequest, apiKey string) ([]GeneratedImage, error) {
+	prompt := imageReq.Prompt
+	if prompt == "" {
+		prompt = "Transform this collage into a professional YouTube thumbnail cover. " +
+			"Make it visually striking, modern, and optimized for video thumbnails. " +
+			"Ensure high quality, attention-grabbing design with good contrast and readable text. " +
+			"Maintain the key elements from the collage but enhance them professionally."
+	}
+
+	model := openAIModel()
+	gptImage := isGPTImageModel(model)
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	fields := map[string]string{
+		"model":  model,
+		"prompt": prompt,
+		"n":      "1",
+		"size":   openAIImageSize(model, imageReq.AspectRatio),
+	}
+	if gptImage {
+		if imageReq.OutputFormat != "" {
+			fields["output_format"] = imageReq.OutputFormat
+		}
+		if quality := os.Getenv("OPENAI_IMAGE_QUALITY"); quality != "" {
+			fields["quality"] = quality
+		}
+	} else {
+		fields["response_format"] = "url"
+	}
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			return nil, fmt.Errorf("failed to write form field: %w", err)
+		}
+	}
+
+	// gpt-image models accept several source images, dall-e-2 only one
+	imageField := "image"
+	if gptImage && len(imageReq.InputImages) > 1 {
+		imageField = "image[]"
+	}
+	for i, img := range imageReq.InputImages {
+		if !gptImage && i > 0 {
+			break
+		}
+		if err := writeOpenAIImagePart(writer, imageField, fmt.Sprintf("collage_%d", i), img); err != nil {
+			return nil, err
+		}
+	}
+
+	if imageReq.Mask != nil {
+		if err := writeOpenAIImagePart(writer, "mask", "mask", *imageReq.Mask); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.openai.com/v1/images/edits", &body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	// gpt-image edits regularly take more than a minute
+	client := &http.Client{Timeout: 3 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &ProviderError{Class: ErrorClassUnavailable, Err: fmt.Errorf("failed to send request: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &ProviderError{Class: ErrorClassUnavailable, Err: fmt.Errorf("failed to read response: %w", err)}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &ProviderError{
+			Class: classifyHTTPStatus(resp.StatusCode),
+			Err:   fmt.Errorf("OpenAI API error: %s (status: %d)", string(respBody), resp.StatusCode),
+		}
+	}
+
+	var openAIResp OpenAIResponse
+	if err := json.Unmarshal(respBody, &openAIResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	if openAIResp.Error != nil {
+		return nil, fmt.Errorf("OpenAI API error: %s", openAIResp.Error.Message)
+	}
+
+	// gpt-image models always return base64 data, dall-e-2 returns URLs
+	format := imageReq.OutputFormat
+	if format == "" || !gptImage {
+		format = "png"
+	}
+	images := make([]GeneratedImage, 0, len(openAIResp.Data))
+	for _, item := range openAIResp.Data {
+		switch {
+		case item.B64JSON != "":
+			data, err := base64.StdEncoding.DecodeString(item.B64JSON)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode image: %w", err)
+			}
+			images = append(images, GeneratedImage{Data: data, Format: format})
+		case item.URL != "":
+			images = append(images, GeneratedImage{URL: item.URL, Format: format})
+		}
+	}
+
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no image in response")
+	}
+
+	return images, nil
+}
+
+// writeOpenAIImagePart adds an image file part with its content type, the
+// edits endpoint rejects parts sent as application/octet-stream.
+func writeOpenAIImagePart(writer *multipart.Writer, field string, name string, img InputImage) error {
+	format := img.Format
+	switch format {
+	case "":
+		format = "png"
+	case "jpg":
+		format = "jpeg"
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s.%s"`, field, name, format))
+	header.Set("Content-Type", "image/"+format)
+
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return fmt.Errorf("failed to create %s part: %w", field, err)
+	}
+	if _, err := part.Write(img.Data); err != nil {
+		return fmt.Errorf("failed to write %s part: %w", field, err)
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Package kinds.
+const (
+	PackageKindPack         = "pack"         // one-off generations, added to PaidGenerations
+	PackageKindSubscription = "subscription" // monthly plan, see Subscription
+)
+
+// Package is a generation pack or subscription plan for sale. Packages are never deleted, a
+// retired package is only hidden from sale so that old transactions keep
+// their meaning.
+type Package struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	Type      string    `gorm:"uniqueIndex" json:"type"` // "pack1", "pack2", "pack3"
+	Name      string    `json:"name"`
+	Count     int       `json:"count"`   // количество генераций (в месяц для подписки)
+	Popular   bool      `json:"popular"` // флаг "Популярный"
+	Active    bool      `gorm:"index" json:"active"`
+	SortOrder int       `json:"sort_order"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Kind        string `gorm:"default:pack" json:"kind"` // "pack" or "subscription"
+	RolloverCap int    `json:"rollover_cap"`             // subscriptions: unused generations carried into the next month
+}
+
+// PackagePrice is one version of a package price in one currency. A price
+// change adds a new version and retires the previous row.
+type PackagePrice struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	PackageID string    `gorm:"index" json:"package_id"`
+	Currency  string    `gorm:"index" json:"currency"` // "USD" or "RUB"
+	Amount    float64   `json:"amount"`
+	Version   int       `json:"version"`
+	Current   bool      `gorm:"index" json:"current"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PackageView is a package with its current prices, as returned by
+// GET /api/packages.
+type PackageView struct {
+	Type        string             `json:"type"`
+	Kind        string             `json:"kind"`
+	Name        string             `json:"name"`
+	Count       int                `json:"count"`
+	RolloverCap int                `json:"rollover_cap,omitempty"`
+	PriceUSD    float64            `json:"price_usd"`
+	PriceRUB    float64            `json:"price_rub"`
+	Prices      map[string]float64 `json:"prices"`
+	Popular     bool               `json:"popular"`
+	Active      bool               `json:"active"`
+}
+
+// PackageInput is the admin request to create or update a package. Nil
+// fields are left unchanged on update.
+type PackageInput struct {
+	Type        string             `json:"type"`
+	Kind        string             `json:"kind"` // "pack" (default) or "subscription", only on create
+	Name        *string            `json:"name"`
+	Count       *int               `json:"count"`
+	RolloverCap *int               `json:"rollover_cap"`
+	Popular     *bool              `json:"popular"`
+	SortOrder   *int               `json:"sort_order"`
+	Active      *bool              `json:"active"` // true puts a retired package back on sale
+	Prices      map[string]float64 `json:"prices"` // currency -> amount
+}
+
+var ErrPackageNotFound = errors.New("package not found")
+
+// defaultPackages are created on first start.
+var defaultPackages = []struct {
+	Type        string
+	Kind        string
+	Name        string
+	Count       int
+	RolloverCap int
+	PriceUSD    float64
+	PriceRUB    float64
+	Popular     bool
+}{
+	{Type: "pack1", Kind: PackageKindPack, Name: "Стартовый", Count: 10, PriceUSD: 2.99, PriceRUB: 249, Popular: false},
+	{Type: "pack2", Kind: PackageKindPack, Name: "Базовый", Count: 30, PriceUSD: 7.99, PriceRUB: 599, Popular: true},
+	{Type: "pack3", Kind: PackageKindPack, Name: "Профессиональный", Count: 100, PriceUSD: 19.99, PriceRUB: 1499, Popular: false},
+	{Type: "pro_monthly", Kind: PackageKindSubscription, Name: "Pro", Count: 150, RolloverCap: 150, PriceUSD: 12.99, PriceRUB: 990, Popular: false},
+}
+
+// seedPackages creates the default packages that do not exist yet.
+// Packages are never deleted, so a retired default is not created again.
+func seedPackages(db *gorm.DB) error {
+	for i, pkg := range defaultPackages {
+		var count int64
+		if err := db.Model(&Package{}).Where("type = ?", pkg.Type).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		name, packCount, rolloverCap, popular, sortOrder := pkg.Name, pkg.Count, pkg.RolloverCap, pkg.Popular, i+1
+		_, err := CreatePackage(db, PackageInput{
+			Type:        pkg.Type,
+			Kind:        pkg.Kind,
+			Name:        &name,
+			Count:       &packCount,
+			RolloverCap: &rolloverCap,
+			Popular:     &popular,
+			SortOrder:   &sortOrder,
+			Prices:      map[string]float64{"USD": pkg.PriceUSD, "RUB": pkg.PriceRUB},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListPackages returns the packages with their current prices, only the
+// active ones unless includeRetired is set.
+func ListPackages(db *gorm.DB, includeRetired bool) ([]PackageView, error) {
+	query := db.Order("sort_order, type")
+	if !includeRetired {
+		query = query.Where("active = ?", true)
+	}
+	var packages []Package
+	if err := query.Find(&packages).Error; err != nil {
+		return nil, err
+	}
+
+	views := make([]PackageView, 0, len(packages))
+	for _, pkg := range packages {
+		var prices []PackagePrice
+		if err := db.Where("package_id = ? AND current = ?", pkg.ID, true).Find(&prices).Error; err != nil {
+			return nil, err
+		}
+
+		view := PackageView{
+			Type:        pkg.Type,
+			Kind:        pkg.Kind,
+			Name:        pkg.Name,
+			Count:       pkg.Count,
+			RolloverCap: pkg.RolloverCap,
+			Prices:      map[string]float64{},
+			Popular:     pkg.Popular,
+			Active:      pkg.Active,
+		}
+		for _, price := range prices {
+			view.Prices[price.Currency] = price.Amount
+		}
+		view.PriceUSD = view.Prices["USD"]
+		view.PriceRUB = view.Prices["RUB"]
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// GetActivePackage returns the package of the given type if it is on sale.
+func GetActivePackage(db *gorm.DB, packageType string) (*Package, error) {
+	var pkg Package
+	err := db.Where("type = ? AND active = ?", packageType, true).First(&pkg).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrPackageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pkg, nil
+}
+
+// CurrentPackagePrice returns the current price of a package in currency.
+func CurrentPackagePrice(db *gorm.DB, packageID string, currency string) (*PackagePrice, error) {
+	var price PackagePrice
+	err := db.Where("package_id = ? AND currency = ? AND current = ?", packageID, strings.ToUpper(currency), true).First(&price).Error
+	if err != nil {
+		return nil, err
+	}
+	return &price, nil
+}
+
+// CreatePackage adds a new active package with its prices.
+func CreatePackage(db *gorm.DB, input PackageInput) (*Package, error) {
+	if input.Type == "" || input.Name == nil || input.Count == nil || *input.Count <= 0 || len(input.Prices) == 0 {
+		return nil, fmt.Errorf("type, name, a positive count and prices are required")
+	}
+	if input.Kind == "" {
+		input.Kind = PackageKindPack
+	}
+	if input.Kind != PackageKindPack && input.Kind != PackageKindSubscription {
+		return nil, fmt.Errorf("kind must be %q or %q", PackageKindPack, PackageKindSubscription)
+	}
+
+	pkg := &Package{
+		ID:     uuid.New().String(),
+		Type:   input.Type,
+		Kind:   input.Kind,
+		Name:   *input.Name,
+		Count:  *input.Count,
+		Active: true,
+	}
+	if input.RolloverCap != nil {
+		if *input.RolloverCap < 0 {
+			return nil, fmt.Errorf("rollover_cap can not be negative")
+		}
+		pkg.RolloverCap = *input.RolloverCap
+	}
+	if input.Popular != nil {
+		pkg.Popular = *input.Popular
+	}
+	if input.SortOrder != nil {
+		pkg.SortOrder = *input.SortOrder
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(pkg).Error; err != nil {
+			return err
+		}
+		return setPackagePrices(tx, pkg.ID, input.Prices)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pkg, nil
+}
+
+// UpdatePackage changes a package. Changed prices get a new version, the
+// previous price rows are kept for history.
+func UpdatePackage(db *gorm.DB, packageType string, input PackageInput) (*Package, error) {
+	var pkg Package
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("type = ?", packageType).First(&pkg).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return ErrPackageNotFound
+			}
+			return err
+		}
+
+		updates := map[string]interface{}{}
+		if input.Name != nil {
+			updates["name"] = *input.Name
+		}
+		if input.Count != nil {
+			if *input.Count <= 0 {
+				return fmt.Errorf("count must be positive")
+			}
+			updates["count"] = *input.Count
+		}
+		if input.RolloverCap != nil {
+			if *input.RolloverCap < 0 {
+				return fmt.Errorf("rollover_cap can not be negative")
+			}
+			updates["rollover_cap"] = *input.RolloverCap
+		}
+		if input.Popular != nil {
+			updates["popular"] = *input.Popular
+		}
+		if input.SortOrder != nil {
+			updates["sort_order"] = *input.SortOrder
+		}
+		if input.Active != nil {
+			updates["active"] = *input.Active
+		}
+		if len(updates) > 0 {
+			if err := tx.Model(&pkg).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		return setPackagePrices(tx, pkg.ID, input.Prices)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pkg, nil
+}
+
+// RetirePackage takes a package off sale.
+func RetirePackage(db *gorm.DB, packageType string) error {
+	result := db.Model(&Package{}).Where("type = ?", packageType).Update("active", false)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrPackageNotFound
+	}
+	return nil
+}
+
+// setPackagePrices adds a new price version for every currency whose
+// amount changed.
+func setPackagePrices(tx *gorm.DB, packageID string, prices map[string]float64) error {
+	for currency, amount := range prices {
+		currency = strings.ToUpper(currency)
+		if amount <= 0 {
+			return fmt.Errorf("price for %s must be positive", currency)
+		}
+
+		var current PackagePrice
+		err := tx.Where("package_id = ? AND currency = ? AND current = ?", packageID, currency, true).First(&current).Error
+		if err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+		if err == nil && current.Amount == amount {
+			continue
+		}
+
+		if err == nil {
+			if err := tx.Model(&current).Update("current", false).Error; err != nil {
+				return err
+			}
+		}
+		price := PackagePrice{
+			ID:        uuid.New().String(),
+			PackageID: packageID,
+			Currency:  currency,
+			Amount:    amount,
+			Version:   current.Version + 1,
+			Current:   true,
+		}
+		if err := tx.Create(&price).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
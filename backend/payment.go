@@ -1,98 +1,364 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
+	"math"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+
+	"gorm.io/gorm"
+)
+
+// Payment statuses reported by providers.
+const (
+	PaymentStatusPending   = "pending"
+	PaymentStatusSucceeded = "succeeded"
+	PaymentStatusFailed    = "failed"
+	PaymentStatusCancelled = "cancelled" // subscription renewals were cancelled
+)
+
+// ErrInvalidWebhookSignature is returned for webhooks that were not signed
+// with our secret.
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// Flags of transactions that were paid but not credited, an admin sorts
+// them out with the buyer.
+const (
+	TransactionFlagAmountMismatch = "amount_mismatch" // the provider reported another amount than we charged
+	TransactionFlagPromoNotHeld   = "promo_not_held"  // the discount was held by another payment of the user
 )
 
-type LavaTopCreateOrderRequest struct {
-	Sum      float64 `json:"sum"`
-	OrderID  string  `json:"orderId"`
-	ShopID   string  `json:"shopId"`
-	Currency string  `json:"currency"` // "RUB" or "USD"
+// ErrTransactionNotFound is returned for payment events that do not match
+// any of our transactions or subscriptions.
+var ErrTransactionNotFound = errors.New("transaction not found")
+
+// PaymentInvoice is the provider independent payment request.
+type PaymentInvoice struct {
+	TransactionID string
+	Amount        float64
+	Currency      string // "USD", "RUB", ...
+	Description   string // package name shown on the payment page
+	Recurring     bool   // monthly subscription
 }
 
-type LavaTopCreateOrderResponse struct {
-	Status string `json:"status"`
-	Data   struct {
-		URL     string `json:"url"`
-		InvoiceID string `json:"invoiceId"`
-		OrderID   string `json:"orderId"`
-	} `json:"data"`
-	Message string `json:"message"`
+// PaymentOrder is a created invoice. The user pays on PaymentURL.
+type PaymentOrder struct {
+	OrderID    string
+	PaymentURL string
 }
 
-func createLavaTopOrder(transactionID string, amount float64, currency string, pkg *Package) (string, string, error) {
-	shopID := os.Getenv("LAVA_SHOP_ID")
-	secretKey := os.Getenv("LAVA_SECRET_KEY")
-	apiURL := os.Getenv("LAVA_API_URL")
+// PaymentEvent is a payment state reported by a webhook or fetched from the
+// provider.
+type PaymentEvent struct {
+	OrderID        string  // provider order of the payment
+	SubscriptionID string  // provider subscription the payment belongs to, if any
+	Status         string  // "pending", "succeeded", "failed", "cancelled"
+	Amount         float64 // amount paid, 0 if unknown
+}
 
-	if apiURL == "" {
-		apiURL = "https://api.lava.top"
-	}
+// PaymentProvider takes payments. Providers register themselves with
+// RegisterPaymentProvider from an init function, like image providers.
+type PaymentProvider interface {
+	Name() string
+	DisplayName() string
+	// Currencies lists the currencies the provider accepts.
+	Currencies() []string
+	// Configured reports whether the provider credentials are set.
+	Configured() bool
+	CreateInvoice(ctx context.Context, invoice PaymentInvoice) (*PaymentOrder, error)
+	// ParseWebhook verifies the webhook signature and parses the event. A
+	// nil event without error is a notification that needs no action.
+	ParseWebhook(header http.Header, body []byte) (*PaymentEvent, error)
+	FetchStatus(ctx context.Context, orderID string) (*PaymentEvent, error)
+}
+
+var (
+	paymentProvidersMu sync.RWMutex
+	paymentProviders   = map[string]PaymentProvider{}
+)
 
-	if shopID == "" || secretKey == "" {
-		return "", "", fmt.Errorf("LAVA_SHOP_ID and LAVA_SECRET_KEY must be set")
+// RegisterPaymentProvider makes a payment provider available by its name.
+func RegisterPaymentProvider(p PaymentProvider) {
+	paymentProvidersMu.Lock()
+	defer paymentProvidersMu.Unlock()
+	paymentProviders[p.Name()] = p
+}
+
+// GetPaymentProvider returns the payment provider registered under name.
+func GetPaymentProvider(name string) (PaymentProvider, bool) {
+	paymentProvidersMu.RLock()
+	defer paymentProvidersMu.RUnlock()
+	p, ok := paymentProviders[name]
+	return p, ok
+}
+
+// PaymentProviders returns all registered payment providers sorted by name.
+func PaymentProviders() []PaymentProvider {
+	paymentProvidersMu.RLock()
+	defer paymentProvidersMu.RUnlock()
+
+	list := make([]PaymentProvider, 0, len(paymentProviders))
+	for _, p := range paymentProviders {
+		list = append(list, p)
 	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list
+}
 
-	// Convert currency code for Lava Top (RUB or USD)
-	lavaCurrency := currency
-	if currency == "USD" {
-		lavaCurrency = "USD"
-	} else if currency == "RUB" {
-		lavaCurrency = "RUB"
+// Default payment routing, overridable with PAYMENT_PROVIDER_BY_CURRENCY
+// and PAYMENT_PROVIDER_BY_REGION.
+const defaultCurrencyRouting = "RUB=lava,USD=stripe"
+
+// SelectPaymentProvider chooses the gateway for a payment: the provider of
+// the buyer's country (ISO code, e.g. "RU") if one is routed, then the one
+// routed for the currency, then any configured provider that accepts the
+// currency.
+func SelectPaymentProvider(currency string, country string) (PaymentProvider, error) {
+	currency = strings.ToUpper(currency)
+
+	var candidates []string
+	if country != "" {
+		if name, ok := parseRouting(os.Getenv("PAYMENT_PROVIDER_BY_REGION"))[strings.ToUpper(country)]; ok {
+			candidates = append(candidates, name)
+		}
+	}
+	currencyRouting, ok := os.LookupEnv("PAYMENT_PROVIDER_BY_CURRENCY")
+	if !ok {
+		currencyRouting = defaultCurrencyRouting
+	}
+	if name, ok := parseRouting(currencyRouting)[currency]; ok {
+		candidates = append(candidates, name)
+	}
+	for _, p := range PaymentProviders() {
+		candidates = append(candidates, p.Name())
 	}
 
-	reqBody := LavaTopCreateOrderRequest{
-		Sum:      amount,
-		OrderID:  transactionID,
-		ShopID:   shopID,
-		Currency: lavaCurrency,
+	for _, name := range candidates {
+		p, ok := GetPaymentProvider(name)
+		if ok && p.Configured() && acceptsCurrency(p, currency) {
+			return p, nil
+		}
 	}
+	return nil, fmt.Errorf("no payment provider configured for %s", currency)
+}
 
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to marshal request: %w", err)
+// parseRouting parses "KEY=provider,KEY=provider" with upper case keys.
+func parseRouting(value string) map[string]string {
+	routing := map[string]string{}
+	for _, entry := range splitList(value) {
+		key, name, ok := strings.Cut(entry, "=")
+		if ok {
+			routing[strings.ToUpper(strings.TrimSpace(key))] = strings.TrimSpace(name)
+		}
 	}
+	return routing
+}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/invoice/create", apiURL), bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create request: %w", err)
+func acceptsCurrency(p PaymentProvider, currency string) bool {
+	for _, c := range p.Currencies() {
+		if c == currency {
+			return true
+		}
 	}
+	return false
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", secretKey)
+// ApplyPaymentEvent updates the transaction, or the subscription, that an
+// event of the provider refers to. Events can be applied any number of
+// times, a payment is only granted once. A payment of another amount than
+// the transaction is failed and flagged for review, not credited.
+func ApplyPaymentEvent(db *gorm.DB, provider string, event *PaymentEvent) error {
+	var transactions []Transaction
+	if event.OrderID != "" {
+		err := db.Where("provider = ? AND lava_order_id = ?", provider, event.OrderID).Limit(1).Find(&transactions).Error
+		if err != nil {
+			return err
+		}
+	}
+	if len(transactions) == 0 {
+		// Renewals and cancellations of a subscription come with a new order
+		return applySubscriptionEvent(db, event)
+	}
+	transaction := &transactions[0]
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to send request: %w", err)
+	switch event.Status {
+	case PaymentStatusSucceeded:
+		if !paymentAmountMatches(event.Amount, transaction.Amount) {
+			return flagAmountMismatch(db, transaction, event.Amount)
+		}
+		if event.SubscriptionID != "" && transaction.ProviderSubscriptionID == "" {
+			transaction.ProviderSubscriptionID = event.SubscriptionID
+			err := db.Model(transaction).Update("provider_subscription_id", event.SubscriptionID).Error
+			if err != nil {
+				return err
+			}
+		}
+		granted, err := CompleteTransaction(db, transaction)
+		if err != nil {
+			return err
+		}
+		if !granted {
+			fmt.Printf("Duplicate payment event for transaction %s ignored\n", transaction.ID)
+		}
+	case PaymentStatusCancelled:
+		if transaction.SubscriptionID != "" {
+			return CancelSubscription(db, transaction.SubscriptionID)
+		}
+		return FailTransaction(db, transaction)
+	case PaymentStatusFailed:
+		return FailTransaction(db, transaction)
 	}
-	defer resp.Body.Close()
+	return nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to read response: %w", err)
+// paymentAmountMatches compares the amount a provider reported with the
+// amount of the transaction in cents, discounts can leave fractions. An
+// unknown amount, 0, is not compared.
+func paymentAmountMatches(paid float64, expected float64) bool {
+	return paid == 0 || math.Round(paid*100) == math.Round(expected*100)
+}
+
+// flagAmountMismatch fails a transaction that was paid with another amount
+// and flags it, so that an admin can sort the payment out with the buyer.
+// Completed transactions are left alone.
+func flagAmountMismatch(db *gorm.DB, transaction *Transaction, paid float64) error {
+	fmt.Printf("Warning: Transaction %s was paid %.2f %s, expected %.2f, not crediting it\n",
+		transaction.ID, paid, transaction.Currency, transaction.Amount)
+	return flagTransaction(db, transaction, TransactionFlagAmountMismatch, paid)
+}
+
+// flagTransaction flags a transaction that is not completed and fails it
+// if it is still pending. paid is the amount reported, 0 if unknown.
+func flagTransaction(db *gorm.DB, transaction *Transaction, reason string, paid float64) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Transaction{}).
+			Where("id = ? AND status <> ?", transaction.ID, "completed").
+			Updates(map[string]interface{}{"flag_reason": reason, "paid_amount": paid})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		transaction.FlagReason = reason
+		transaction.PaidAmount = paid
+		return closeTransaction(tx, transaction, "failed")
+	})
+}
+
+// applySubscriptionEvent applies an event that refers to a subscription
+// by the provider subscription ID.
+func applySubscriptionEvent(db *gorm.DB, event *PaymentEvent) error {
+	var subscriptions []Subscription
+	if event.SubscriptionID != "" {
+		err := db.Where("provider_subscription_id = ?", event.SubscriptionID).Limit(1).Find(&subscriptions).Error
+		if err != nil {
+			return err
+		}
 	}
+	if len(subscriptions) == 0 {
+		return ErrTransactionNotFound
+	}
+	subscription := subscriptions[0]
 
-	if resp.StatusCode != http.StatusOK {
-		return "", "", fmt.Errorf("lava top API error: %s (status: %d)", string(body), resp.StatusCode)
+	switch event.Status {
+	case PaymentStatusSucceeded:
+		renewed, err := RenewSubscription(db, subscription.ID, event.OrderID, event.Amount)
+		if err != nil {
+			return err
+		}
+		if !renewed {
+			fmt.Printf("Duplicate renewal event for subscription %s ignored\n", subscription.ID)
+		}
+	case PaymentStatusCancelled:
+		return CancelSubscription(db, subscription.ID)
+	case PaymentStatusFailed:
+		return MarkSubscriptionPastDue(db, subscription.ID)
 	}
+	return nil
+}
 
-	var lavaResp LavaTopCreateOrderResponse
-	if err := json.Unmarshal(body, &lavaResp); err != nil {
-		return "", "", fmt.Errorf("failed to parse response: %w", err)
+// CompleteTransaction marks a transaction as completed and grants the
+// generations of the package snapshot, or starts the subscription, in one
+// DB transaction. A transaction that is already completed is left alone,
+// so replayed webhooks never grant credits twice, and so is a flagged one.
+// A failed or expired transaction paid late is completed if its promo
+// discount can be claimed again. Returns whether the credits were granted
+// by this call.
+func CompleteTransaction(db *gorm.DB, transaction *Transaction) (bool, error) {
+	count := transaction.PackageCount
+	if count == 0 {
+		// Transactions created before packages were snapshotted
+		var pkg Package
+		if err := db.Where("type = ?", transaction.PackageType).First(&pkg).Error; err != nil {
+			return false, fmt.Errorf("unknown package type: %s", transaction.PackageType)
+		}
+		count = pkg.Count
 	}
 
-	if lavaResp.Status != "success" {
-		return "", "", fmt.Errorf("lava top error: %s", lavaResp.Message)
+	granted := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Transaction{}).
+			Where("id = ? AND status <> ? AND flag_reason = ''", transaction.ID, "completed").
+			Update("status", "completed")
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		if transaction.PackageKind == PackageKindSubscription {
+			if err := startSubscription(tx, transaction, time.Now()); err != nil {
+				return err
+			}
+		} else if err := AddPaidGenerations(tx, transaction.UserID, count, transaction.ID); err != nil {
+			return err
+		}
+		if err := completePromoRedemption(tx, transaction); err != nil {
+			return err
+		}
+		if err := rewardReferral(tx, transaction); err != nil {
+			return err
+		}
+		granted = true
+		return nil
+	})
+	if errors.Is(err, ErrPromoNotHeld) {
+		fmt.Printf("Warning: Transaction %s was paid with promo code %s held by another payment, not crediting it\n",
+			transaction.ID, transaction.PromoCode)
+		return false, flagTransaction(db, transaction, TransactionFlagPromoNotHeld, 0)
+	}
+	if err != nil {
+		return false, err
 	}
 
-	return lavaResp.Data.InvoiceID, lavaResp.Data.URL, nil
+	transaction.Status = "completed"
+	return granted, nil
+}
+
+// FailTransaction marks a pending transaction as failed and releases its
+// promo code. Completed transactions are never downgraded.
+func FailTransaction(db *gorm.DB, transaction *Transaction) error {
+	return closeTransaction(db, transaction, "failed")
 }
 
+// ExpireTransaction closes a pending transaction that was never paid. A
+// payment that still arrives later completes it as usual.
+func ExpireTransaction(db *gorm.DB, transaction *Transaction) error {
+	return closeTransaction(db, transaction, "expired")
+}
+
+// closeTransaction moves a pending transaction to status and releases its
+// promo code.
+func closeTransaction(db *gorm.DB, transaction *Transaction, status string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Transaction{}).
+			Where("id = ? AND status = ?", transaction.ID, "pending").
+			Update("status", status)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		transaction.Status = status
+		return releasePromoRedemption(tx, transaction.ID)
+	})
+}
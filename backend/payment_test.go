@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// newTestTransaction creates a pending pack transaction of the provider
+// with the given order ID.
+func newTestTransaction(t *testing.T, db *gorm.DB, userID string, provider string, orderID string, amount float64) *Transaction {
+	t.Helper()
+	transaction := &Transaction{
+		ID:           uuid.New().String(),
+		UserID:       userID,
+		PackageType:  "pack1",
+		PackageName:  "Test pack",
+		PackageKind:  PackageKindPack,
+		PackageCount: 10,
+		Amount:       amount,
+		Currency:     "USD",
+		Status:       "pending",
+		LavaOrderID:  orderID,
+		Provider:     provider,
+	}
+	if err := db.Create(transaction).Error; err != nil {
+		t.Fatalf("create transaction: %v", err)
+	}
+	return transaction
+}
+
+// assertPaidBalance fails unless the user has paid generations and the
+// balance matches the ledger.
+func assertPaidBalance(t *testing.T, db *gorm.DB, userID string, paid int) {
+	t.Helper()
+	reconciliation := assertConsistent(t, db, userID)
+	if reconciliation.PaidBalance != paid {
+		t.Fatalf("paid balance = %d, want %d", reconciliation.PaidBalance, paid)
+	}
+}
+
+// assertTransactionStatus fails unless the stored transaction has status.
+func assertTransactionStatus(t *testing.T, db *gorm.DB, transactionID string, status string) {
+	t.Helper()
+	var transaction Transaction
+	if err := db.Where("id = ?", transactionID).First(&transaction).Error; err != nil {
+		t.Fatalf("load transaction: %v", err)
+	}
+	if transaction.Status != status {
+		t.Fatalf("transaction status = %s, want %s", transaction.Status, status)
+	}
+}
+
+func TestApplyPaymentEventReplayed(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, db, 0, 0)
+	transaction := newTestTransaction(t, db, user.ID, "lava", "order-1", 5)
+
+	event := &PaymentEvent{OrderID: "order-1", Status: PaymentStatusSucceeded, Amount: 5}
+	for i := 0; i < 3; i++ {
+		if err := ApplyPaymentEvent(db, "lava", event); err != nil {
+			t.Fatalf("ApplyPaymentEvent: %v", err)
+		}
+	}
+	assertTransactionStatus(t, db, transaction.ID, "completed")
+	assertPaidBalance(t, db, user.ID, 10)
+
+	// A failure reported after the payment does not take it back
+	if err := ApplyPaymentEvent(db, "lava", &PaymentEvent{OrderID: "order-1", Status: PaymentStatusFailed}); err != nil {
+		t.Fatalf("ApplyPaymentEvent: %v", err)
+	}
+	assertTransactionStatus(t, db, transaction.ID, "completed")
+	assertPaidBalance(t, db, user.ID, 10)
+}
+
+func TestApplyPaymentEventUnknownOrder(t *testing.T) {
+	db := newTestDB(t)
+	err := ApplyPaymentEvent(db, "lava", &PaymentEvent{OrderID: "missing", Status: PaymentStatusSucceeded})
+	if err != ErrTransactionNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrTransactionNotFound)
+	}
+}
+
+func TestApplyPaymentEventAmountMismatch(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, db, 0, 0)
+	transaction := newTestTransaction(t, db, user.ID, "lava", "order-1", 4.99)
+
+	err := ApplyPaymentEvent(db, "lava", &PaymentEvent{OrderID: "order-1", Status: PaymentStatusSucceeded, Amount: 0.99})
+	if err != nil {
+		t.Fatalf("ApplyPaymentEvent: %v", err)
+	}
+	assertTransactionStatus(t, db, transaction.ID, "failed")
+	assertPaidBalance(t, db, user.ID, 0)
+
+	var flagged Transaction
+	db.Where("id = ?", transaction.ID).First(&flagged)
+	if flagged.FlagReason != TransactionFlagAmountMismatch || flagged.PaidAmount != 0.99 {
+		t.Fatalf("transaction not flagged: reason %q, paid %.2f", flagged.FlagReason, flagged.PaidAmount)
+	}
+
+	// A later event without an amount does not credit the flagged payment
+	err = ApplyPaymentEvent(db, "lava", &PaymentEvent{OrderID: "order-1", Status: PaymentStatusSucceeded})
+	if err != nil {
+		t.Fatalf("ApplyPaymentEvent: %v", err)
+	}
+	assertTransactionStatus(t, db, transaction.ID, "failed")
+	assertPaidBalance(t, db, user.ID, 0)
+
+	// Amounts that only differ below a cent match
+	other := newTestTransaction(t, db, user.ID, "lava", "order-2", 4.99)
+	err = ApplyPaymentEvent(db, "lava", &PaymentEvent{OrderID: "order-2", Status: PaymentStatusSucceeded, Amount: 4.990001})
+	if err != nil {
+		t.Fatalf("ApplyPaymentEvent: %v", err)
+	}
+	assertTransactionStatus(t, db, other.ID, "completed")
+	assertPaidBalance(t, db, user.ID, 10)
+}
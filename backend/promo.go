@@ -0,0 +1,397 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Promo code kinds.
+const (
+	PromoKindCredits  = "credits"  // grants paid generations on redemption
+	PromoKindDiscount = "discount" // percentage off a payment
+)
+
+const (
+	PromoRedemptionCompleted = "completed"
+	PromoRedemptionPending   = "pending"  // discount held by a payment that is not completed yet
+	PromoRedemptionReleased  = "released" // the payment failed, the code can be used again
+)
+
+var (
+	ErrPromoNotFound        = errors.New("promo code not found")
+	ErrPromoExpired         = errors.New("promo code expired")
+	ErrPromoExhausted       = errors.New("promo code has no redemptions left")
+	ErrPromoAlreadyRedeemed = errors.New("promo code already redeemed")
+	ErrPromoNotApplicable   = errors.New("promo code does not apply to this purchase")
+)
+
+// ErrPromoNotHeld is returned when a discounted transaction is paid but its
+// discount is held by another payment of the user.
+var ErrPromoNotHeld = errors.New("promo discount is held by another payment")
+
+// PromoCode is a code handed out by marketing, e.g. "BLOGGER50" for 50
+// generations or 20% off pack2. Codes are stored upper case.
+type PromoCode struct {
+	ID              string     `gorm:"primaryKey" json:"id"`
+	Code            string     `gorm:"uniqueIndex" json:"code"`
+	Kind            string     `json:"kind"`                   // "credits" or "discount"
+	Credits         int        `json:"credits,omitempty"`      // generations granted by a credits code
+	DiscountPercent int        `json:"discount_percent"`       // 1-99 for a discount code
+	PackageType     string     `json:"package_type,omitempty"` // discount only for this package, "" for all
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	MaxRedemptions  int        `json:"max_redemptions"` // 0 is unlimited
+	Redemptions     int        `json:"redemptions"`
+	Active          bool       `gorm:"index" json:"active"`
+	Note            string     `json:"note,omitempty"` // who the code was given to
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// PromoRedemption records a use of a promo code by a user, with the client
+// address for abuse review. A user has at most one redemption per code.
+type PromoRedemption struct {
+	ID            string    `gorm:"primaryKey" json:"id"`
+	PromoCodeID   string    `gorm:"uniqueIndex:idx_promo_redemption_user" json:"promo_code_id"`
+	UserID        string    `gorm:"uniqueIndex:idx_promo_redemption_user;index" json:"user_id"`
+	Code          string    `json:"code"`
+	Status        string    `gorm:"index" json:"status"` // "completed", "pending", "released"
+	Credits       int       `json:"credits,omitempty"`
+	TransactionID string    `gorm:"index" json:"transaction_id,omitempty"`
+	Discount      float64   `json:"discount,omitempty"` // amount taken off the payment
+	IP            string    `json:"ip"`
+	UserAgent     string    `json:"user_agent"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// PromoCodeInput is the admin request to create a promo code.
+type PromoCodeInput struct {
+	Code            string     `json:"code" binding:"required"`
+	Kind            string     `json:"kind" binding:"required"`
+	Credits         int        `json:"credits"`
+	DiscountPercent int        `json:"discount_percent"`
+	PackageType     string     `json:"package_type"`
+	ExpiresAt       *time.Time `json:"expires_at"`
+	MaxRedemptions  int        `json:"max_redemptions"`
+	Note            string     `json:"note"`
+}
+
+// isPromoCodeError reports whether err is a promo code the user can not
+// use, as opposed to a database failure.
+func isPromoCodeError(err error) bool {
+	for _, promoErr := range []error{ErrPromoNotFound, ErrPromoExpired, ErrPromoExhausted, ErrPromoAlreadyRedeemed, ErrPromoNotApplicable} {
+		if errors.Is(err, promoErr) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// CreatePromoCode adds an active promo code.
+func CreatePromoCode(db *gorm.DB, input PromoCodeInput) (*PromoCode, error) {
+	promo := &PromoCode{
+		ID:             uuid.New().String(),
+		Code:           normalizePromoCode(input.Code),
+		Kind:           input.Kind,
+		PackageType:    input.PackageType,
+		ExpiresAt:      input.ExpiresAt,
+		MaxRedemptions: input.MaxRedemptions,
+		Active:         true,
+		Note:           input.Note,
+	}
+	if promo.Code == "" {
+		return nil, fmt.Errorf("code is required")
+	}
+	if promo.MaxRedemptions < 0 {
+		return nil, fmt.Errorf("max_redemptions can not be negative")
+	}
+
+	switch input.Kind {
+	case PromoKindCredits:
+		if input.Credits <= 0 {
+			return nil, fmt.Errorf("credits must be positive")
+		}
+		promo.Credits = input.Credits
+	case PromoKindDiscount:
+		// A free payment can not go through the provider, use a credits code
+		if input.DiscountPercent <= 0 || input.DiscountPercent >= 100 {
+			return nil, fmt.Errorf("discount_percent must be between 1 and 99")
+		}
+		promo.DiscountPercent = input.DiscountPercent
+	default:
+		return nil, fmt.Errorf("kind must be %q or %q", PromoKindCredits, PromoKindDiscount)
+	}
+
+	if err := db.Create(promo).Error; err != nil {
+		return nil, err
+	}
+	return promo, nil
+}
+
+// DeactivatePromoCode stops a code from being redeemed.
+func DeactivatePromoCode(db *gorm.DB, code string) error {
+	result := db.Model(&PromoCode{}).Where("code = ?", normalizePromoCode(code)).Update("active", false)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrPromoNotFound
+	}
+	return nil
+}
+
+// ValidatePromoCode returns the code if the user can redeem it now. A
+// redemption held by an unfinished payment does not count, the user may
+// retry the payment with the same code.
+func ValidatePromoCode(db *gorm.DB, code string, userID string) (*PromoCode, error) {
+	var promo PromoCode
+	if err := db.Where("code = ? AND active = ?", normalizePromoCode(code), true).First(&promo).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrPromoNotFound
+		}
+		return nil, err
+	}
+
+	if promo.ExpiresAt != nil && time.Now().After(*promo.ExpiresAt) {
+		return nil, ErrPromoExpired
+	}
+
+	redemption, err := findPromoRedemption(db, promo.ID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if redemption != nil && redemption.Status == PromoRedemptionCompleted {
+		return nil, ErrPromoAlreadyRedeemed
+	}
+	held := redemption != nil && redemption.Status == PromoRedemptionPending
+
+	if !held && promo.MaxRedemptions > 0 && promo.Redemptions >= promo.MaxRedemptions {
+		return nil, ErrPromoExhausted
+	}
+	return &promo, nil
+}
+
+// findPromoRedemption returns the user's redemption of the code, or nil.
+func findPromoRedemption(db *gorm.DB, promoID string, userID string) (*PromoRedemption, error) {
+	var redemptions []PromoRedemption
+	err := db.Where("promo_code_id = ? AND user_id = ?", promoID, userID).Limit(1).Find(&redemptions).Error
+	if err != nil || len(redemptions) == 0 {
+		return nil, err
+	}
+	return &redemptions[0], nil
+}
+
+// PromoDiscount returns the amount a discount code takes off a price of
+// the package, rounded to cents.
+func PromoDiscount(promo *PromoCode, packageType string, price float64) (float64, error) {
+	if promo.Kind != PromoKindDiscount || (promo.PackageType != "" && promo.PackageType != packageType) {
+		return 0, ErrPromoNotApplicable
+	}
+	return math.Round(price*float64(promo.DiscountPercent)) / 100, nil
+}
+
+// claimPromoRedemption takes one redemption of the code, checked and
+// counted by a single conditional UPDATE so the limit can not be exceeded
+// by concurrent requests.
+func claimPromoRedemption(tx *gorm.DB, promoID string) error {
+	result := tx.Model(&PromoCode{}).
+		Where("id = ? AND (max_redemptions = 0 OR redemptions < max_redemptions)", promoID).
+		Update("redemptions", gorm.Expr("redemptions + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrPromoExhausted
+	}
+	return nil
+}
+
+// RedeemCreditsCode redeems a credits code and adds its generations to the
+// paid balance.
+func RedeemCreditsCode(db *gorm.DB, code string, userID string, ip string, userAgent string) (*PromoRedemption, error) {
+	var redemption *PromoRedemption
+	err := db.Transaction(func(tx *gorm.DB) error {
+		promo, err := ValidatePromoCode(tx, code, userID)
+		if err != nil {
+			return err
+		}
+		if promo.Kind != PromoKindCredits {
+			return ErrPromoNotApplicable
+		}
+		if err := claimPromoRedemption(tx, promo.ID); err != nil {
+			return err
+		}
+
+		redemption = &PromoRedemption{
+			ID:          uuid.New().String(),
+			PromoCodeID: promo.ID,
+			UserID:      userID,
+			Code:        promo.Code,
+			Status:      PromoRedemptionCompleted,
+			Credits:     promo.Credits,
+			IP:          ip,
+			UserAgent:   userAgent,
+		}
+		// The unique index on code and user rejects a concurrent second redemption
+		if err := tx.Create(redemption).Error; err != nil {
+			return ErrPromoAlreadyRedeemed
+		}
+
+		result := tx.Model(&User{}).
+			Where("id = ?", userID).
+			Update("paid_generations", gorm.Expr("paid_generations + ?", promo.Credits))
+		if result.Error != nil {
+			return result.Error
+		}
+		return recordCreditChange(tx, userID, CreditKindPaid, promo.Credits, CreditReasonPromo, promo.Code, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return redemption, nil
+}
+
+// holdPromoDiscount records the discount of a payment that is being
+// created. The redemption is completed with the payment and released if
+// it fails. A user retrying a payment reuses the redemption, the payment
+// that held it before is failed so it can not be paid with the discount.
+func holdPromoDiscount(tx *gorm.DB, promo *PromoCode, transaction *Transaction, ip string, userAgent string) error {
+	redemption, err := findPromoRedemption(tx, promo.ID, transaction.UserID)
+	if err != nil {
+		return err
+	}
+
+	if redemption != nil && redemption.Status == PromoRedemptionPending && redemption.TransactionID != transaction.ID {
+		var previous Transaction
+		err := tx.Where("id = ?", redemption.TransactionID).First(&previous).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err == nil {
+			// Releases the redemption, it is claimed again below
+			if err := closeTransaction(tx, &previous, "failed"); err != nil {
+				return err
+			}
+			if redemption, err = findPromoRedemption(tx, promo.ID, transaction.UserID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if redemption != nil {
+		if redemption.Status == PromoRedemptionCompleted {
+			return ErrPromoAlreadyRedeemed
+		}
+		if redemption.Status == PromoRedemptionReleased {
+			if err := claimPromoRedemption(tx, promo.ID); err != nil {
+				return err
+			}
+		}
+		result := tx.Model(&PromoRedemption{}).
+			Where("id = ? AND status = ?", redemption.ID, redemption.Status).
+			Updates(map[string]interface{}{
+				"status":         PromoRedemptionPending,
+				"transaction_id": transaction.ID,
+				"discount":       transaction.Discount,
+				"ip":             ip,
+				"user_agent":     userAgent,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrPromoAlreadyRedeemed
+		}
+		return nil
+	}
+
+	if err := claimPromoRedemption(tx, promo.ID); err != nil {
+		return err
+	}
+	redemption = &PromoRedemption{
+		ID:            uuid.New().String(),
+		PromoCodeID:   promo.ID,
+		UserID:        transaction.UserID,
+		Code:          promo.Code,
+		Status:        PromoRedemptionPending,
+		TransactionID: transaction.ID,
+		Discount:      transaction.Discount,
+		IP:            ip,
+		UserAgent:     userAgent,
+	}
+	if err := tx.Create(redemption).Error; err != nil {
+		return ErrPromoAlreadyRedeemed
+	}
+	return nil
+}
+
+// completePromoRedemption completes the discount held by a paid
+// transaction. The discount of a transaction that failed or expired before
+// it was paid is claimed again. A discounted transaction whose redemption
+// was handed to a later payment, or whose code has no redemptions left,
+// gets ErrPromoNotHeld, so the discount is used only once.
+func completePromoRedemption(tx *gorm.DB, transaction *Transaction) error {
+	result := tx.Model(&PromoRedemption{}).
+		Where("transaction_id = ? AND status = ?", transaction.ID, PromoRedemptionPending).
+		Update("status", PromoRedemptionCompleted)
+	if result.Error != nil || result.RowsAffected > 0 {
+		return result.Error
+	}
+	if transaction.PromoCode == "" && transaction.Discount == 0 {
+		return nil
+	}
+
+	var redemptions []PromoRedemption
+	err := tx.Where("transaction_id = ? AND status = ?", transaction.ID, PromoRedemptionReleased).Limit(1).Find(&redemptions).Error
+	if err != nil {
+		return err
+	}
+	if len(redemptions) == 0 {
+		return ErrPromoNotHeld
+	}
+	if err := claimPromoRedemption(tx, redemptions[0].PromoCodeID); err == ErrPromoExhausted {
+		return ErrPromoNotHeld
+	} else if err != nil {
+		return err
+	}
+	result = tx.Model(&PromoRedemption{}).
+		Where("id = ? AND status = ?", redemptions[0].ID, PromoRedemptionReleased).
+		Update("status", PromoRedemptionCompleted)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrPromoNotHeld
+	}
+	return nil
+}
+
+// releasePromoRedemption gives back the discount held by a failed
+// transaction, so the user can use the code again.
+func releasePromoRedemption(tx *gorm.DB, transactionID string) error {
+	var redemptions []PromoRedemption
+	err := tx.Where("transaction_id = ? AND status = ?", transactionID, PromoRedemptionPending).Find(&redemptions).Error
+	if err != nil || len(redemptions) == 0 {
+		return err
+	}
+
+	result := tx.Model(&PromoRedemption{}).
+		Where("id = ? AND status = ?", redemptions[0].ID, PromoRedemptionPending).
+		Update("status", PromoRedemptionReleased)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	return tx.Model(&PromoCode{}).
+		Where("id = ? AND redemptions > 0", redemptions[0].PromoCodeID).
+		Update("redemptions", gorm.Expr("redemptions - 1")).Error
+}
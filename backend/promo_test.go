@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// newTestPromo creates an active discount code of percent.
+func newTestPromo(t *testing.T, db *gorm.DB, code string, percent int) *PromoCode {
+	t.Helper()
+	promo := &PromoCode{ID: uuid.New().String(), Code: code, Kind: PromoKindDiscount, DiscountPercent: percent, Active: true}
+	if err := db.Create(promo).Error; err != nil {
+		t.Fatalf("create promo code: %v", err)
+	}
+	return promo
+}
+
+// newDiscountedTransaction creates a pending transaction discounted with
+// promo the way the payment handler does, holding the discount with it.
+func newDiscountedTransaction(t *testing.T, db *gorm.DB, userID string, promo *PromoCode, orderID string, price float64) *Transaction {
+	t.Helper()
+	discount, err := PromoDiscount(promo, "pack1", price)
+	if err != nil {
+		t.Fatalf("PromoDiscount: %v", err)
+	}
+	transaction := &Transaction{
+		ID:           uuid.New().String(),
+		UserID:       userID,
+		PackageType:  "pack1",
+		PackageName:  "Test pack",
+		PackageKind:  PackageKindPack,
+		PackageCount: 10,
+		Amount:       price - discount,
+		Currency:     "USD",
+		Status:       "pending",
+		LavaOrderID:  orderID,
+		Provider:     "lava",
+		PromoCode:    promo.Code,
+		Discount:     discount,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(transaction).Error; err != nil {
+			return err
+		}
+		return holdPromoDiscount(tx, promo, transaction, "203.0.113.1", "test")
+	})
+	if err != nil {
+		t.Fatalf("hold discount: %v", err)
+	}
+	return transaction
+}
+
+func TestPromoDiscountPaidTwice(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, db, 0, 0)
+	promo := newTestPromo(t, db, "HALF", 50)
+
+	// The user abandons the first invoice, asks for a second one and then
+	// pays both
+	first := newDiscountedTransaction(t, db, user.ID, promo, "order-1", 5)
+	second := newDiscountedTransaction(t, db, user.ID, promo, "order-2", 5)
+	assertTransactionStatus(t, db, first.ID, "failed")
+
+	for _, orderID := range []string{"order-2", "order-1"} {
+		event := &PaymentEvent{OrderID: orderID, Status: PaymentStatusSucceeded, Amount: 2.5}
+		if err := ApplyPaymentEvent(db, "lava", event); err != nil {
+			t.Fatalf("ApplyPaymentEvent %s: %v", orderID, err)
+		}
+	}
+	assertTransactionStatus(t, db, second.ID, "completed")
+	assertTransactionStatus(t, db, first.ID, "failed")
+	assertPaidBalance(t, db, user.ID, 10)
+
+	var flagged Transaction
+	db.Where("id = ?", first.ID).First(&flagged)
+	if flagged.FlagReason != TransactionFlagPromoNotHeld {
+		t.Fatalf("flag_reason = %q, want %q", flagged.FlagReason, TransactionFlagPromoNotHeld)
+	}
+
+	redemption, err := findPromoRedemption(db, promo.ID, user.ID)
+	if err != nil || redemption == nil {
+		t.Fatalf("findPromoRedemption = %v, %v", redemption, err)
+	}
+	if redemption.Status != PromoRedemptionCompleted || redemption.TransactionID != second.ID {
+		t.Fatalf("redemption = %+v, want completed by %s", redemption, second.ID)
+	}
+	db.Where("id = ?", promo.ID).First(promo)
+	if promo.Redemptions != 1 {
+		t.Fatalf("redemptions = %d, want 1", promo.Redemptions)
+	}
+}
+
+func TestPromoDiscountPaidAfterExpiry(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, db, 0, 0)
+	other := newTestUser(t, db, 0, 0)
+	promo := newTestPromo(t, db, "ONCE", 50)
+	db.Model(promo).Update("max_redemptions", 1)
+
+	// The invoice expires, the payment still arrives later and claims the
+	// discount again
+	transaction := newDiscountedTransaction(t, db, user.ID, promo, "order-1", 5)
+	if err := ExpireTransaction(db, transaction); err != nil {
+		t.Fatalf("ExpireTransaction: %v", err)
+	}
+	event := &PaymentEvent{OrderID: "order-1", Status: PaymentStatusSucceeded, Amount: 2.5}
+	if err := ApplyPaymentEvent(db, "lava", event); err != nil {
+		t.Fatalf("ApplyPaymentEvent: %v", err)
+	}
+	assertTransactionStatus(t, db, transaction.ID, "completed")
+	assertPaidBalance(t, db, user.ID, 10)
+	db.Where("id = ?", promo.ID).First(promo)
+	if promo.Redemptions != 1 {
+		t.Fatalf("redemptions = %d, want 1", promo.Redemptions)
+	}
+
+	// Once another user took the last redemption, a late payment is flagged
+	db.Model(promo).Update("max_redemptions", 2)
+	late := newDiscountedTransaction(t, db, other.ID, promo, "order-2", 5)
+	if err := ExpireTransaction(db, late); err != nil {
+		t.Fatalf("ExpireTransaction: %v", err)
+	}
+	third := newTestUser(t, db, 0, 0)
+	newDiscountedTransaction(t, db, third.ID, promo, "order-3", 5)
+
+	event = &PaymentEvent{OrderID: "order-2", Status: PaymentStatusSucceeded, Amount: 2.5}
+	if err := ApplyPaymentEvent(db, "lava", event); err != nil {
+		t.Fatalf("ApplyPaymentEvent: %v", err)
+	}
+	assertTransactionStatus(t, db, late.ID, "expired")
+	assertPaidBalance(t, db, other.ID, 0)
+	var flagged Transaction
+	db.Where("id = ?", late.ID).First(&flagged)
+	if flagged.FlagReason != TransactionFlagPromoNotHeld {
+		t.Fatalf("flag_reason = %q, want %q", flagged.FlagReason, TransactionFlagPromoNotHeld)
+	}
+}
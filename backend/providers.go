@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InputImage is an image passed to a provider. URL is a public URL the
+// provider can fetch (served from Redis), Data holds the raw bytes for
+// providers that take the image in the request body.
+type InputImage struct {
+	URL    string
+	Data   []byte
+	Format string // "png", "jpeg", "webp"
+}
+
+// ImageRequest is the provider independent generation request.
+type ImageRequest struct {
+	Prompt       string
+	InputImages  []InputImage
+	Mask         *InputImage // optional edit mask, transparent areas are regenerated
+	AspectRatio  string      // "16:9"
+	OutputFormat string      // "png"
+	CallbackURL  string      // used by async providers to report completion
+}
+
+// ImageResult is the outcome of a generation. Providers that finish
+// asynchronously return only TaskID from Generate and report the images
+// later through a TaskStatus.
+type ImageResult struct {
+	TaskID string
+	Images []GeneratedImage
+	Cost   float64 // provider cost in USD
+}
+
+// GeneratedImage is a single result image. Providers either return a URL
+// to download the image from or the image bytes inline.
+type GeneratedImage struct {
+	URL    string
+	Data   []byte
+	Format string
+}
+
+// TaskStatus is the state of an asynchronous provider task.
+type TaskStatus struct {
+	TaskID string
+	State  string       // provider specific state, e.g. "waiting"
+	Done   bool         // no more updates will follow
+	Result *ImageResult // set when the task succeeded
+	Err    error        // set when the task failed
+}
+
+// Provider error classes, used to decide whether to fail over to the next
+// provider in the chain.
+const (
+	ErrorClassInsufficientBalance = "insufficient_balance"
+	ErrorClassRateLimited         = "rate_limited"
+	ErrorClassTaskFailed          = "task_failed"
+	ErrorClassTimeout             = "timeout"
+	ErrorClassUnavailable         = "unavailable"
+	ErrorClassAuth                = "auth"
+	ErrorClassInvalidRequest      = "invalid_request"
+)
+
+// ProviderError is a provider failure together with its class.
+type ProviderError struct {
+	Class string
+	Err   error
+}
+
+func (e *ProviderError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// ProviderErrorClass returns the class of err, or "" if err is not a
+// ProviderError.
+func ProviderErrorClass(err error) string {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr.Class
+	}
+	return ""
+}
+
+// classifyHTTPStatus maps a provider HTTP status (or API code) to an error class.
+func classifyHTTPStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrorClassAuth
+	case status == http.StatusPaymentRequired:
+		return ErrorClassInsufficientBalance
+	case status == http.StatusTooManyRequests:
+		return ErrorClassRateLimited
+	case status >= 500:
+		return ErrorClassUnavailable
+	default:
+		return ErrorClassInvalidRequest
+	}
+}
+
+type ProviderCapabilities struct {
+	ImageToImage  bool     `json:"image_to_image"`
+	Async         bool     `json:"async"` // result arrives via callback or polling
+	Mask          bool     `json:"mask"`  // accepts an edit mask
+	AspectRatios  []string `json:"aspect_ratios"`
+	OutputFormats []string `json:"output_formats"`
+	MaxInputBytes int      `json:"max_input_bytes"`
+	CostPerImage  float64  `json:"cost_per_image"` // USD
+	// Hosts result URLs are downloaded from, subdomains included
+	ResultHosts []string `json:"-"`
+}
+
+// ImageProvider generates covers. Providers register themselves with
+// RegisterProvider from an init function, so adding a provider only needs
+// a new file.
+type ImageProvider interface {
+	Name() string
+	DisplayName() string
+	Capabilities() ProviderCapabilities
+	// Configured reports whether the provider API key is set.
+	Configured() bool
+	Generate(ctx context.Context, req ImageRequest) (*ImageResult, error)
+}
+
+// AsyncImageProvider is implemented by providers whose tasks finish in the
+// background. Completion is reported to /api/providers/:name/callback and
+// FetchTask is used by the sweeper for callbacks that never arrive. Anyone
+// can call the callback, so only the task ID is taken from it and the task
+// state is fetched from the provider.
+type AsyncImageProvider interface {
+	ImageProvider
+	FetchTask(ctx context.Context, taskID string) (*TaskStatus, error)
+	CallbackTaskID(body []byte) (string, error)
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]ImageProvider{}
+)
+
+// RegisterProvider makes a provider available by its name.
+func RegisterProvider(p ImageProvider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[p.Name()] = p
+}
+
+// GetProvider returns the provider registered under name.
+func GetProvider(name string) (ImageProvider, bool) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	p, ok := providers[name]
+	return p, ok
+}
+
+// Providers returns all registered providers sorted by name.
+func Providers() []ImageProvider {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	list := make([]ImageProvider, 0, len(providers))
+	for _, p := range providers {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list
+}
+
+// resultURLAllowed tells whether a result URL of the provider may be
+// downloaded: it must use https and point to one of the provider's
+// ResultHosts, so that a result never makes us fetch an internal address.
+func resultURLAllowed(providerName string, rawURL string) bool {
+	provider, ok := GetProvider(providerName)
+	if !ok {
+		return false
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	for _, allowed := range provider.Capabilities().ResultHosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// resultClient returns an HTTP client for result URLs of the provider that
+// only follows redirects to its result hosts.
+func resultClient(providerName string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 || !resultURLAllowed(providerName, req.URL.String()) {
+				return fmt.Errorf("redirect to %s not allowed", req.URL.Host)
+			}
+			return nil
+		},
+	}
+}
+
+// envList reads a lower case comma separated list from the environment.
+func envList(name string, defaultValue []string) []string {
+	values := splitList(strings.ToLower(os.Getenv(name)))
+	if len(values) == 0 {
+		return defaultValue
+	}
+	return values
+}
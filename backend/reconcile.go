@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Payment reconciliation defaults, overridable with
+// PAYMENT_RECONCILE_AFTER_MINUTES and PAYMENT_INVOICE_EXPIRY_HOURS.
+const (
+	defaultReconcileAfterMinutes = 15
+	defaultInvoiceExpiryHours    = 24
+)
+
+// reconcileBatchSize limits the provider requests of one pass.
+const reconcileBatchSize = 100
+
+// reconcilePayments asks the payment providers about transactions that are
+// still pending some minutes after they were created, e.g. because the
+// webhook was lost or the server was down when it fired. Paid and failed
+// payments are applied with the same code as the webhook, invoices that
+// were not paid in time are expired.
+func reconcilePayments(db *gorm.DB) {
+	now := time.Now()
+	after := time.Duration(envInt("PAYMENT_RECONCILE_AFTER_MINUTES", defaultReconcileAfterMinutes)) * time.Minute
+	expiry := time.Duration(envInt("PAYMENT_INVOICE_EXPIRY_HOURS", defaultInvoiceExpiryHours)) * time.Hour
+
+	var transactions []Transaction
+	err := db.Where("status = ? AND created_at < ?", "pending", now.Add(-after)).
+		Order("created_at").
+		Limit(reconcileBatchSize).
+		Find(&transactions).Error
+	if err != nil {
+		fmt.Printf("Warning: Failed to load pending transactions: %v\n", err)
+		return
+	}
+
+	for i := range transactions {
+		reconcileTransaction(db, &transactions[i], now.Sub(transactions[i].CreatedAt) > expiry)
+	}
+}
+
+// reconcileTransaction brings one pending transaction in line with the
+// provider. expired tells whether the invoice is past its expiry.
+func reconcileTransaction(db *gorm.DB, transaction *Transaction, expired bool) {
+	provider, ok := GetPaymentProvider(transaction.Provider)
+	if !ok || !provider.Configured() {
+		fmt.Printf("Payment reconciliation: transaction %s uses unavailable provider %q\n", transaction.ID, transaction.Provider)
+		if expired {
+			expireTransaction(db, transaction)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	event, err := provider.FetchStatus(ctx, transaction.LavaOrderID)
+	if err != nil {
+		fmt.Printf("Warning: Failed to fetch status of %s order %s (transaction %s): %v\n", provider.Name(), transaction.LavaOrderID, transaction.ID, err)
+		// An order the provider does not know about would stay pending forever
+		if expired {
+			expireTransaction(db, transaction)
+		}
+		return
+	}
+	if event.OrderID == "" {
+		event.OrderID = transaction.LavaOrderID
+	}
+
+	if event.Status == PaymentStatusPending {
+		if expired {
+			expireTransaction(db, transaction)
+		}
+		return
+	}
+
+	fmt.Printf("Payment reconciliation: transaction %s is pending, %s reports %s for order %s\n",
+		transaction.ID, provider.Name(), event.Status, event.OrderID)
+	if err := ApplyPaymentEvent(db, provider.Name(), event); err != nil {
+		fmt.Printf("Warning: Failed to apply reconciled status of transaction %s: %v\n", transaction.ID, err)
+	}
+}
+
+// expireTransaction expires an invoice that was never paid and logs it.
+func expireTransaction(db *gorm.DB, transaction *Transaction) {
+	fmt.Printf("Payment reconciliation: expiring transaction %s, unpaid since %s\n",
+		transaction.ID, transaction.CreatedAt.UTC().Format(time.RFC3339))
+	if err := ExpireTransaction(db, transaction); err != nil {
+		fmt.Printf("Warning: Failed to expire transaction %s: %v\n", transaction.ID, err)
+	}
+}
+
+// StartPaymentReconciler runs reconcilePayments every interval.
+func StartPaymentReconciler(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			reconcilePayments(db)
+		}
+	}()
+}
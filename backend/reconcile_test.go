@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestReconcileTransactionAmountMismatch(t *testing.T) {
+	// The stub reports 4.99 paid for every order
+	newLavaStub(t, "success")
+	db := newTestDB(t)
+	user := newTestUser(t, db, 0, 0)
+
+	underpaid := newTestTransaction(t, db, user.ID, "lava", "inv-1", 9.99)
+	reconcileTransaction(db, underpaid, false)
+	assertTransactionStatus(t, db, underpaid.ID, "failed")
+	assertPaidBalance(t, db, user.ID, 0)
+
+	paid := newTestTransaction(t, db, user.ID, "lava", "inv-2", 4.99)
+	reconcileTransaction(db, paid, false)
+	assertTransactionStatus(t, db, paid.ID, "completed")
+	assertPaidBalance(t, db, user.ID, 10)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	ReferralStatusPending  = "pending"  // signed up, no completed purchase yet
+	ReferralStatusRewarded = "rewarded" // first purchase completed, both sides got the bonus
+	ReferralStatusRejected = "rejected" // failed an abuse check, never rewarded
+)
+
+// Referral abuse check reasons.
+const (
+	ReferralRejectSelf    = "self_referral" // same email as the referrer, ignoring aliases
+	ReferralRejectSameIP  = "same_ip"       // signed up from an address the referrer used
+	ReferralRejectIPLimit = "ip_limit"      // too many referred signups from one address
+)
+
+// Referral bonuses and limits, overridable with REFERRAL_REFERRER_BONUS,
+// REFERRAL_REFERRED_BONUS and REFERRAL_MAX_PER_IP.
+const (
+	defaultReferrerBonus  = 10
+	defaultReferredBonus  = 5
+	defaultReferralsPerIP = 3
+)
+
+// referralCodeAlphabet leaves out characters that are easy to confuse.
+const referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// Referral links a user to the user whose code they signed up with. The
+// reward is granted once, on the first purchase of the referred user that
+// is paid in full.
+type Referral struct {
+	ID             string     `gorm:"primaryKey" json:"id"`
+	ReferrerID     string     `gorm:"index" json:"referrer_id"`
+	ReferredID     string     `gorm:"uniqueIndex" json:"referred_id"`
+	Code           string     `json:"code"`
+	Status         string     `gorm:"index" json:"status"` // "pending", "rewarded", "rejected"
+	RejectReason   string     `json:"reject_reason,omitempty"`
+	SignupIP       string     `gorm:"index" json:"-"`
+	ReferrerReward int        `json:"referrer_reward"`
+	ReferredReward int        `json:"referred_reward"`
+	TransactionID  string     `json:"transaction_id,omitempty"` // first completed purchase
+	RewardedAt     *time.Time `json:"rewarded_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// SignupInfo is what is known about a new account besides its Google
+// profile.
+type SignupInfo struct {
+	Timezone     string // IANA zone of the browser, "" keeps the default
+	ReferralCode string // code of the referral link the user came from
+	IP           string
+}
+
+// newReferralCode returns a random 8 character code that no user has yet.
+func newReferralCode(db *gorm.DB) (string, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		buf := make([]byte, 8)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for i, b := range buf {
+			buf[i] = referralCodeAlphabet[int(b)%len(referralCodeAlphabet)]
+		}
+		code := string(buf)
+
+		var count int64
+		if err := db.Model(&User{}).Where("referral_code = ?", code).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return code, nil
+		}
+	}
+	return "", fmt.Errorf("failed to generate a unique referral code")
+}
+
+// backfillReferralCodes gives users created before referrals their code.
+func backfillReferralCodes(db *gorm.DB) error {
+	var users []User
+	if err := db.Where("referral_code = '' OR referral_code IS NULL").Where("is_guest = ?", false).Find(&users).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		code, err := newReferralCode(db)
+		if err != nil {
+			return err
+		}
+		if err := db.Model(&User{}).Where("id = ?", user.ID).Update("referral_code", code).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeEmail lower-cases an email and drops "+tag" suffixes, and dots
+// for Gmail, so that aliases of one mailbox compare equal.
+func normalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], email[at+1:]
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	if domain == "gmail.com" || domain == "googlemail.com" {
+		local = strings.ReplaceAll(local, ".", "")
+		domain = "gmail.com"
+	}
+	return local + "@" + domain
+}
+
+// recordReferral links a new user to the owner of the referral code. A
+// referral that fails the abuse checks is kept as rejected for review.
+// Unknown codes are ignored.
+func recordReferral(tx *gorm.DB, user *User, code string, ip string) error {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return nil
+	}
+	var referrers []User
+	if err := tx.Where("referral_code = ?", code).Limit(1).Find(&referrers).Error; err != nil || len(referrers) == 0 {
+		return err
+	}
+	referrer := referrers[0]
+
+	referral := Referral{
+		ID:         uuid.New().String(),
+		ReferrerID: referrer.ID,
+		ReferredID: user.ID,
+		Code:       code,
+		Status:     ReferralStatusPending,
+		SignupIP:   ip,
+	}
+
+	switch {
+	case referrer.ID == user.ID || normalizeEmail(referrer.Email) == normalizeEmail(user.Email):
+		referral.RejectReason = ReferralRejectSelf
+	case ip != "" && (ip == referrer.SignupIP || ip == referrer.LastIP):
+		referral.RejectReason = ReferralRejectSameIP
+	case ip != "":
+		var count int64
+		err := tx.Model(&Referral{}).
+			Where("signup_ip = ? AND created_at > ?", ip, time.Now().Add(-24*time.Hour)).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count >= int64(envInt("REFERRAL_MAX_PER_IP", defaultReferralsPerIP)) {
+			referral.RejectReason = ReferralRejectIPLimit
+		}
+	}
+	if referral.RejectReason != "" {
+		referral.Status = ReferralStatusRejected
+		fmt.Printf("Referral of %s by %s rejected: %s\n", user.ID, referrer.ID, referral.RejectReason)
+	}
+
+	if err := tx.Create(&referral).Error; err != nil {
+		return err
+	}
+	user.ReferredBy = referrer.ID
+	return tx.Model(&User{}).Where("id = ?", user.ID).Update("referred_by", referrer.ID).Error
+}
+
+// rewardReferral grants the referral bonuses when the referred user's
+// first purchase at the full price completes. It runs in the transaction
+// that completes the payment, the status change makes sure the bonus is
+// granted only once.
+func rewardReferral(tx *gorm.DB, transaction *Transaction) error {
+	// A purchase discounted with a promo code would make the bonuses cheap
+	// to farm, the referral waits for one that is paid in full
+	if transaction.PromoCode != "" || transaction.Discount > 0 || transaction.Amount <= 0 {
+		return nil
+	}
+
+	var referrals []Referral
+	err := tx.Where("referred_id = ? AND status = ?", transaction.UserID, ReferralStatusPending).Limit(1).Find(&referrals).Error
+	if err != nil || len(referrals) == 0 {
+		return err
+	}
+	referral := referrals[0]
+
+	referrerBonus := envInt("REFERRAL_REFERRER_BONUS", defaultReferrerBonus)
+	referredBonus := envInt("REFERRAL_REFERRED_BONUS", defaultReferredBonus)
+	now := time.Now()
+	result := tx.Model(&Referral{}).
+		Where("id = ? AND status = ?", referral.ID, ReferralStatusPending).
+		Updates(map[string]interface{}{
+			"status":          ReferralStatusRewarded,
+			"referrer_reward": referrerBonus,
+			"referred_reward": referredBonus,
+			"transaction_id":  transaction.ID,
+			"rewarded_at":     &now,
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+
+	for userID, bonus := range map[string]int{referral.ReferrerID: referrerBonus, referral.ReferredID: referredBonus} {
+		err := tx.Model(&User{}).
+			Where("id = ?", userID).
+			Update("paid_generations", gorm.Expr("paid_generations + ?", bonus)).Error
+		if err != nil {
+			return err
+		}
+		if err := recordCreditChange(tx, userID, CreditKindPaid, bonus, CreditReasonReferralBonus, referral.ID, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// referralLink returns the link that carries the user's referral code.
+func referralLink(code string) string {
+	frontendURL := os.Getenv("FRONTEND_URL")
+	if frontendURL == "" {
+		frontendURL = "http://localhost:3000"
+	}
+	return strings.TrimRight(frontendURL, "/") + "/?ref=" + code
+}
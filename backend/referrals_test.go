@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRewardReferralSkipsDiscountedPurchase(t *testing.T) {
+	t.Setenv("REFERRAL_REFERRER_BONUS", "10")
+	t.Setenv("REFERRAL_REFERRED_BONUS", "5")
+	db := newTestDB(t)
+	referrer := newTestUser(t, db, 0, 0)
+	referred := newTestUser(t, db, 0, 0)
+	referral := Referral{ID: uuid.New().String(), ReferrerID: referrer.ID, ReferredID: referred.ID, Status: ReferralStatusPending}
+	if err := db.Create(&referral).Error; err != nil {
+		t.Fatalf("create referral: %v", err)
+	}
+
+	// A promo code took the price down to almost nothing
+	discounted := newDiscountedTransaction(t, db, referred.ID, newTestPromo(t, db, "SALE99", 99), "order-1", 4.99)
+	if _, err := CompleteTransaction(db, discounted); err != nil {
+		t.Fatalf("CompleteTransaction: %v", err)
+	}
+	assertPaidBalance(t, db, referrer.ID, 0)
+	assertPaidBalance(t, db, referred.ID, 10)
+
+	full := newTestTransaction(t, db, referred.ID, "lava", "order-2", 4.99)
+	if _, err := CompleteTransaction(db, full); err != nil {
+		t.Fatalf("CompleteTransaction: %v", err)
+	}
+	assertPaidBalance(t, db, referrer.ID, 10)
+	assertPaidBalance(t, db, referred.ID, 25)
+
+	db.Where("id = ?", referral.ID).First(&referral)
+	if referral.Status != ReferralStatusRewarded || referral.TransactionID != full.ID {
+		t.Fatalf("referral = %+v, want rewarded by %s", referral, full.ID)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	RefundSourceReport    = "report"    // reported by the user
+	RefundSourceAutomatic = "automatic" // the result was lost before it could be saved
+)
+
+const (
+	RefundStatusRefunded = "refunded"
+	RefundStatusRejected = "rejected"
+)
+
+// Report reasons a user can give.
+const (
+	ReportReasonUnavailable = "unavailable" // the image does not load
+	ReportReasonBroken      = "broken"      // the image loads but is corrupted or unusable
+)
+
+// Refund reject reasons.
+const (
+	RefundRejectTooOld    = "too_old"         // reported after the report window
+	RefundRejectAvailable = "image_available" // reported as unavailable, but it loads
+	RefundRejectLimit     = "limit_reached"   // too many refunded reports in the last 30 days
+)
+
+// Refund policy defaults, overridable with REFUND_REPORT_WINDOW_DAYS and
+// REFUND_MAX_PER_MONTH.
+const (
+	defaultRefundReportWindowDays = 7
+	defaultRefundsPerMonth        = 3
+)
+
+// remoteResultTTL is how long a result kept at the provider URL is retried
+// when the provider cannot be reached, the provider URLs expire sooner.
+const remoteResultTTL = 24 * time.Hour
+
+var (
+	ErrGenerationRefunded = errors.New("generation already refunded")
+	ErrGenerationReported = errors.New("generation already reported")
+)
+
+// GenerationRefund is a request to return the credit of a generation,
+// reported by the user or found by the recovery sweeper. Rejected reports
+// are kept for review. A generation is refunded at most once, its RefundID
+// points to the refund.
+type GenerationRefund struct {
+	ID           string    `gorm:"primaryKey" json:"id"`
+	GenerationID string    `gorm:"index" json:"generation_id"`
+	UserID       string    `gorm:"index" json:"user_id"`
+	Source       string    `json:"source"` // "report", "automatic"
+	Reason       string    `json:"reason"` // "unavailable", "broken"
+	Comment      string    `json:"comment,omitempty"`
+	Status       string    `gorm:"index" json:"status"` // "refunded", "rejected"
+	RejectReason string    `json:"reject_reason,omitempty"`
+	CreditKind   string    `json:"credit_kind,omitempty"` // kind of the returned credit
+	Credits      int       `json:"credits"`
+	CreatedAt    time.Time `gorm:"index" json:"created_at"`
+}
+
+// ReportGeneration handles a user report of a generation. Images that
+// really are unavailable are refunded right away, images reported as
+// broken are refunded up to REFUND_MAX_PER_MONTH times in 30 days.
+func ReportGeneration(db *gorm.DB, store BlobStore, generation *Generation, reason string, comment string) (*GenerationRefund, error) {
+	if generation.RefundID != "" {
+		return nil, ErrGenerationRefunded
+	}
+	var reports int64
+	err := db.Model(&GenerationRefund{}).
+		Where("generation_id = ? AND source = ?", generation.ID, RefundSourceReport).
+		Count(&reports).Error
+	if err != nil {
+		return nil, err
+	}
+	if reports > 0 {
+		return nil, ErrGenerationReported
+	}
+
+	refund := &GenerationRefund{
+		ID:           uuid.New().String(),
+		GenerationID: generation.ID,
+		UserID:       generation.UserID,
+		Source:       RefundSourceReport,
+		Reason:       reason,
+		Comment:      comment,
+		Status:       RefundStatusRefunded,
+	}
+
+	window := time.Duration(envInt("REFUND_REPORT_WINDOW_DAYS", defaultRefundReportWindowDays)) * 24 * time.Hour
+	if generation.Expired || time.Since(generation.CreatedAt) > window {
+		refund.Status = RefundStatusRejected
+		refund.RejectReason = RefundRejectTooOld
+		return refund, db.Create(refund).Error
+	}
+
+	// A provider that cannot be reached does not prove anything, the report
+	// is then handled like a broken image
+	available, err := imageAvailable(store, generation.Provider, generation.ImageURL)
+	if err != nil {
+		fmt.Printf("Warning: Failed to check image of generation %s: %v\n", generation.ID, err)
+	}
+	verified := err == nil && !available
+	if reason == ReportReasonUnavailable && err == nil && available {
+		refund.Status = RefundStatusRejected
+		refund.RejectReason = RefundRejectAvailable
+		return refund, db.Create(refund).Error
+	}
+	if verified {
+		refund.Reason = ReportReasonUnavailable
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if !verified {
+			var refunded int64
+			err := tx.Model(&GenerationRefund{}).
+				Where("user_id = ? AND source = ? AND reason = ? AND status = ? AND created_at > ?",
+					generation.UserID, RefundSourceReport, ReportReasonBroken, RefundStatusRefunded, time.Now().Add(-30*24*time.Hour)).
+				Count(&refunded).Error
+			if err != nil {
+				return err
+			}
+			if refunded >= int64(envInt("REFUND_MAX_PER_MONTH", defaultRefundsPerMonth)) {
+				refund.Status = RefundStatusRejected
+				refund.RejectReason = RefundRejectLimit
+				return tx.Create(refund).Error
+			}
+		}
+		return refundGeneration(tx, generation, refund)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if refund.Status == RefundStatusRejected {
+		fmt.Printf("Refund of generation %s rejected: %s\n", generation.ID, refund.RejectReason)
+	}
+	return refund, nil
+}
+
+// refundGeneration returns the credit spent on the generation and records
+// the refund. The refund ID is set on the generation by a conditional
+// update, so a generation is never refunded twice.
+func refundGeneration(tx *gorm.DB, generation *Generation, refund *GenerationRefund) error {
+	result := tx.Model(&Generation{}).
+		Where("id = ? AND (refund_id = '' OR refund_id IS NULL)", generation.ID).
+		Update("refund_id", refund.ID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrGenerationRefunded
+	}
+
+	kind, err := generationCreditKind(tx, generation)
+	if err != nil {
+		return err
+	}
+	column := creditColumn(kind)
+	err = tx.Model(&User{}).
+		Where("id = ?", generation.UserID).
+		Update(column, gorm.Expr(column+" + 1")).Error
+	if err != nil {
+		return err
+	}
+	if err := recordCreditChange(tx, generation.UserID, kind, 1, CreditReasonRefund, generation.ID, refund.Source+" refund: "+refund.Reason); err != nil {
+		return err
+	}
+
+	refund.Status = RefundStatusRefunded
+	refund.CreditKind = kind
+	refund.Credits = 1
+	if err := tx.Create(refund).Error; err != nil {
+		return err
+	}
+	generation.RefundID = refund.ID
+	return nil
+}
+
+// generationCreditKind returns the kind of the credit the generation was
+// paid with, from the reservation of its job.
+func generationCreditKind(tx *gorm.DB, generation *Generation) (string, error) {
+	var reservations []CreditReservation
+	err := tx.Where("id IN (?)", tx.Model(&GenerationJob{}).Select("reservation_id").Where("generation_id = ?", generation.ID)).
+		Limit(1).
+		Find(&reservations).Error
+	if err != nil {
+		return "", err
+	}
+	if len(reservations) > 0 && reservations[0].Kind != "" {
+		return reservations[0].Kind, nil
+	}
+	// Generations made before subscriptions existed
+	if generation.IsFree {
+		return CreditKindFree, nil
+	}
+	return CreditKindPaid, nil
+}
+
+// imageAvailable tells whether the image of a generation can still be
+// loaded. Files in our storage are checked in the store, provider URLs
+// with a request to the provider's result hosts. An error means the store
+// or the provider could not be asked.
+func imageAvailable(store BlobStore, providerName string, imageURL string) (bool, error) {
+	if savedPath, ok := storagePath(imageURL); ok {
+		_, err := store.Stat(context.Background(), savedPath)
+		if err == ErrBlobNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	if !resultURLAllowed(providerName, imageURL) {
+		return false, fmt.Errorf("not a %s result host: %s", providerName, imageURL)
+	}
+	client := resultClient(providerName, 15*time.Second)
+	resp, err := client.Get(imageURL)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusGone, resp.StatusCode == http.StatusForbidden:
+		// Expired provider URLs answer with one of these
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+}
+
+// recoverRemoteGenerations retries saving the results that are only at the
+// provider URL. Results whose URL expired are refunded automatically.
+func recoverRemoteGenerations(db *gorm.DB, store BlobStore) {
+	var generations []Generation
+	err := db.Where("remote_only = ? AND (refund_id = '' OR refund_id IS NULL)", true).Find(&generations).Error
+	if err != nil {
+		fmt.Printf("Warning: Failed to load unsaved generations: %v\n", err)
+		return
+	}
+
+	for i := range generations {
+		generation := &generations[i]
+		available, err := imageAvailable(store, generation.Provider, generation.ImageURL)
+		if err == nil && available {
+			savedPath, err := downloadAndSaveImage(db, store, generation.Provider, generation.ImageURL, generation.UserID)
+			if err != nil {
+				fmt.Printf("Warning: Failed to save image of generation %s: %v\n", generation.ID, err)
+				continue
+			}
+			coverURL := storageURL(savedPath)
+			err = db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Model(generation).Updates(map[string]interface{}{"image_url": coverURL, "remote_only": false}).Error; err != nil {
+					return err
+				}
+				return acquireBlobs(tx, coverURL)
+			})
+			if err != nil {
+				fmt.Printf("Warning: Failed to update generation %s: %v\n", generation.ID, err)
+				continue
+			}
+			db.Model(&GenerationJob{}).Where("generation_id = ?", generation.ID).Update("image_url", coverURL)
+			fmt.Printf("Saved image of generation %s to storage\n", generation.ID)
+			continue
+		}
+		if err != nil && time.Since(generation.CreatedAt) < remoteResultTTL {
+			continue
+		}
+
+		refund := &GenerationRefund{
+			ID:           uuid.New().String(),
+			GenerationID: generation.ID,
+			UserID:       generation.UserID,
+			Source:       RefundSourceAutomatic,
+			Reason:       ReportReasonUnavailable,
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			return refundGeneration(tx, generation, refund)
+		})
+		if err != nil {
+			if !errors.Is(err, ErrGenerationRefunded) {
+				fmt.Printf("Warning: Failed to refund generation %s: %v\n", generation.ID, err)
+			}
+			continue
+		}
+		fmt.Printf("Refunded generation %s, its image is no longer available\n", generation.ID)
+	}
+}
+
+// StartGenerationRecovery runs recoverRemoteGenerations every interval.
+func StartGenerationRecovery(db *gorm.DB, store BlobStore, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			recoverRemoteGenerations(db, store)
+		}
+	}()
+}
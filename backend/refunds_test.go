@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// newTestGeneration creates a paid generation of the user with the image
+// at imageURL, made at createdAt.
+func newTestGeneration(t *testing.T, db *gorm.DB, userID string, imageURL string, createdAt time.Time) *Generation {
+	t.Helper()
+	generation := &Generation{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		ImageURL:  imageURL,
+		Provider:  "nano-banana",
+		CreatedAt: createdAt,
+	}
+	if err := db.Create(generation).Error; err != nil {
+		t.Fatalf("create generation: %v", err)
+	}
+	return generation
+}
+
+// newTestRefunds records count refunded broken reports of the user, made
+// at createdAt.
+func newTestRefunds(t *testing.T, db *gorm.DB, userID string, count int, createdAt time.Time) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		refund := &GenerationRefund{
+			ID:           uuid.New().String(),
+			GenerationID: uuid.New().String(),
+			UserID:       userID,
+			Source:       RefundSourceReport,
+			Reason:       ReportReasonBroken,
+			Status:       RefundStatusRefunded,
+			Credits:      1,
+			CreatedAt:    createdAt,
+		}
+		if err := db.Create(refund).Error; err != nil {
+			t.Fatalf("create refund: %v", err)
+		}
+	}
+}
+
+func TestReportGeneration(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		reason     string
+		stored     bool // the image is in storage
+		age        time.Duration
+		expired    bool
+		refunds    int       // earlier refunded broken reports
+		refundsAt  time.Time // when they were made
+		wantStatus string
+		wantReject string
+		wantReason string
+	}{
+		{name: "broken", reason: ReportReasonBroken, stored: true, wantStatus: RefundStatusRefunded, wantReason: ReportReasonBroken},
+		{name: "unavailable", reason: ReportReasonUnavailable, wantStatus: RefundStatusRefunded, wantReason: ReportReasonUnavailable},
+		{name: "reported broken but missing", reason: ReportReasonBroken, wantStatus: RefundStatusRefunded, wantReason: ReportReasonUnavailable},
+		{name: "unavailable but loads", reason: ReportReasonUnavailable, stored: true, wantStatus: RefundStatusRejected, wantReject: RefundRejectAvailable},
+		{name: "too old", reason: ReportReasonBroken, stored: true, age: 8 * 24 * time.Hour, wantStatus: RefundStatusRejected, wantReject: RefundRejectTooOld},
+		{name: "expired", reason: ReportReasonUnavailable, expired: true, wantStatus: RefundStatusRejected, wantReject: RefundRejectTooOld},
+		{name: "limit reached", reason: ReportReasonBroken, stored: true, refunds: 3, refundsAt: now.Add(-29 * 24 * time.Hour), wantStatus: RefundStatusRejected, wantReject: RefundRejectLimit},
+		{name: "limit of an earlier month", reason: ReportReasonBroken, stored: true, refunds: 3, refundsAt: now.Add(-31 * 24 * time.Hour), wantStatus: RefundStatusRefunded, wantReason: ReportReasonBroken},
+		{name: "missing over the limit", reason: ReportReasonUnavailable, refunds: 3, refundsAt: now.Add(-time.Hour), wantStatus: RefundStatusRefunded, wantReason: ReportReasonUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("REFUND_REPORT_WINDOW_DAYS", "7")
+			t.Setenv("REFUND_MAX_PER_MONTH", "3")
+			db := newTestDB(t)
+			store, err := NewLocalBlobStore(t.TempDir())
+			if err != nil {
+				t.Fatalf("NewLocalBlobStore: %v", err)
+			}
+			user := newTestUser(t, db, 0, 0)
+			newTestRefunds(t, db, user.ID, tt.refunds, tt.refundsAt)
+
+			key := user.ID + "/cover.png"
+			if tt.stored {
+				if err := store.Put(context.Background(), key, []byte("cover"), "image/png"); err != nil {
+					t.Fatalf("Put: %v", err)
+				}
+			}
+			generation := newTestGeneration(t, db, user.ID, storageURL(key), now.Add(-tt.age))
+			if tt.expired {
+				db.Model(generation).Update("expired", true)
+				generation.Expired = true
+			}
+
+			refund, err := ReportGeneration(db, store, generation, tt.reason, "")
+			if err != nil {
+				t.Fatalf("ReportGeneration: %v", err)
+			}
+			if refund.Status != tt.wantStatus || refund.RejectReason != tt.wantReject {
+				t.Fatalf("refund = %s (%s), want %s (%s)", refund.Status, refund.RejectReason, tt.wantStatus, tt.wantReject)
+			}
+
+			credits := 0
+			if tt.wantStatus == RefundStatusRefunded {
+				credits = 1
+				if refund.Reason != tt.wantReason || refund.CreditKind != CreditKindPaid {
+					t.Fatalf("refund = %+v, want a paid credit for %s", refund, tt.wantReason)
+				}
+			}
+			assertPaidBalance(t, db, user.ID, credits)
+
+			// A generation is reported once
+			if _, err := ReportGeneration(db, store, generation, tt.reason, ""); !errors.Is(err, ErrGenerationReported) && !errors.Is(err, ErrGenerationRefunded) {
+				t.Fatalf("second report: err = %v", err)
+			}
+			assertPaidBalance(t, db, user.ID, credits)
+		})
+	}
+}
+
+func TestRecoverRemoteGenerations(t *testing.T) {
+	db := newTestDB(t)
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBlobStore: %v", err)
+	}
+	user := newTestUser(t, db, 0, 0)
+
+	// The provider can not be asked about either image, only the one past
+	// the retry window is refunded
+	lost := newTestGeneration(t, db, user.ID, "https://unknown.example/lost.png", time.Now().Add(-2*remoteResultTTL))
+	recent := newTestGeneration(t, db, user.ID, "https://unknown.example/recent.png", time.Now())
+	db.Model(&Generation{}).Where("id IN ?", []string{lost.ID, recent.ID}).Update("remote_only", true)
+
+	for i := 0; i < 2; i++ {
+		recoverRemoteGenerations(db, store)
+	}
+	assertPaidBalance(t, db, user.ID, 1)
+
+	var refunds []GenerationRefund
+	db.Where("user_id = ?", user.ID).Find(&refunds)
+	if len(refunds) != 1 || refunds[0].GenerationID != lost.ID || refunds[0].Source != RefundSourceAutomatic {
+		t.Fatalf("refunds = %+v, want one automatic refund of the lost generation", refunds)
+	}
+
+	// Refunded already, a report does not return the credit again
+	db.Where("id = ?", lost.ID).First(lost)
+	if _, err := ReportGeneration(db, store, lost, ReportReasonUnavailable, ""); !errors.Is(err, ErrGenerationRefunded) {
+		t.Fatalf("report of a refunded generation: err = %v, want %v", err, ErrGenerationRefunded)
+	}
+	stale := *lost
+	stale.RefundID = ""
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return refundGeneration(tx, &stale, &GenerationRefund{ID: uuid.New().String(), GenerationID: lost.ID, UserID: user.ID, Source: RefundSourceReport})
+	})
+	if !errors.Is(err, ErrGenerationRefunded) {
+		t.Fatalf("refund of a stale copy: err = %v, want %v", err, ErrGenerationRefunded)
+	}
+	assertPaidBalance(t, db, user.ID, 1)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Retention defaults in days, overridable with RETENTION_FREE_DAYS and
+// RETENTION_PAID_DAYS. 0 keeps the covers forever.
+const (
+	defaultFreeRetentionDays = 30
+	defaultPaidRetentionDays = 365
+)
+
+const janitorBatchSize = 100
+
+// StorageCleanupReport tells what CleanupStorage did, or would do in a dry
+// run. In a dry run RemovedFiles counts the files that no generation would
+// refer to anymore.
+type StorageCleanupReport struct {
+	DryRun             bool  `json:"dry_run"`
+	ExpiredGenerations int   `json:"expired_generations"`
+	PurgedUsers        int   `json:"purged_users"` // owners of storage files without an account
+	RemovedFiles       int   `json:"removed_files"`
+	RemovedBytes       int64 `json:"removed_bytes"`
+	RemovedDirs        int   `json:"removed_dirs"`
+
+	// Keys counted in RemovedFiles, a dry run finds some files twice
+	removed map[string]bool
+}
+
+// countRemoved adds a removed file to the report.
+func (r *StorageCleanupReport) countRemoved(key string, size int64) {
+	if r.removed[key] {
+		return
+	}
+	r.removed[key] = true
+	r.RemovedFiles++
+	r.RemovedBytes += size
+}
+
+// retentionDays reads a retention period in days, 0 disables it.
+func retentionDays(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value < 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// CleanupStorage applies the retention policy: generations older than
+// their retention period and generations of deleted accounts are marked
+// expired and their files are removed, as are the files of deleted
+// accounts, files no generation refers to and empty directories. A dry run
+// only reports.
+func CleanupStorage(db *gorm.DB, store BlobStore, dryRun bool) (*StorageCleanupReport, error) {
+	report := &StorageCleanupReport{DryRun: dryRun, removed: map[string]bool{}}
+
+	if err := removeOrphanFiles(db, store, report); err != nil {
+		return report, fmt.Errorf("failed to remove orphan files: %w", err)
+	}
+	if err := expireGenerations(db, store, report); err != nil {
+		return report, fmt.Errorf("failed to expire generations: %w", err)
+	}
+	if !dryRun {
+		removed, removedBytes := collectBlobGarbage(db, store, blobGCGrace)
+		report.RemovedFiles += removed
+		report.RemovedBytes += removedBytes
+	}
+	if local, ok := store.(*LocalBlobStore); ok {
+		removed, err := local.RemoveEmptyDirs(dryRun, report.removed)
+		if err != nil {
+			return report, fmt.Errorf("failed to remove empty directories: %w", err)
+		}
+		report.RemovedDirs = removed
+	}
+	return report, nil
+}
+
+// expiredGenerationScopes select the generations to expire: free and paid
+// ones past their retention period and the ones of deleted accounts.
+// Results only at the provider URL are left to recoverRemoteGenerations.
+func expiredGenerationScopes(now time.Time) []func(*gorm.DB) *gorm.DB {
+	scopes := []func(*gorm.DB) *gorm.DB{
+		func(db *gorm.DB) *gorm.DB {
+			return db.Where("user_id NOT IN (SELECT id FROM users)")
+		},
+	}
+	policies := []struct {
+		free bool
+		days int
+	}{
+		{true, retentionDays("RETENTION_FREE_DAYS", defaultFreeRetentionDays)},
+		{false, retentionDays("RETENTION_PAID_DAYS", defaultPaidRetentionDays)},
+	}
+	for _, policy := range policies {
+		if policy.days == 0 {
+			continue
+		}
+		free, cutoff := policy.free, now.AddDate(0, 0, -policy.days)
+		scopes = append(scopes, func(db *gorm.DB) *gorm.DB {
+			return db.Where("is_free = ? AND created_at < ? AND remote_only = ?", free, cutoff, false)
+		})
+	}
+	return scopes
+}
+
+// expireGenerations marks the generations selected by
+// expiredGenerationScopes expired and drops their references to the cover
+// and the collage.
+func expireGenerations(db *gorm.DB, store BlobStore, report *StorageCleanupReport) error {
+	// Files of the expiring generations and how many of them refer to each
+	references := map[string]int{}
+	seen := map[string]bool{}
+
+	for _, scope := range expiredGenerationScopes(time.Now()) {
+		offset := 0
+		for {
+			var generations []Generation
+			err := db.Scopes(scope).Where("expired = ?", false).
+				Order("id").Offset(offset).Limit(janitorBatchSize).Find(&generations).Error
+			if err != nil {
+				return err
+			}
+
+			for i := range generations {
+				generation := &generations[i]
+				// A generation of a deleted account may be old enough as well
+				if seen[generation.ID] {
+					continue
+				}
+				seen[generation.ID] = true
+				report.ExpiredGenerations++
+
+				if report.DryRun {
+					for _, fileURL := range []string{generation.ImageURL, generation.InputURL} {
+						if _, ok := storagePath(fileURL); ok {
+							references[fileURL]++
+						}
+					}
+					continue
+				}
+				if err := expireGeneration(db, store, generation, report); err != nil {
+					return err
+				}
+			}
+
+			if len(generations) < janitorBatchSize {
+				break
+			}
+			// Expired generations drop out of the query, in a dry run nothing changes
+			if report.DryRun {
+				offset += len(generations)
+			}
+		}
+	}
+
+	if report.DryRun {
+		for fileURL, count := range references {
+			if size, removable := fileRemovable(db, store, fileURL, count); removable {
+				savedPath, _ := storagePath(fileURL)
+				report.countRemoved(savedPath, size)
+			}
+		}
+
+		// Blobs that are unreferenced already, see collectBlobGarbage
+		var unreferenced []StoredBlob
+		db.Where("ref_count = 0 AND updated_at < ?", time.Now().Add(-blobGCGrace)).Find(&unreferenced)
+		for _, blob := range unreferenced {
+			report.countRemoved(blob.Key, blob.Size)
+		}
+	}
+	return nil
+}
+
+// expireGeneration marks a generation expired and drops its references to
+// its files. Files saved before content addressing are removed right away,
+// the blob collector removes the others.
+func expireGeneration(db *gorm.DB, store BlobStore, generation *Generation, report *StorageCleanupReport) error {
+	var untracked []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Generation{}).Where("id = ? AND expired = ?", generation.ID, false).Update("expired", true)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		var err error
+		untracked, err = releaseGenerationFiles(tx, generation)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// The batch result must not point to the removed file
+	db.Model(&GenerationJob{}).Where("generation_id = ?", generation.ID).Update("image_url", "")
+
+	for _, fileURL := range untracked {
+		if size, removable := fileRemovable(db, store, fileURL, 0); removable {
+			removeStoredFile(store, fileURL)
+			savedPath, _ := storagePath(fileURL)
+			report.countRemoved(savedPath, size)
+		}
+	}
+	return nil
+}
+
+// removeOrphanFiles removes the files of deleted accounts and the files
+// saved before content addressing that no generation refers to. Content
+// addressed blobs are left to the blob collector.
+func removeOrphanFiles(db *gorm.DB, store BlobStore, report *StorageCleanupReport) error {
+	ctx := context.Background()
+	cutoff := time.Now().Add(-blobGCGrace)
+	owners := map[string]bool{}
+	purged := map[string]bool{}
+	var orphans []BlobInfo
+
+	err := store.List(ctx, "", func(info BlobInfo) error {
+		owner, _, ok := strings.Cut(info.Key, "/")
+		if !ok {
+			return nil
+		}
+		exists, checked := owners[owner]
+		if !checked {
+			var count int64
+			if err := db.Model(&User{}).Where("id = ?", owner).Count(&count).Error; err != nil {
+				return err
+			}
+			exists = count > 0
+			owners[owner] = exists
+		}
+		if !exists {
+			purged[owner] = true
+			orphans = append(orphans, info)
+			return nil
+		}
+
+		// Recently saved files may not have their generation yet
+		if info.ModTime.After(cutoff) {
+			return nil
+		}
+		if _, ok := contentHash(info.Key); ok {
+			var tracked int64
+			db.Model(&StoredBlob{}).Where("key = ?", info.Key).Count(&tracked)
+			if tracked > 0 {
+				return nil
+			}
+		}
+		// Compared by path, BASE_URL may have changed since the file was saved
+		pattern := "%/storage/" + info.Key
+		var generations, jobs int64
+		db.Model(&Generation{}).
+			Where("(image_url LIKE ? OR input_url LIKE ?) AND expired = ?", pattern, pattern, false).
+			Count(&generations)
+		db.Model(&GenerationJob{}).
+			Where("input_url LIKE ? AND status IN ?", pattern, []string{JobStatusQueued, JobStatusRunning}).
+			Count(&jobs)
+		if generations == 0 && jobs == 0 {
+			orphans = append(orphans, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	report.PurgedUsers = len(purged)
+	for _, info := range orphans {
+		if !report.DryRun {
+			if err := store.Delete(ctx, info.Key); err != nil {
+				fmt.Printf("Warning: Failed to remove %s: %v\n", info.Key, err)
+				continue
+			}
+		}
+		report.countRemoved(info.Key, info.Size)
+	}
+	if !report.DryRun {
+		for owner := range purged {
+			db.Where("owner = ?", owner).Delete(&StoredBlob{})
+		}
+	}
+	return nil
+}
+
+// RemoveEmptyDirs removes the empty directories under the storage
+// directory, deepest first, and returns how many it removed. A dry run
+// counts the directories that would be empty once the removing keys are
+// removed.
+func (s *LocalBlobStore) RemoveEmptyDirs(dryRun bool, removing map[string]bool) (int, error) {
+	var dirs []string
+	err := filepath.WalkDir(s.dir, func(dirPath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && dirPath != s.dir {
+			dirs = append(dirs, dirPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+
+	gone := map[string]bool{}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		empty := true
+		for _, entry := range entries {
+			entryPath := filepath.Join(dir, entry.Name())
+			rel, _ := filepath.Rel(s.dir, entryPath)
+			if !gone[entryPath] && !(dryRun && removing[filepath.ToSlash(rel)]) {
+				empty = false
+				break
+			}
+		}
+		if !empty {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(dir); err != nil {
+				continue
+			}
+		}
+		gone[dir] = true
+	}
+	return len(gone), nil
+}
+
+// StartStorageJanitor runs CleanupStorage every interval.
+func StartStorageJanitor(db *gorm.DB, store BlobStore, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			report, err := CleanupStorage(db, store, false)
+			if err != nil {
+				fmt.Printf("Warning: Storage cleanup failed: %v\n", err)
+			}
+			if report.ExpiredGenerations > 0 || report.RemovedFiles > 0 || report.RemovedDirs > 0 {
+				printCleanupReport(report)
+			}
+		}
+	}()
+}
+
+func printCleanupReport(report *StorageCleanupReport) {
+	verb := "Storage cleanup"
+	if report.DryRun {
+		verb = "Storage cleanup (dry run)"
+	}
+	fmt.Printf("%s: %d generations expired, %d deleted accounts purged, %d files (%d bytes) and %d directories removed\n",
+		verb, report.ExpiredGenerations, report.PurgedUsers, report.RemovedFiles, report.RemovedBytes, report.RemovedDirs)
+}
+
+// runStorageCleanup runs CleanupStorage once from the command line:
+//
+//	go run . cleanup-storage [-dry-run]
+//
+// Returns the exit code.
+func runStorageCleanup(args []string) int {
+	flags := flag.NewFlagSet("cleanup-storage", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be removed")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	db, err := InitDB()
+	if err != nil {
+		fmt.Printf("Failed to initialize database: %v\n", err)
+		return 1
+	}
+	store, err := NewBlobStoreFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to initialize storage: %v\n", err)
+		return 1
+	}
+
+	report, err := CleanupStorage(db, store, *dryRun)
+	printCleanupReport(report)
+	if err != nil {
+		fmt.Printf("Storage cleanup failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
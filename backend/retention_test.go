@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// newStoredGeneration stores the cover and the collage of a generation of
+// the user made at createdAt, with their blob references.
+func newStoredGeneration(t *testing.T, db *gorm.DB, store BlobStore, userID string, cover string, collage string, createdAt time.Time) *Generation {
+	t.Helper()
+	coverKey, err := storeBlob(db, store, userID, []byte(cover), "png")
+	if err != nil {
+		t.Fatalf("store cover: %v", err)
+	}
+	collageKey, err := storeBlob(db, store, userID+"/inputs", []byte(collage), "jpeg")
+	if err != nil {
+		t.Fatalf("store collage: %v", err)
+	}
+	generation := &Generation{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		ImageURL:  storageURL(coverKey),
+		InputURL:  storageURL(collageKey),
+		IsFree:    true,
+		CreatedAt: createdAt,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(generation).Error; err != nil {
+			return err
+		}
+		return acquireBlobs(tx, generation.ImageURL, generation.InputURL)
+	})
+	if err != nil {
+		t.Fatalf("create generation: %v", err)
+	}
+	return generation
+}
+
+// countExpired returns the number of expired generations.
+func countExpired(t *testing.T, db *gorm.DB) int64 {
+	t.Helper()
+	var count int64
+	if err := db.Model(&Generation{}).Where("expired = ?", true).Count(&count).Error; err != nil {
+		t.Fatalf("count expired generations: %v", err)
+	}
+	return count
+}
+
+func TestCleanupStorageDryRun(t *testing.T) {
+	t.Setenv("RETENTION_FREE_DAYS", "30")
+	t.Setenv("RETENTION_PAID_DAYS", "365")
+	db := newTestDB(t)
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBlobStore: %v", err)
+	}
+	ctx := context.Background()
+	user := newTestUser(t, db, 0, 0)
+	old := time.Now().AddDate(0, 0, -40)
+
+	// Two old variants share a collage, the recent generation stays
+	newStoredGeneration(t, db, store, user.ID, "cover 1", "collage", old)
+	newStoredGeneration(t, db, store, user.ID, "cover 2", "collage", old)
+	newStoredGeneration(t, db, store, user.ID, "cover 3", "other collage", time.Now())
+
+	// A file of a deleted account, saved before content addressing, is both
+	// an orphan and the file of an expiring generation
+	if err := store.Put(ctx, "gone/cover.png", []byte("gone"), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	newTestGeneration(t, db, "gone", storageURL("gone/cover.png"), time.Now())
+
+	// The blobs were stored long enough ago to be collected once released
+	db.Model(&StoredBlob{}).Where("1 = 1").UpdateColumn("updated_at", time.Now().Add(-2*blobGCGrace))
+	keys := listKeys(t, store, "")
+	db.Where("id = ?", user.ID).First(user)
+
+	dryRun, err := CleanupStorage(db, store, true)
+	if err != nil {
+		t.Fatalf("CleanupStorage dry run: %v", err)
+	}
+	if dryRun.ExpiredGenerations != 3 || dryRun.PurgedUsers != 1 {
+		t.Fatalf("dry run = %+v, want 3 expired generations of 1 purged user", dryRun)
+	}
+	// 2 covers, the shared collage once and the orphan once
+	if dryRun.RemovedFiles != 4 {
+		t.Fatalf("dry run removed files = %d, want 4", dryRun.RemovedFiles)
+	}
+
+	// Nothing changed
+	if after := listKeys(t, store, ""); len(after) != len(keys) {
+		t.Fatalf("dry run removed files: %v, was %v", after, keys)
+	}
+	if expired := countExpired(t, db); expired != 0 {
+		t.Fatalf("dry run expired %d generations", expired)
+	}
+	var unchanged User
+	db.Where("id = ?", user.ID).First(&unchanged)
+	if unchanged.StorageFiles != user.StorageFiles || unchanged.StorageBytes != user.StorageBytes {
+		t.Fatalf("dry run changed the storage usage to %d files, %d bytes", unchanged.StorageFiles, unchanged.StorageBytes)
+	}
+
+	// The real run does what the dry run reported
+	report, err := CleanupStorage(db, store, false)
+	if err != nil {
+		t.Fatalf("CleanupStorage: %v", err)
+	}
+	if report.ExpiredGenerations != dryRun.ExpiredGenerations || report.RemovedFiles != dryRun.RemovedFiles ||
+		report.RemovedBytes != dryRun.RemovedBytes || report.RemovedDirs != dryRun.RemovedDirs {
+		t.Fatalf("report = %+v, dry run reported %+v", report, dryRun)
+	}
+	if after := listKeys(t, store, ""); len(after) != len(keys)-4 {
+		t.Fatalf("files left = %v", after)
+	}
+	if expired := countExpired(t, db); expired != 3 {
+		t.Fatalf("expired generations = %d, want 3", expired)
+	}
+}
+
+func TestExpireGenerationsOverlappingScopes(t *testing.T) {
+	t.Setenv("RETENTION_FREE_DAYS", "30")
+	t.Setenv("RETENTION_PAID_DAYS", "0")
+	old := time.Now().AddDate(0, 0, -40)
+	user := User{ID: uuid.New().String(), Email: uuid.New().String() + "@example.com"}
+
+	// The old free generations of the deleted account are in both scopes,
+	// together they take more than one batch
+	var generations []Generation
+	for i := 0; i < janitorBatchSize*3/2; i++ {
+		owner := user.ID
+		if i%5 < 2 {
+			owner = "gone"
+		}
+		generations = append(generations, Generation{ID: uuid.New().String(), UserID: owner, IsFree: true, CreatedAt: old})
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		db := newTestDB(t)
+		if err := db.Create(&user).Error; err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+		if err := db.CreateInBatches(generations, 50).Error; err != nil {
+			t.Fatalf("create generations: %v", err)
+		}
+		store, err := NewLocalBlobStore(t.TempDir())
+		if err != nil {
+			t.Fatalf("NewLocalBlobStore: %v", err)
+		}
+
+		report := &StorageCleanupReport{DryRun: dryRun, removed: map[string]bool{}}
+		if err := expireGenerations(db, store, report); err != nil {
+			t.Fatalf("expireGenerations: %v", err)
+		}
+		if report.ExpiredGenerations != len(generations) {
+			t.Fatalf("dry run %v: expired %d generations, want %d", dryRun, report.ExpiredGenerations, len(generations))
+		}
+		want := int64(len(generations))
+		if dryRun {
+			want = 0
+		}
+		if expired := countExpired(t, db); expired != want {
+			t.Fatalf("dry run %v: %d generations marked expired, want %d", dryRun, expired, want)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3MaxPresignTTL is the longest validity of a SigV4 presigned URL.
+const s3MaxPresignTTL = 7 * 24 * time.Hour
+
+// s3EmptyPayloadHash is the SHA-256 of an empty body.
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type S3ListBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type S3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// S3BlobStore keeps blobs in a bucket of an S3 compatible object storage,
+// AWS S3 or MinIO. Requests are signed with AWS Signature Version 4.
+type S3BlobStore struct {
+	endpoint       *url.URL
+	publicEndpoint *url.URL // endpoint in presigned URLs, clients may reach the storage by another address
+	region         string
+	bucket         string
+	accessKey      string
+	secretKey      string
+	pathStyle      bool // "endpoint/bucket/key" instead of "bucket.endpoint/key", MinIO needs it
+	client         *http.Client
+}
+
+// NewS3BlobStoreFromEnv configures the store with S3_ENDPOINT, S3_BUCKET,
+// S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY and optionally S3_REGION
+// (us-east-1), S3_PUBLIC_ENDPOINT and S3_FORCE_PATH_STYLE (true).
+func NewS3BlobStoreFromEnv() (*S3BlobStore, error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	bucket := os.Getenv("S3_BUCKET")
+	accessKey := os.Getenv("S3_ACCESS_KEY_ID")
+	secretKey := os.Getenv("S3_SECRET_ACCESS_KEY")
+	if endpoint == "" || bucket == "" || accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set")
+	}
+
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	publicEndpoint := os.Getenv("S3_PUBLIC_ENDPOINT")
+	if publicEndpoint == "" {
+		publicEndpoint = endpoint
+	}
+	pathStyle := true
+	if value := os.Getenv("S3_FORCE_PATH_STYLE"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3_FORCE_PATH_STYLE: %w", err)
+		}
+		pathStyle = parsed
+	}
+
+	return NewS3BlobStore(endpoint, publicEndpoint, region, bucket, accessKey, secretKey, pathStyle)
+}
+
+func NewS3BlobStore(endpoint string, publicEndpoint string, region string, bucket string, accessKey string, secretKey string, pathStyle bool) (*S3BlobStore, error) {
+	endpointURL, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil || endpointURL.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint: %s", endpoint)
+	}
+	publicURL, err := url.Parse(strings.TrimRight(publicEndpoint, "/"))
+	if err != nil || publicURL.Host == "" {
+		return nil, fmt.Errorf("invalid S3 public endpoint: %s", publicEndpoint)
+	}
+	return &S3BlobStore{
+		endpoint:       endpointURL,
+		publicEndpoint: publicURL,
+		region:         region,
+		bucket:         bucket,
+		accessKey:      accessKey,
+		secretKey:      secretKey,
+		pathStyle:      pathStyle,
+		client:         &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+func (s *S3BlobStore) Name() string {
+	return "s3"
+}
+
+// objectURL returns the URL of a key on the endpoint, "" is the bucket.
+func (s *S3BlobStore) objectURL(endpoint *url.URL, key string) *url.URL {
+	objectURL := *endpoint
+	if s.pathStyle {
+		objectURL.Path = endpoint.Path + "/" + s.bucket
+		if key != "" {
+			objectURL.Path += "/" + key
+		}
+	} else {
+		objectURL.Host = s.bucket + "." + endpoint.Host
+		objectURL.Path = endpoint.Path + "/" + key
+	}
+	objectURL.RawPath = s3EscapePath(objectURL.Path)
+	return &objectURL
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	if _, ok := contentHash(key); ok {
+		header.Set("Cache-Control", "public, "+immutableCacheControl)
+	}
+	resp, err := s.do(ctx, "PUT", s.objectURL(s.endpoint, key), header, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, "GET", s.objectURL(s.endpoint, key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3BlobStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	resp, err := s.do(ctx, "HEAD", s.objectURL(s.endpoint, key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &BlobInfo{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, "DELETE", s.objectURL(s.endpoint, key), nil, nil)
+	if err == ErrBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3BlobStore) List(ctx context.Context, prefix string, fn func(BlobInfo) error) error {
+	token := ""
+	for {
+		listURL := s.objectURL(s.endpoint, "")
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		listURL.RawQuery = query.Encode()
+
+		resp, err := s.do(ctx, "GET", listURL, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result S3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to parse response: %w", err)
+		}
+
+		for _, object := range result.Contents {
+			if err := fn(BlobInfo{Key: object.Key, Size: object.Size, ModTime: object.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// PresignGet returns a SigV4 presigned URL on the public endpoint. The
+// signing time is rounded down to the hour, so the URL stays the same for
+// an hour and browsers can cache the image.
+func (s *S3BlobStore) PresignGet(key string, ttl time.Duration) (string, error) {
+	now := time.Now().UTC().Truncate(time.Hour)
+	ttl += time.Hour
+	if ttl > s3MaxPresignTTL {
+		ttl = s3MaxPresignTTL
+	}
+	return s.presign("GET", s.objectURL(s.publicEndpoint, key), ttl, now), nil
+}
+
+func (s *S3BlobStore) presign(method string, objectURL *url.URL, ttl time.Duration, now time.Time) string {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := s.scope(now)
+
+	query := objectURL.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.accessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(ttl/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		objectURL.EscapedPath(),
+		s3CanonicalQuery(query),
+		"host:" + objectURL.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	query.Set("X-Amz-Signature", s.signature(canonicalRequest, amzDate, scope, now))
+	presigned := *objectURL
+	presigned.RawQuery = s3CanonicalQuery(query)
+	return presigned.String()
+}
+
+// sign adds the SigV4 Authorization header to a request.
+func (s *S3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := s.scope(now)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	signature := s.signature(canonicalRequest, amzDate, scope, now)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func (s *S3BlobStore) scope(now time.Time) string {
+	return now.UTC().Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+func (s *S3BlobStore) signature(canonicalRequest string, amzDate string, scope string, now time.Time) string {
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := s3HMAC([]byte("AWS4"+s.secretKey), now.UTC().Format("20060102"))
+	key = s3HMAC(key, s.region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, as
+// SigV4 requires.
+func s3Escape(value string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+// s3CanonicalQuery returns the query sorted by name with SigV4 escaping.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// do sends a signed request. 404 responses are ErrBlobNotFound, other
+// errors carry the S3 error message.
+func (s *S3BlobStore) do(ctx context.Context, method string, requestURL *url.URL, header http.Header, body []byte) (*http.Response, error) {
+	payloadHash := s3EmptyPayloadHash
+	var reqBody io.Reader
+	if body != nil {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+		reqBody = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, requestURL.String(), reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrBlobNotFound
+	}
+	respBody, _ := io.ReadAll(resp.Body)
+	var s3Err S3ErrorResponse
+	if xml.Unmarshal(respBody, &s3Err) == nil && s3Err.Message != "" {
+		return nil, fmt.Errorf("s3 API error: %s: %s (status: %d)", s3Err.Code, s3Err.Message, resp.StatusCode)
+	}
+	return nil, fmt.Errorf("s3 API error: %s (status: %d)", string(respBody), resp.StatusCode)
+}
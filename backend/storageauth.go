@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Lifetimes of signed storage URLs. URLs in API responses live for
+// STORAGE_URL_TTL_MINUTES, share links for as long as the user asks, up to
+// maxShareURLTTL.
+const (
+	defaultStorageURLTTLMinutes = 24 * 60
+	defaultShareURLTTL          = 7 * 24 * time.Hour
+	maxShareURLTTL              = 30 * 24 * time.Hour
+)
+
+// defaultSessionSecret is used when SESSION_SECRET is not set.
+const defaultSessionSecret = "coverflow-ai-secret-key-change-in-production"
+
+// storageURLSecret is the key of the storage URL signatures,
+// STORAGE_URL_SECRET or the session secret.
+func storageURLSecret() []byte {
+	if secret := os.Getenv("STORAGE_URL_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return []byte(defaultSessionSecret)
+}
+
+// storageSignature signs a storage path together with its expiry time.
+func storageSignature(savedPath string, expires int64) string {
+	mac := hmac.New(sha256.New, storageURLSecret())
+	mac.Write([]byte(savedPath + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signStorageURL returns a URL of a storage file that anyone can load until
+// it expires. The expiry is rounded up to the hour, so the URL stays the
+// same for an hour and browsers can cache the image.
+func signStorageURL(savedPath string, ttl time.Duration) (string, time.Time) {
+	expires := time.Now().Add(ttl).Truncate(time.Hour).Add(time.Hour)
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", storageSignature(savedPath, expires.Unix()))
+	return storageURL(savedPath) + "?" + query.Encode(), expires
+}
+
+// signedURL presigns a storage URL from the database for an API response.
+// Other URLs, e.g. of the provider, are returned unchanged.
+func signedURL(store BlobStore, rawURL string) string {
+	savedPath, ok := storagePath(rawURL)
+	if !ok {
+		return rawURL
+	}
+	ttl := time.Duration(envInt("STORAGE_URL_TTL_MINUTES", defaultStorageURLTTLMinutes)) * time.Minute
+	signed, err := store.PresignGet(savedPath, ttl)
+	if err != nil {
+		fmt.Printf("Warning: Failed to presign %s: %v\n", savedPath, err)
+		return rawURL
+	}
+	return signed
+}
+
+// signJobURLs replaces the stored URLs of the jobs with signed ones.
+func signJobURLs(store BlobStore, jobs []GenerationJob) {
+	for i := range jobs {
+		jobs[i].ImageURL = signedURL(store, jobs[i].ImageURL)
+	}
+}
+
+// signGenerationURLs replaces the stored URLs of the generations with
+// signed ones.
+func signGenerationURLs(store BlobStore, generations []Generation) {
+	for i := range generations {
+		generations[i].ImageURL = signedURL(store, generations[i].ImageURL)
+		generations[i].InputURL = signedURL(store, generations[i].InputURL)
+	}
+}
+
+// verifyStorageSignature checks the expires and sig query parameters of a
+// signed URL.
+func verifyStorageSignature(savedPath string, expires string, signature string, now time.Time) bool {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > unix {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(storageSignature(savedPath, unix)))
+}
+
+// canAccessStorage tells whether the user may load the files of owner, the
+// first element of the storage path. Files of a guest stay where they were
+// after the guest was merged into an account.
+func canAccessStorage(db *gorm.DB, userID string, owner string) bool {
+	if userID == owner {
+		return true
+	}
+	if !isGuestID(owner) {
+		return false
+	}
+	var count int64
+	db.Model(&User{}).Where("id = ? AND merged_into = ?", owner, userID).Count(&count)
+	return count > 0
+}
+
+// serveStorage serves the files of /storage to their owner, or to anyone
+// with a valid signed URL. Files of a local store are sent directly, other
+// stores are redirected to a short lived presigned URL.
+func serveStorage(db *gorm.DB, guests *GuestManager, store BlobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		savedPath := strings.TrimPrefix(path.Clean("/"+c.Param("path")), "/")
+		owner, _, ok := strings.Cut(savedPath, "/")
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+
+		// Content addressed files never change under their key
+		hash, immutable := contentHash(savedPath)
+
+		var cacheControl string
+		if c.Query("sig") != "" {
+			if !verifyStorageSignature(savedPath, c.Query("expires"), c.Query("sig"), time.Now()) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired link"})
+				return
+			}
+			expires, _ := strconv.ParseInt(c.Query("expires"), 10, 64)
+			cacheControl = fmt.Sprintf("public, max-age=%d", expires-time.Now().Unix())
+			if immutable {
+				// Cached until the signed URL itself stops working
+				cacheControl += ", immutable"
+			}
+		} else {
+			userID := guests.CurrentUserID(c)
+			if userID == "" {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+				return
+			}
+			// Other users' files are reported as missing, not as forbidden
+			if !canAccessStorage(db, userID, owner) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+				return
+			}
+			cacheControl = "private, max-age=3600"
+			if immutable {
+				cacheControl = "private, " + immutableCacheControl
+			}
+		}
+
+		fileStore, isFile := store.(FileBlobStore)
+		if !isFile {
+			presigned, err := store.PresignGet(savedPath, 5*time.Minute)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load file"})
+				return
+			}
+			// The presigned URL expires soon, the redirect must not be cached
+			c.Header("Cache-Control", "no-store")
+			c.Redirect(http.StatusFound, presigned)
+			return
+		}
+
+		if _, err := store.Stat(c.Request.Context(), savedPath); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		c.Header("Cache-Control", cacheControl)
+		// The name is the SHA-256 of the content, a strong ETag; c.File
+		// answers If-None-Match with 304
+		if immutable {
+			c.Header("ETag", `"`+hash+`"`)
+		}
+		c.File(fileStore.FilePath(savedPath))
+	}
+}
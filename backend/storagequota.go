@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Storage tiers, the quota grows with what the user pays for.
+const (
+	StorageTierFree       = "free"
+	StorageTierPack       = "pack"       // bought a generation pack
+	StorageTierSubscriber = "subscriber" // has a running subscription
+)
+
+// Default quotas of the tiers, overridable with STORAGE_QUOTA_<TIER>_MB and
+// STORAGE_QUOTA_<TIER>_FILES, e.g. STORAGE_QUOTA_PACK_MB.
+var defaultStorageQuotas = map[string]StorageQuota{
+	StorageTierFree:       {Bytes: 100 << 20, Files: 200},
+	StorageTierPack:       {Bytes: 1 << 30, Files: 2000},
+	StorageTierSubscriber: {Bytes: 5 << 30, Files: 10000},
+}
+
+// storageCleanupHint tells users over their quota how to get below it.
+const storageCleanupHint = "Delete covers you no longer need from your generation history (DELETE /api/generations/:id) to free up space."
+
+// ErrStorageQuotaExceeded is returned when new files would not fit in the
+// user's storage quota.
+var ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+
+// StorageQuota limits the stored files of a user.
+type StorageQuota struct {
+	Bytes int64
+	Files int
+}
+
+// StorageUsage is the storage a user uses and may use.
+type StorageUsage struct {
+	Tier       string `json:"tier"`
+	UsedBytes  int64  `json:"used_bytes"`
+	UsedFiles  int    `json:"used_files"`
+	QuotaBytes int64  `json:"quota_bytes"`
+	QuotaFiles int    `json:"quota_files"`
+}
+
+// storageQuota returns the quota of a tier.
+func storageQuota(tier string) StorageQuota {
+	quota := defaultStorageQuotas[tier]
+	prefix := "STORAGE_QUOTA_" + strings.ToUpper(tier)
+	return StorageQuota{
+		Bytes: int64(envInt(prefix+"_MB", int(quota.Bytes>>20))) << 20,
+		Files: envInt(prefix+"_FILES", quota.Files),
+	}
+}
+
+// storageTier returns the tier of a user: subscriber while a subscription
+// runs, pack buyer after any completed pack payment, free otherwise.
+func storageTier(db *gorm.DB, userID string) (string, error) {
+	subscription, err := ActiveSubscription(db, userID, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if subscription != nil {
+		return StorageTierSubscriber, nil
+	}
+
+	var packs int64
+	err = db.Model(&Transaction{}).
+		Where("user_id = ? AND status = ? AND package_kind = ?", userID, "completed", PackageKindPack).
+		Count(&packs).Error
+	if err != nil {
+		return "", err
+	}
+	if packs > 0 {
+		return StorageTierPack, nil
+	}
+	return StorageTierFree, nil
+}
+
+// GetStorageUsage returns the storage usage and quota of a user.
+func GetStorageUsage(db *gorm.DB, userID string) (*StorageUsage, error) {
+	var user User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+	tier, err := storageTier(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	quota := storageQuota(tier)
+	return &StorageUsage{
+		Tier:       tier,
+		UsedBytes:  user.StorageBytes,
+		UsedFiles:  user.StorageFiles,
+		QuotaBytes: quota.Bytes,
+		QuotaFiles: quota.Files,
+	}, nil
+}
+
+// CheckStorageQuota returns ErrStorageQuotaExceeded, together with the
+// usage, if the given number of new files and bytes would not fit in the
+// quota. Results are checked before they are generated, so the size of the
+// collage is all that is known.
+func CheckStorageQuota(db *gorm.DB, userID string, files int, bytes int64) (*StorageUsage, error) {
+	usage, err := GetStorageUsage(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if usage.UsedFiles+files > usage.QuotaFiles || usage.UsedBytes+bytes > usage.QuotaBytes {
+		return usage, ErrStorageQuotaExceeded
+	}
+	return usage, nil
+}
+
+// addStorageUsage changes the storage usage of a user by files and bytes,
+// negative when files are removed. The usage never goes below zero, removing
+// more than was added is logged as the accounting bug it is.
+func addStorageUsage(tx *gorm.DB, userID string, files int, bytes int64) error {
+	if files < 0 || bytes < 0 {
+		var user User
+		if err := tx.Select("storage_files", "storage_bytes").Where("id = ?", userID).First(&user).Error; err == nil {
+			if user.StorageFiles+files < 0 || user.StorageBytes+bytes < 0 {
+				fmt.Printf("Warning: Storage usage of %s would go negative (%d files, %d bytes, removing %d files, %d bytes)\n",
+					userID, user.StorageFiles, user.StorageBytes, -files, -bytes)
+			}
+		}
+	}
+	err := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"storage_files": gorm.Expr("MAX(storage_files + ?, 0)", files),
+		"storage_bytes": gorm.Expr("MAX(storage_bytes + ?, 0)", bytes),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update storage usage: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// assertStorageUsage fails unless the user uses files and bytes of storage.
+func assertStorageUsage(t *testing.T, db *gorm.DB, userID string, files int, bytes int64) {
+	t.Helper()
+	usage, err := GetStorageUsage(db, userID)
+	if err != nil {
+		t.Fatalf("GetStorageUsage: %v", err)
+	}
+	if usage.UsedFiles != files || usage.UsedBytes != bytes {
+		t.Fatalf("storage usage = %d files, %d bytes, want %d files, %d bytes", usage.UsedFiles, usage.UsedBytes, files, bytes)
+	}
+}
+
+func TestCheckStorageQuotaTiers(t *testing.T) {
+	t.Setenv("STORAGE_QUOTA_FREE_FILES", "2")
+	t.Setenv("STORAGE_QUOTA_FREE_MB", "1")
+	t.Setenv("STORAGE_QUOTA_PACK_FILES", "5")
+	db := newTestDB(t)
+	user := newTestUser(t, db, 0, 0)
+
+	checkTier := func(tier string, files int) {
+		t.Helper()
+		usage, err := CheckStorageQuota(db, user.ID, files, 0)
+		if err != nil || usage.Tier != tier {
+			t.Fatalf("CheckStorageQuota(%d files) = %+v, %v, want tier %s", files, usage, err, tier)
+		}
+		usage, err = CheckStorageQuota(db, user.ID, files+1, 0)
+		if !errors.Is(err, ErrStorageQuotaExceeded) || usage == nil || usage.QuotaFiles != files {
+			t.Fatalf("CheckStorageQuota(%d files) = %+v, %v, want %v", files+1, usage, err, ErrStorageQuotaExceeded)
+		}
+	}
+
+	checkTier(StorageTierFree, 2)
+	if _, err := CheckStorageQuota(db, user.ID, 1, 2<<20); !errors.Is(err, ErrStorageQuotaExceeded) {
+		t.Fatalf("CheckStorageQuota(2 MB) err = %v, want %v", err, ErrStorageQuotaExceeded)
+	}
+
+	// A pack counts once it is paid
+	transaction := newTestTransaction(t, db, user.ID, "lava", "order-1", 2.99)
+	checkTier(StorageTierFree, 2)
+	if _, err := CompleteTransaction(db, transaction); err != nil {
+		t.Fatalf("CompleteTransaction: %v", err)
+	}
+	checkTier(StorageTierPack, 5)
+
+	// A subscription wins over packs
+	buySubscription(t, db, user.ID)
+	checkTier(StorageTierSubscriber, defaultStorageQuotas[StorageTierSubscriber].Files)
+}
+
+func TestStorageUsageAfterDeleteAndCollect(t *testing.T) {
+	db := newTestDB(t)
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalBlobStore: %v", err)
+	}
+	user := newTestUser(t, db, 0, 0)
+
+	// Two variants share the collage, it is counted once
+	first := newStoredGeneration(t, db, store, user.ID, "cover 1", "collage", time.Now())
+	second := newStoredGeneration(t, db, store, user.ID, "cover 2", "collage", time.Now())
+	assertStorageUsage(t, db, user.ID, 3, int64(len("cover 1")+len("cover 2")+len("collage")))
+
+	if err := DeleteGeneration(db, store, first); err != nil {
+		t.Fatalf("DeleteGeneration: %v", err)
+	}
+	assertStorageUsage(t, db, user.ID, 2, int64(len("cover 2")+len("collage")))
+	if err := DeleteGeneration(db, store, second); err != nil {
+		t.Fatalf("DeleteGeneration: %v", err)
+	}
+	assertStorageUsage(t, db, user.ID, 0, 0)
+
+	// Collecting the released blobs does not subtract them again
+	if removed, _ := collectBlobGarbage(db, store, 0); removed != 3 {
+		t.Fatalf("collected %d blobs, want 3", removed)
+	}
+	assertStorageUsage(t, db, user.ID, 0, 0)
+	if keys := listKeys(t, store, ""); len(keys) != 0 {
+		t.Fatalf("files left = %v", keys)
+	}
+
+	// Removing more than was added leaves the usage at zero
+	if err := addStorageUsage(db, user.ID, -1, -10); err != nil {
+		t.Fatalf("addStorageUsage: %v", err)
+	}
+	assertStorageUsage(t, db, user.ID, 0, 0)
+}
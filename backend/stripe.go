@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stripeWebhookTolerance is how old a signed webhook may be, against replays.
+const stripeWebhookTolerance = 5 * time.Minute
+
+type StripeCheckoutSession struct {
+	ID            string `json:"id"`
+	URL           string `json:"url"`
+	Status        string `json:"status"`         // "open", "complete", "expired"
+	PaymentStatus string `json:"payment_status"` // "paid", "unpaid", "no_payment_required"
+	Subscription  string `json:"subscription"`
+	AmountTotal   int64  `json:"amount_total"` // minor units
+}
+
+type StripeInvoice struct {
+	ID            string `json:"id"`
+	Subscription  string `json:"subscription"`
+	BillingReason string `json:"billing_reason"` // "subscription_create", "subscription_cycle", ...
+	AmountPaid    int64  `json:"amount_paid"`
+}
+
+type StripeSubscription struct {
+	ID string `json:"id"`
+}
+
+type StripeEvent struct {
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+type StripeErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// StripeProvider takes card payments through Stripe Checkout, for buyers
+// outside of the regions Lava Top serves well.
+type StripeProvider struct{}
+
+func init() {
+	RegisterPaymentProvider(&StripeProvider{})
+}
+
+func (p *StripeProvider) Name() string {
+	return "stripe"
+}
+
+func (p *StripeProvider) DisplayName() string {
+	return "Stripe"
+}
+
+func (p *StripeProvider) Currencies() []string {
+	return []string{"USD", "EUR"}
+}
+
+func (p *StripeProvider) Configured() bool {
+	return os.Getenv("STRIPE_SECRET_KEY") != ""
+}
+
+func (p *StripeProvider) apiURL() string {
+	if apiURL := os.Getenv("STRIPE_API_URL"); apiURL != "" {
+		return apiURL
+	}
+	return "https://api.stripe.com"
+}
+
+func (p *StripeProvider) CreateInvoice(ctx context.Context, invoice PaymentInvoice) (*PaymentOrder, error) {
+	if !p.Configured() {
+		return nil, fmt.Errorf("STRIPE_SECRET_KEY must be set")
+	}
+
+	frontendURL := os.Getenv("FRONTEND_URL")
+	if frontendURL == "" {
+		frontendURL = "http://localhost:3000"
+	}
+	frontendURL = strings.TrimRight(frontendURL, "/")
+
+	form := url.Values{}
+	form.Set("mode", "payment")
+	form.Set("client_reference_id", invoice.TransactionID)
+	form.Set("metadata[transaction_id]", invoice.TransactionID)
+	form.Set("success_url", frontendURL+"/?payment=success")
+	form.Set("cancel_url", frontendURL+"/?payment=cancelled")
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("line_items[0][price_data][currency]", strings.ToLower(invoice.Currency))
+	form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(int64(math.Round(invoice.Amount*100)), 10))
+	form.Set("line_items[0][price_data][product_data][name]", invoice.Description)
+	if invoice.Recurring {
+		form.Set("mode", "subscription")
+		form.Set("line_items[0][price_data][recurring][interval]", "month")
+	}
+
+	var session StripeCheckoutSession
+	if err := p.do(ctx, "POST", "/v1/checkout/sessions", form, &session); err != nil {
+		return nil, err
+	}
+	return &PaymentOrder{OrderID: session.ID, PaymentURL: session.URL}, nil
+}
+
+func (p *StripeProvider) FetchStatus(ctx context.Context, orderID string) (*PaymentEvent, error) {
+	if !p.Configured() {
+		return nil, fmt.Errorf("STRIPE_SECRET_KEY must be set")
+	}
+
+	var session StripeCheckoutSession
+	if err := p.do(ctx, "GET", "/v1/checkout/sessions/"+url.PathEscape(orderID), nil, &session); err != nil {
+		return nil, err
+	}
+	return stripeSessionEvent(&session), nil
+}
+
+// ParseWebhook verifies the Stripe-Signature header and maps the events
+// that change a payment or subscription. Other events return nil.
+func (p *StripeProvider) ParseWebhook(header http.Header, body []byte) (*PaymentEvent, error) {
+	if err := verifyStripeSignature(header.Get("Stripe-Signature"), body, time.Now()); err != nil {
+		return nil, err
+	}
+
+	var event StripeEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid webhook data: %w", err)
+	}
+
+	switch event.Type {
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded",
+		"checkout.session.async_payment_failed", "checkout.session.expired":
+		var session StripeCheckoutSession
+		if err := json.Unmarshal(event.Data.Object, &session); err != nil {
+			return nil, fmt.Errorf("invalid webhook data: %w", err)
+		}
+		paymentEvent := stripeSessionEvent(&session)
+		if event.Type == "checkout.session.async_payment_failed" {
+			paymentEvent.Status = PaymentStatusFailed
+		}
+		return paymentEvent, nil
+
+	case "invoice.paid", "invoice.payment_failed":
+		var invoice StripeInvoice
+		if err := json.Unmarshal(event.Data.Object, &invoice); err != nil {
+			return nil, fmt.Errorf("invalid webhook data: %w", err)
+		}
+		// The first invoice of a subscription is paid through the checkout session
+		if invoice.Subscription == "" || invoice.BillingReason == "subscription_create" {
+			return nil, nil
+		}
+		status := PaymentStatusSucceeded
+		if event.Type == "invoice.payment_failed" {
+			status = PaymentStatusFailed
+		}
+		return &PaymentEvent{
+			OrderID:        invoice.ID,
+			SubscriptionID: invoice.Subscription,
+			Status:         status,
+			Amount:         float64(invoice.AmountPaid) / 100,
+		}, nil
+
+	case "customer.subscription.deleted":
+		var subscription StripeSubscription
+		if err := json.Unmarshal(event.Data.Object, &subscription); err != nil {
+			return nil, fmt.Errorf("invalid webhook data: %w", err)
+		}
+		return &PaymentEvent{SubscriptionID: subscription.ID, Status: PaymentStatusCancelled}, nil
+	}
+	return nil, nil
+}
+
+func stripeSessionEvent(session *StripeCheckoutSession) *PaymentEvent {
+	event := &PaymentEvent{
+		OrderID:        session.ID,
+		SubscriptionID: session.Subscription,
+		Status:         PaymentStatusPending,
+		Amount:         float64(session.AmountTotal) / 100,
+	}
+	switch {
+	case session.PaymentStatus == "paid" || session.PaymentStatus == "no_payment_required":
+		event.Status = PaymentStatusSucceeded
+	case session.Status == "expired":
+		event.Status = PaymentStatusFailed
+	}
+	return event
+}
+
+// verifyStripeSignature checks a "t=<unix time>,v1=<hex HMAC-SHA256>"
+// header against the raw body, signed with STRIPE_WEBHOOK_SECRET.
+func verifyStripeSignature(header string, body []byte, now time.Time) error {
+	secret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if secret == "" {
+		return fmt.Errorf("STRIPE_WEBHOOK_SECRET must be set")
+	}
+
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidWebhookSignature
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > stripeWebhookTolerance || age < -stripeWebhookTolerance {
+		return ErrInvalidWebhookSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrInvalidWebhookSignature
+}
+
+// do sends a form encoded request to the Stripe API and decodes the response.
+func (p *StripeProvider) do(ctx context.Context, method string, path string, form url.Values, out interface{}) error {
+	var reqBody io.Reader
+	if form != nil {
+		reqBody = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.apiURL()+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("STRIPE_SECRET_KEY"))
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var stripeErr StripeErrorResponse
+		if json.Unmarshal(body, &stripeErr) == nil && stripeErr.Error.Message != "" {
+			return fmt.Errorf("stripe API error: %s (status: %d)", stripeErr.Error.Message, resp.StatusCode)
+		}
+		return fmt.Errorf("stripe API error: %s (status: %d)", string(body), resp.StatusCode)
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testStripeWebhookSecret = "whsec_test"
+
+// newStripeStub starts a Stripe API stub for Checkout sessions. The
+// session cs_paid is paid, cs_open is not and any other is missing.
+func newStripeStub(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("Authorization") != "Bearer sk_test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":{"message":"Invalid API Key provided"}}`)
+			return
+		}
+
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/v1/checkout/sessions":
+			if r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+				t.Errorf("Content-Type = %s", r.Header.Get("Content-Type"))
+			}
+			if err := r.ParseForm(); err != nil {
+				t.Errorf("parse form: %v", err)
+				return
+			}
+			want := map[string]string{
+				"mode":                                           "subscription",
+				"client_reference_id":                            "tx-1",
+				"metadata[transaction_id]":                       "tx-1",
+				"line_items[0][price_data][currency]":            "usd",
+				"line_items[0][price_data][unit_amount]":         "999",
+				"line_items[0][price_data][recurring][interval]": "month",
+				"line_items[0][price_data][product_data][name]":  "Monthly",
+			}
+			for key, value := range want {
+				if got := r.PostForm.Get(key); got != value {
+					t.Errorf("%s = %q, want %q", key, got, value)
+				}
+			}
+			fmt.Fprint(w, `{"id":"cs_new","url":"https://checkout.stripe.test/cs_new","status":"open"}`)
+		case r.Method == "GET" && r.URL.Path == "/v1/checkout/sessions/cs_paid":
+			fmt.Fprint(w, `{"id":"cs_paid","status":"complete","payment_status":"paid","amount_total":999,"subscription":"sub_1"}`)
+		case r.Method == "GET" && r.URL.Path == "/v1/checkout/sessions/cs_open":
+			fmt.Fprint(w, `{"id":"cs_open","status":"open","payment_status":"unpaid","amount_total":999}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"message":"No such checkout.session"}}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("STRIPE_API_URL", server.URL)
+	t.Setenv("STRIPE_SECRET_KEY", "sk_test")
+	t.Setenv("STRIPE_WEBHOOK_SECRET", testStripeWebhookSecret)
+	return server
+}
+
+// signStripeWebhook returns a Stripe-Signature header of body sent at.
+func signStripeWebhook(body []byte, secret string, at time.Time) http.Header {
+	timestamp := fmt.Sprint(at.Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	header := http.Header{}
+	header.Set("Stripe-Signature", fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil))))
+	return header
+}
+
+// stripeEvent returns the body of an event of type with object.
+func stripeEvent(t *testing.T, eventType string, object interface{}) []byte {
+	t.Helper()
+	body, err := json.Marshal(map[string]interface{}{
+		"type": eventType,
+		"data": map[string]interface{}{"object": object},
+	})
+	if err != nil {
+		t.Fatalf("marshal event: %v", err)
+	}
+	return body
+}
+
+func TestStripeCreateInvoice(t *testing.T) {
+	newStripeStub(t)
+	provider := &StripeProvider{}
+	invoice := PaymentInvoice{TransactionID: "tx-1", Amount: 9.99, Currency: "USD", Description: "Monthly", Recurring: true}
+
+	order, err := provider.CreateInvoice(context.Background(), invoice)
+	if err != nil {
+		t.Fatalf("CreateInvoice: %v", err)
+	}
+	if order.OrderID != "cs_new" || order.PaymentURL != "https://checkout.stripe.test/cs_new" {
+		t.Fatalf("order = %+v", order)
+	}
+
+	t.Setenv("STRIPE_SECRET_KEY", "sk_wrong")
+	_, err = provider.CreateInvoice(context.Background(), invoice)
+	if err == nil || !strings.Contains(err.Error(), "Invalid API Key provided") {
+		t.Fatalf("err = %v, want the Stripe error message", err)
+	}
+}
+
+func TestStripeFetchStatus(t *testing.T) {
+	newStripeStub(t)
+	provider := &StripeProvider{}
+
+	event, err := provider.FetchStatus(context.Background(), "cs_paid")
+	if err != nil {
+		t.Fatalf("FetchStatus: %v", err)
+	}
+	if event.OrderID != "cs_paid" || event.Status != PaymentStatusSucceeded || event.Amount != 9.99 || event.SubscriptionID != "sub_1" {
+		t.Fatalf("event = %+v", event)
+	}
+
+	event, err = provider.FetchStatus(context.Background(), "cs_open")
+	if err != nil {
+		t.Fatalf("FetchStatus: %v", err)
+	}
+	if event.Status != PaymentStatusPending {
+		t.Fatalf("status = %s, want %s", event.Status, PaymentStatusPending)
+	}
+
+	if _, err := provider.FetchStatus(context.Background(), "cs_missing"); err == nil {
+		t.Fatal("FetchStatus succeeded for a missing session")
+	}
+}
+
+func TestStripeParseWebhook(t *testing.T) {
+	newStripeStub(t)
+	provider := &StripeProvider{}
+	now := time.Now()
+
+	body := stripeEvent(t, "checkout.session.completed", map[string]interface{}{
+		"id": "cs_paid", "status": "complete", "payment_status": "paid", "amount_total": 500,
+	})
+	event, err := provider.ParseWebhook(signStripeWebhook(body, testStripeWebhookSecret, now), body)
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if event.OrderID != "cs_paid" || event.Status != PaymentStatusSucceeded || event.Amount != 5 {
+		t.Fatalf("event = %+v", event)
+	}
+
+	renewal := stripeEvent(t, "invoice.paid", map[string]interface{}{
+		"id": "in_2", "subscription": "sub_1", "billing_reason": "subscription_cycle", "amount_paid": 999,
+	})
+	event, err = provider.ParseWebhook(signStripeWebhook(renewal, testStripeWebhookSecret, now), renewal)
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if event.OrderID != "in_2" || event.SubscriptionID != "sub_1" || event.Status != PaymentStatusSucceeded {
+		t.Fatalf("renewal event = %+v", event)
+	}
+
+	ignored := stripeEvent(t, "customer.created", map[string]interface{}{"id": "cus_1"})
+	event, err = provider.ParseWebhook(signStripeWebhook(ignored, testStripeWebhookSecret, now), ignored)
+	if err != nil || event != nil {
+		t.Fatalf("unhandled event: event = %+v, err = %v", event, err)
+	}
+}
+
+func TestStripeParseWebhookRejected(t *testing.T) {
+	newStripeStub(t)
+	provider := &StripeProvider{}
+	now := time.Now()
+	body := stripeEvent(t, "checkout.session.completed", map[string]interface{}{
+		"id": "cs_paid", "status": "complete", "payment_status": "paid", "amount_total": 500,
+	})
+
+	tampered := signStripeWebhook(body, testStripeWebhookSecret, now)
+	tampered.Set("Stripe-Signature", strings.Replace(tampered.Get("Stripe-Signature"), "v1=", "v1=00", 1))
+
+	for name, header := range map[string]http.Header{
+		"bad signature":   signStripeWebhook(body, "whsec_other", now),
+		"tampered":        tampered,
+		"stale timestamp": signStripeWebhook(body, testStripeWebhookSecret, now.Add(-stripeWebhookTolerance-time.Minute)),
+		"future":          signStripeWebhook(body, testStripeWebhookSecret, now.Add(stripeWebhookTolerance+time.Minute)),
+		"no signature":    {},
+	} {
+		if _, err := provider.ParseWebhook(header, body); err != ErrInvalidWebhookSignature {
+			t.Errorf("%s: err = %v, want %v", name, err, ErrInvalidWebhookSignature)
+		}
+	}
+}
+
+func TestStripeWebhookReplayed(t *testing.T) {
+	newStripeStub(t)
+	db := newTestDB(t)
+	user := newTestUser(t, db, 0, 0)
+	transaction := newTestTransaction(t, db, user.ID, "stripe", "cs_paid", 5)
+	provider := &StripeProvider{}
+
+	body := stripeEvent(t, "checkout.session.completed", map[string]interface{}{
+		"id": "cs_paid", "status": "complete", "payment_status": "paid", "amount_total": 500,
+	})
+	header := signStripeWebhook(body, testStripeWebhookSecret, time.Now())
+
+	// Stripe retries deliveries, each one is valid but grants only once
+	for i := 0; i < 3; i++ {
+		event, err := provider.ParseWebhook(header, body)
+		if err != nil {
+			t.Fatalf("ParseWebhook: %v", err)
+		}
+		if err := ApplyPaymentEvent(db, provider.Name(), event); err != nil {
+			t.Fatalf("ApplyPaymentEvent: %v", err)
+		}
+	}
+	assertTransactionStatus(t, db, transaction.ID, "completed")
+	assertPaidBalance(t, db, user.ID, 10)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	SubscriptionStatusActive    = "active"
+	SubscriptionStatusPastDue   = "past_due"  // renewal payment failed, usable until the period ends
+	SubscriptionStatusCancelled = "cancelled" // no more renewals, usable until the period ends
+	SubscriptionStatusExpired   = "expired"
+	SubscriptionStatusScheduled = "scheduled" // bought while another period runs, starts when it ends
+)
+
+// Subscription is a monthly plan of a user. The generations of the current
+// period are kept in User.SubscriptionGenerations and are spent after the
+// free ones and before the paid ones.
+type Subscription struct {
+	ID                     string     `gorm:"primaryKey" json:"id"`
+	UserID                 string     `gorm:"index" json:"user_id"`
+	PackageID              string     `json:"package_id"`
+	PlanType               string     `json:"plan_type"`
+	PlanName               string     `json:"plan_name"`
+	Status                 string     `gorm:"index" json:"status"` // "active", "past_due", "cancelled", "expired", "scheduled"
+	Quota                  int        `json:"quota"`               // generations included per period
+	RolloverCap            int        `json:"rollover_cap"`        // unused generations carried into the next period
+	CurrentPeriodStart     time.Time  `json:"current_period_start"`
+	CurrentPeriodEnd       time.Time  `gorm:"index" json:"current_period_end"`
+	ProviderSubscriptionID string     `gorm:"index" json:"-"` // order of the first payment, renewal webhooks refer to it
+	CancelledAt            *time.Time `json:"cancelled_at,omitempty"`
+	CreatedAt              time.Time  `json:"created_at"`
+	UpdatedAt              time.Time  `json:"updated_at"`
+}
+
+// subscriptionPeriodEnd returns the end of a period that starts at start.
+func subscriptionPeriodEnd(start time.Time) time.Time {
+	return start.AddDate(0, 1, 0)
+}
+
+// ActiveSubscription returns the subscription whose period is running, or
+// nil if the user has none. Cancelled and past due subscriptions stay
+// usable until the end of the paid period.
+func ActiveSubscription(db *gorm.DB, userID string, now time.Time) (*Subscription, error) {
+	// Find instead of First, most users have no subscription
+	var subscriptions []Subscription
+	err := db.Where("user_id = ? AND status NOT IN ? AND current_period_end > ?", userID, []string{SubscriptionStatusExpired, SubscriptionStatusScheduled}, now.UTC()).
+		Order("current_period_end DESC").
+		Limit(1).
+		Find(&subscriptions).Error
+	if err != nil || len(subscriptions) == 0 {
+		return nil, err
+	}
+	return &subscriptions[0], nil
+}
+
+// ScheduledSubscription returns the subscription that starts when the
+// running one ends, or nil if there is none.
+func ScheduledSubscription(db *gorm.DB, userID string) (*Subscription, error) {
+	var subscriptions []Subscription
+	err := db.Where("user_id = ? AND status = ?", userID, SubscriptionStatusScheduled).
+		Order("current_period_start").
+		Limit(1).
+		Find(&subscriptions).Error
+	if err != nil || len(subscriptions) == 0 {
+		return nil, err
+	}
+	return &subscriptions[0], nil
+}
+
+// availableSubscriptionGenerations returns the subscription generations the
+// user can spend now. Generations of a period that is over are not counted
+// even before expireSubscriptionCredits took them back.
+func availableSubscriptionGenerations(db *gorm.DB, user *User, now time.Time) int {
+	if user.SubscriptionGenerations == 0 {
+		return 0
+	}
+	subscription, err := ActiveSubscription(db, user.ID, now)
+	if err != nil || subscription == nil {
+		return 0
+	}
+	return user.SubscriptionGenerations
+}
+
+// startSubscription starts the subscription bought by a completed
+// transaction. If the user already has a running subscription, for example
+// a cancelled one, the new subscription is scheduled and its quota is
+// granted when the running period ends, see startScheduledSubscriptions.
+func startSubscription(tx *gorm.DB, transaction *Transaction, now time.Time) error {
+	if err := expireSubscriptionCredits(tx, transaction.UserID, now); err != nil {
+		return err
+	}
+
+	running, err := ActiveSubscription(tx, transaction.UserID, now)
+	if err != nil {
+		return err
+	}
+
+	// Renewal events refer to the provider subscription, or to the first order
+	providerSubscriptionID := transaction.ProviderSubscriptionID
+	if providerSubscriptionID == "" {
+		providerSubscriptionID = transaction.LavaOrderID
+	}
+
+	var pkg Package
+	if err := tx.Where("id = ?", transaction.PackageID).First(&pkg).Error; err != nil {
+		return fmt.Errorf("unknown subscription plan: %s", transaction.PackageType)
+	}
+	subscription := &Subscription{
+		ID:                     uuid.New().String(),
+		UserID:                 transaction.UserID,
+		PackageID:              transaction.PackageID,
+		PlanType:               transaction.PackageType,
+		PlanName:               transaction.PackageName,
+		Status:                 SubscriptionStatusActive,
+		Quota:                  transaction.PackageCount,
+		RolloverCap:            pkg.RolloverCap,
+		CurrentPeriodStart:     now.UTC(),
+		CurrentPeriodEnd:       subscriptionPeriodEnd(now).UTC(),
+		ProviderSubscriptionID: providerSubscriptionID,
+	}
+	if running != nil {
+		subscription.Status = SubscriptionStatusScheduled
+		subscription.CurrentPeriodStart = running.CurrentPeriodEnd
+		subscription.CurrentPeriodEnd = subscriptionPeriodEnd(running.CurrentPeriodEnd).UTC()
+	}
+	if err := tx.Create(subscription).Error; err != nil {
+		return err
+	}
+
+	transaction.SubscriptionID = subscription.ID
+	if err := tx.Model(&Transaction{}).Where("id = ?", transaction.ID).Update("subscription_id", subscription.ID).Error; err != nil {
+		return err
+	}
+	if running != nil {
+		return nil
+	}
+	return startSubscriptionPeriod(tx, subscription, now, transaction.ID)
+}
+
+// startScheduledSubscriptions starts the user's scheduled subscriptions
+// whose period began: the unused generations are capped and the quota is
+// granted like at a renewal.
+func startScheduledSubscriptions(tx *gorm.DB, userID string, now time.Time) error {
+	var subscriptions []Subscription
+	err := tx.Where("user_id = ? AND status = ? AND current_period_start <= ?", userID, SubscriptionStatusScheduled, now.UTC()).
+		Order("current_period_start").
+		Find(&subscriptions).Error
+	if err != nil {
+		return err
+	}
+
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		// Only one call starts it, the others see it is no longer scheduled
+		result := tx.Model(&Subscription{}).
+			Where("id = ? AND status = ?", subscription.ID, SubscriptionStatusScheduled).
+			Update("status", SubscriptionStatusActive)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+
+		var transaction Transaction
+		if err := tx.Where("subscription_id = ?", subscription.ID).Order("created_at").First(&transaction).Error; err != nil {
+			return err
+		}
+		// A scheduled period that was due long ago starts now
+		start := subscription.CurrentPeriodStart
+		if subscriptionPeriodEnd(start).Before(now) {
+			start = now
+		}
+		if err := startSubscriptionPeriod(tx, subscription, start, transaction.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenewSubscription records a renewal payment reported by the payment
+// provider and starts the next period. orderID is the provider order of the
+// renewal, a replayed webhook with the same order is ignored. amount 0 means
+// the amount of the previous payment. A renewal paid with another amount is
+// recorded as a failed, flagged transaction and does not renew. Returns
+// whether the subscription was renewed by this call.
+func RenewSubscription(db *gorm.DB, subscriptionID string, orderID string, amount float64) (bool, error) {
+	if orderID == "" {
+		return false, fmt.Errorf("renewal order ID is required")
+	}
+
+	now := time.Now()
+	renewed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var subscription Subscription
+		if err := tx.Where("id = ?", subscriptionID).First(&subscription).Error; err != nil {
+			return err
+		}
+
+		var existing int64
+		if err := tx.Model(&Transaction{}).Where("lava_order_id = ?", orderID).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return nil
+		}
+
+		var previous Transaction
+		tx.Where("subscription_id = ? AND status = ?", subscription.ID, "completed").Order("created_at DESC").First(&previous)
+		// A discount code only applies to the first payment
+		expected := previous.Amount + previous.Discount
+		if amount == 0 {
+			amount = expected
+		}
+
+		transaction := Transaction{
+			ID:             uuid.New().String(),
+			UserID:         subscription.UserID,
+			PackageType:    subscription.PlanType,
+			PackageID:      subscription.PackageID,
+			PackageName:    subscription.PlanName,
+			PackageKind:    PackageKindSubscription,
+			PackageCount:   subscription.Quota,
+			PriceID:        previous.PriceID,
+			Amount:         amount,
+			Currency:       previous.Currency,
+			Status:         "completed",
+			LavaOrderID:    orderID,
+			Provider:       previous.Provider,
+			SubscriptionID: subscription.ID,
+		}
+		if expected > 0 && !paymentAmountMatches(amount, expected) {
+			fmt.Printf("Warning: Renewal %s of subscription %s was paid %.2f %s, expected %.2f, not renewing it\n",
+				orderID, subscription.ID, amount, previous.Currency, expected)
+			transaction.Status = "failed"
+			transaction.FlagReason = TransactionFlagAmountMismatch
+			transaction.PaidAmount = amount
+			transaction.Amount = expected
+			return tx.Create(&transaction).Error
+		}
+		if err := tx.Create(&transaction).Error; err != nil {
+			return err
+		}
+
+		// A renewal that arrives after the period ended starts a new one now
+		if err := expireSubscriptionCredits(tx, subscription.UserID, now); err != nil {
+			return err
+		}
+		start := subscription.CurrentPeriodEnd
+		if start.Before(now) {
+			start = now
+		}
+		if err := startSubscriptionPeriod(tx, &subscription, start, transaction.ID); err != nil {
+			return err
+		}
+		renewed = true
+		return nil
+	})
+	return renewed, err
+}
+
+// startSubscriptionPeriod caps the unused generations at the rollover cap,
+// grants the quota of the new period and makes the subscription active.
+func startSubscriptionPeriod(tx *gorm.DB, subscription *Subscription, start time.Time, transactionID string) error {
+	var user User
+	if err := tx.Where("id = ?", subscription.UserID).First(&user).Error; err != nil {
+		return err
+	}
+
+	if excess := user.SubscriptionGenerations - subscription.RolloverCap; excess > 0 {
+		err := tx.Model(&User{}).
+			Where("id = ?", user.ID).
+			Update("subscription_generations", gorm.Expr("subscription_generations - ?", excess)).Error
+		if err != nil {
+			return err
+		}
+		if err := recordCreditChange(tx, user.ID, CreditKindSubscription, -excess, CreditReasonSubscriptionExpiry, subscription.ID, "over rollover cap"); err != nil {
+			return err
+		}
+	}
+
+	err := tx.Model(&User{}).
+		Where("id = ?", user.ID).
+		Update("subscription_generations", gorm.Expr("subscription_generations + ?", subscription.Quota)).Error
+	if err != nil {
+		return err
+	}
+	if err := recordCreditChange(tx, user.ID, CreditKindSubscription, subscription.Quota, CreditReasonSubscriptionGrant, transactionID, ""); err != nil {
+		return err
+	}
+
+	subscription.Status = SubscriptionStatusActive
+	subscription.CurrentPeriodStart = start.UTC()
+	subscription.CurrentPeriodEnd = subscriptionPeriodEnd(start).UTC()
+	subscription.CancelledAt = nil
+	return tx.Model(subscription).Updates(map[string]interface{}{
+		"status":               subscription.Status,
+		"current_period_start": subscription.CurrentPeriodStart,
+		"current_period_end":   subscription.CurrentPeriodEnd,
+		"cancelled_at":         nil,
+	}).Error
+}
+
+// CancelSubscription stops the renewals. The generations of the paid period
+// stay usable until it ends.
+func CancelSubscription(db *gorm.DB, subscriptionID string) error {
+	now := time.Now().UTC()
+	return db.Model(&Subscription{}).
+		Where("id = ? AND status IN ?", subscriptionID, []string{SubscriptionStatusActive, SubscriptionStatusPastDue}).
+		Updates(map[string]interface{}{
+			"status":       SubscriptionStatusCancelled,
+			"cancelled_at": &now,
+		}).Error
+}
+
+// MarkSubscriptionPastDue records a failed renewal payment. The provider
+// retries the charge, a later successful renewal makes it active again.
+func MarkSubscriptionPastDue(db *gorm.DB, subscriptionID string) error {
+	return db.Model(&Subscription{}).
+		Where("id = ? AND status = ?", subscriptionID, SubscriptionStatusActive).
+		Update("status", SubscriptionStatusPastDue).Error
+}
+
+// expireSubscriptionCredits ends the user's subscriptions whose period is
+// over and starts the scheduled ones that follow them. The unused
+// generations are taken back, unless another subscription is running.
+func expireSubscriptionCredits(tx *gorm.DB, userID string, now time.Time) error {
+	// SQLite compares times as text, keep them all in UTC
+	result := tx.Model(&Subscription{}).
+		Where("user_id = ? AND status NOT IN ? AND current_period_end <= ?", userID, []string{SubscriptionStatusExpired, SubscriptionStatusScheduled}, now.UTC()).
+		Update("status", SubscriptionStatusExpired)
+	if result.Error != nil {
+		return result.Error
+	}
+	if err := startScheduledSubscriptions(tx, userID, now); err != nil {
+		return err
+	}
+
+	subscription, err := ActiveSubscription(tx, userID, now)
+	if err != nil || subscription != nil {
+		return err
+	}
+
+	var user User
+	if err := tx.Where("id = ?", userID).First(&user).Error; err != nil {
+		return err
+	}
+	if user.SubscriptionGenerations <= 0 {
+		return nil
+	}
+	err = tx.Model(&User{}).
+		Where("id = ?", userID).
+		Update("subscription_generations", gorm.Expr("subscription_generations - ?", user.SubscriptionGenerations)).Error
+	if err != nil {
+		return err
+	}
+	return recordCreditChange(tx, userID, CreditKindSubscription, -user.SubscriptionGenerations, CreditReasonSubscriptionExpiry, "", "subscription period ended")
+}
+
+// expireSubscriptions takes back the generations of all subscriptions
+// whose period ended without a renewal.
+func expireSubscriptions(db *gorm.DB) {
+	now := time.Now()
+
+	var userIDs []string
+	err := db.Model(&Subscription{}).
+		Where("status NOT IN ? AND current_period_end <= ?", []string{SubscriptionStatusExpired, SubscriptionStatusScheduled}, now.UTC()).
+		Distinct().
+		Pluck("user_id", &userIDs).Error
+	if err != nil {
+		fmt.Printf("Warning: Failed to load ended subscriptions: %v\n", err)
+		return
+	}
+
+	for _, userID := range userIDs {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return expireSubscriptionCredits(tx, userID, now)
+		})
+		if err != nil {
+			fmt.Printf("Warning: Failed to expire subscription of user %s: %v\n", userID, err)
+		}
+	}
+}
+
+// StartSubscriptionSweeper runs expireSubscriptions every interval.
+func StartSubscriptionSweeper(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			expireSubscriptions(db)
+		}
+	}()
+}
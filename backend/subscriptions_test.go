@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// buySubscription completes a payment for the pro_monthly plan.
+func buySubscription(t *testing.T, db *gorm.DB, userID string) *Transaction {
+	t.Helper()
+	var pkg Package
+	if err := db.Where("type = ?", "pro_monthly").First(&pkg).Error; err != nil {
+		t.Fatalf("load plan: %v", err)
+	}
+	transaction := &Transaction{
+		ID:           uuid.New().String(),
+		UserID:       userID,
+		PackageType:  pkg.Type,
+		PackageID:    pkg.ID,
+		PackageName:  pkg.Name,
+		PackageKind:  PackageKindSubscription,
+		PackageCount: pkg.Count,
+		Amount:       12.99,
+		Currency:     "USD",
+		Status:       "pending",
+		LavaOrderID:  uuid.New().String(),
+		Provider:     "lava",
+	}
+	if err := db.Create(transaction).Error; err != nil {
+		t.Fatalf("create transaction: %v", err)
+	}
+	if _, err := CompleteTransaction(db, transaction); err != nil {
+		t.Fatalf("CompleteTransaction: %v", err)
+	}
+	return transaction
+}
+
+// assertSubscriptionBalance fails unless the user has subscription
+// generations and the balance matches the ledger.
+func assertSubscriptionBalance(t *testing.T, db *gorm.DB, userID string, generations int) {
+	t.Helper()
+	reconciliation := assertConsistent(t, db, userID)
+	if reconciliation.SubscriptionBalance != generations {
+		t.Fatalf("subscription balance = %d, want %d", reconciliation.SubscriptionBalance, generations)
+	}
+}
+
+func TestStartSubscriptionDuringCancelledPeriod(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, db, 0, 0)
+
+	first := buySubscription(t, db, user.ID)
+	assertSubscriptionBalance(t, db, user.ID, 150)
+	if err := CancelSubscription(db, first.SubscriptionID); err != nil {
+		t.Fatalf("CancelSubscription: %v", err)
+	}
+	var running Subscription
+	db.Where("id = ?", first.SubscriptionID).First(&running)
+
+	// Buying again before the cancelled period ends grants nothing yet
+	second := buySubscription(t, db, user.ID)
+	assertSubscriptionBalance(t, db, user.ID, 150)
+	scheduled, err := ScheduledSubscription(db, user.ID)
+	if err != nil || scheduled == nil || scheduled.ID != second.SubscriptionID {
+		t.Fatalf("ScheduledSubscription = %+v, %v", scheduled, err)
+	}
+	if !scheduled.CurrentPeriodStart.Equal(running.CurrentPeriodEnd) {
+		t.Fatalf("scheduled period starts %s, want %s", scheduled.CurrentPeriodStart, running.CurrentPeriodEnd)
+	}
+	if active, _ := ActiveSubscription(db, user.ID, time.Now()); active == nil || active.ID != running.ID {
+		t.Fatalf("ActiveSubscription = %+v, want the cancelled one", active)
+	}
+
+	// When the cancelled period is over, the scheduled one starts with its
+	// quota and the rollover cap applied to what is left
+	after := running.CurrentPeriodEnd.Add(time.Minute)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return expireSubscriptionCredits(tx, user.ID, after)
+	})
+	if err != nil {
+		t.Fatalf("expireSubscriptionCredits: %v", err)
+	}
+	assertSubscriptionBalance(t, db, user.ID, 300)
+
+	active, err := ActiveSubscription(db, user.ID, after)
+	if err != nil || active == nil || active.ID != second.SubscriptionID || active.Status != SubscriptionStatusActive {
+		t.Fatalf("ActiveSubscription = %+v, %v, want the second one", active, err)
+	}
+	if !active.CurrentPeriodStart.Equal(running.CurrentPeriodEnd) {
+		t.Fatalf("period starts %s, want %s", active.CurrentPeriodStart, running.CurrentPeriodEnd)
+	}
+
+	// Running it again does not grant twice
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return expireSubscriptionCredits(tx, user.ID, after)
+	})
+	if err != nil {
+		t.Fatalf("expireSubscriptionCredits: %v", err)
+	}
+	assertSubscriptionBalance(t, db, user.ID, 300)
+}
+
+func TestRenewSubscriptionAmountMismatch(t *testing.T) {
+	db := newTestDB(t)
+	user := newTestUser(t, db, 0, 0)
+	first := buySubscription(t, db, user.ID)
+	var before Subscription
+	db.Where("id = ?", first.SubscriptionID).First(&before)
+
+	renewed, err := RenewSubscription(db, first.SubscriptionID, "renewal-1", 0.99)
+	if err != nil || renewed {
+		t.Fatalf("RenewSubscription = %v, %v, want not renewed", renewed, err)
+	}
+	assertSubscriptionBalance(t, db, user.ID, 150)
+
+	var after Subscription
+	db.Where("id = ?", first.SubscriptionID).First(&after)
+	if !after.CurrentPeriodEnd.Equal(before.CurrentPeriodEnd) {
+		t.Fatalf("period end moved to %s", after.CurrentPeriodEnd)
+	}
+	var flagged Transaction
+	if err := db.Where("lava_order_id = ?", "renewal-1").First(&flagged).Error; err != nil {
+		t.Fatalf("load renewal: %v", err)
+	}
+	if flagged.Status != "failed" || flagged.FlagReason != TransactionFlagAmountMismatch || flagged.PaidAmount != 0.99 {
+		t.Fatalf("renewal = %+v, want a failed and flagged transaction", flagged)
+	}
+
+	// The right amount renews
+	renewed, err = RenewSubscription(db, first.SubscriptionID, "renewal-2", 12.99)
+	if err != nil || !renewed {
+		t.Fatalf("RenewSubscription = %v, %v, want renewed", renewed, err)
+	}
+	assertSubscriptionBalance(t, db, user.ID, 300)
+}
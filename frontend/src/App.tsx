@@ -34,12 +34,28 @@ function App() {
         headers: {
           'Content-Type': 'application/json',
         },
+        withCredentials: true,
       })
 
+      // Generation runs in the background, poll the job until it finishes
+      let job = response.data
+      while (job.status === 'queued' || job.status === 'running') {
+        await new Promise((resolve) => setTimeout(resolve, 3000))
+        const jobResponse = await axios.get(`http://localhost:8080/api/jobs/${job.id}`, {
+          withCredentials: true,
+        })
+        job = jobResponse.data
+      }
+
+      if (job.status === 'failed') {
+        throw { response: { data: { error: 'Failed to generate cover', details: job.error } } }
+      }
+
       setGeneratedCover({
-        url: response.data.image_url,
-        id: response.data.id,
+        url: job.image_url,
+        id: job.id,
       })
+      refreshUser()
     } catch (error: any) {
       console.error('Error generating cover:', error)
       
@@ -61,8 +61,9 @@ export function AuthProvider({ children }: { children: React.ReactNode }) {
   }
 
   const signIn = async () => {
-    // Redirect to backend OAuth endpoint
-    window.location.href = 'http://localhost:8080/api/auth/google'
+    // Redirect to backend OAuth endpoint, with the code of a referral link (?ref=CODE)
+    const ref = new URLSearchParams(window.location.search).get('ref')
+    window.location.href = 'http://localhost:8080/api/auth/google' + (ref ? `?ref=${encodeURIComponent(ref)}` : '')
   }
 
   const signOut = async () => {